@@ -5,27 +5,77 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/iov-one/block-metrics/pkg/config"
 	"github.com/iov-one/block-metrics/pkg/metrics"
+	"github.com/iov-one/block-metrics/pkg/models"
 	"github.com/iov-one/block-metrics/pkg/store"
+	"github.com/iov-one/block-metrics/utils"
 
 	"github.com/iov-one/weave/errors"
 )
 
 func main() {
+	timeout, err := time.ParseDuration(utils.Env("TENDERMINT_TIMEOUT", "30s"))
+	if err != nil {
+		log.Fatalf("invalid TENDERMINT_TIMEOUT: %s", err)
+	}
+	workers, err := strconv.Atoi(utils.Env("FETCH_WORKERS", strconv.Itoa(metrics.DefaultFetchWorkers)))
+	if err != nil {
+		log.Fatalf("invalid FETCH_WORKERS: %s", err)
+	}
+	batchSize, err := strconv.Atoi(utils.Env("FETCH_BATCH_SIZE", strconv.Itoa(metrics.DefaultBatchSize)))
+	if err != nil {
+		log.Fatalf("invalid FETCH_BATCH_SIZE: %s", err)
+	}
+
+	domainRenew, err := time.ParseDuration(utils.Env("ACCOUNT_DOMAIN_RENEW", "0"))
+	if err != nil {
+		log.Fatalf("invalid ACCOUNT_DOMAIN_RENEW: %s", err)
+	}
+	domainGracePeriod, err := time.ParseDuration(utils.Env("ACCOUNT_DOMAIN_GRACE_PERIOD", "0"))
+	if err != nil {
+		log.Fatalf("invalid ACCOUNT_DOMAIN_GRACE_PERIOD: %s", err)
+	}
+
 	conf := config.Configuration{
-		DBHost:          os.Getenv("POSTGRES_HOST"),
-		DBName:          os.Getenv("POSTGRES_DB_NAME"),
-		DBUser:          os.Getenv("POSTGRES_USER"),
-		DBPass:          os.Getenv("POSTGRES_PASSWORD"),
-		DBSSL:           os.Getenv("POSTGRES_SSL_ENABLE"),
-		TendermintWsURI: os.Getenv("TENDERMINT_WS_URI"),
-		Hrp:             os.Getenv("HRP"),
+		DBHost:                   os.Getenv("POSTGRES_HOST"),
+		DBName:                   os.Getenv("POSTGRES_DB_NAME"),
+		DBUser:                   os.Getenv("POSTGRES_USER"),
+		DBPass:                   os.Getenv("POSTGRES_PASSWORD"),
+		DBSSL:                    os.Getenv("POSTGRES_SSL_ENABLE"),
+		TendermintURIs:           splitList(utils.Env("TENDERMINT_URI", os.Getenv("TENDERMINT_WS_URI"))),
+		TendermintTimeout:        timeout,
+		FetchWorkers:             workers,
+		BatchSize:                batchSize,
+		DisabledHandlers:         splitList(os.Getenv("DISABLED_HANDLERS")),
+		TxDecoder:                utils.Env("TX_DECODER", "bnsd"),
+		AccountDomainRenew:       domainRenew,
+		AccountDomainGracePeriod: domainGracePeriod,
+		Hrp:                      os.Getenv("HRP"),
 	}
 
-	if err := run(conf); err != nil {
+	// Without a command, the collector is synchronizing blocks.
+	if args := os.Args[1:]; len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			err = runMigrate(conf, args[1:])
+		case "reindex":
+			err = runReindex(conf, args[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", args[0])
+		}
+	} else {
+		err = run(conf)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -34,11 +84,17 @@ func run(conf config.Configuration) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dbUri := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s", conf.DBUser, conf.DBPass,
-		conf.DBHost, conf.DBName, conf.DBSSL)
-	db, err := sql.Open("postgres", dbUri)
+	// Collector is running until terminated.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	db, err := openDB(conf)
 	if err != nil {
-		return fmt.Errorf("cannot connect to postgres: %s", err)
+		return err
 	}
 	defer db.Close()
 
@@ -46,20 +102,161 @@ func run(conf config.Configuration) error {
 		return fmt.Errorf("ensure schema: %s", err)
 	}
 
-	st := store.NewStore(db)
-
-	tmc, err := metrics.DialTendermint(conf.TendermintWsURI)
+	tmc, err := dialTendermint(conf)
 	if err != nil {
 		return errors.Wrap(err, "dial tendermint")
 	}
 	defer tmc.Close()
 
-	inserted, err := metrics.Sync(ctx, tmc, st, conf.Hrp)
-	if err != nil {
-		return errors.Wrap(err, "sync")
+	st := store.NewStore(db)
+	if err := initAccountConfiguration(ctx, st, conf, tmc); err != nil {
+		return err
+	}
+	if err := initCashConfiguration(ctx, st, conf, tmc); err != nil {
+		return err
 	}
 
-	fmt.Println("inserted:", inserted)
+	handlers := metrics.DefaultHandlers()
+	if err := handlers.Disable(conf.DisabledHandlers...); err != nil {
+		return errors.Wrapf(err, "disable handlers, available: %s", strings.Join(handlers.Names(), ", "))
+	}
+	decoder, err := metrics.Decoder(conf.TxDecoder)
+	if err != nil {
+		return errors.Wrapf(err, "available: %s", strings.Join(metrics.DecoderNames(), ", "))
+	}
 
+	syncOpts := []metrics.SyncOption{
+		metrics.WithFetchWorkers(conf.FetchWorkers),
+		metrics.WithBatchSize(conf.BatchSize),
+		metrics.WithHandlers(handlers),
+		metrics.WithDecoder(decoder),
+	}
+	if err := metrics.StreamSync(ctx, tmc, st, conf.Hrp, syncOpts...); err != nil && err != context.Canceled {
+		return errors.Wrap(err, "stream sync")
+	}
 	return nil
 }
+
+// initAccountConfiguration stores the account module configuration, unless
+// it is already known. The configuration set in the environment is recorded
+// as the genesis configuration. The current configuration is read from the
+// chain using given client, if not nil, and recorded from the height it was
+// read at, because the chain cannot be queried for an earlier state. The
+// account handler cannot compute expiration times without the configuration,
+// so an error is returned if it remains unknown while the handler is enabled.
+func initAccountConfiguration(ctx context.Context, st *store.Store, conf config.Configuration, c metrics.Caller) error {
+	if !handlerEnabled(conf, "account") {
+		return nil
+	}
+
+	if conf.AccountDomainRenew != 0 {
+		genesis := models.AccountConfiguration{
+			DomainRenew:       conf.AccountDomainRenew,
+			DomainGracePeriod: conf.AccountDomainGracePeriod,
+		}
+		if err := st.InitAccountConfiguration(ctx, 0, genesis); err != nil {
+			return errors.Wrap(err, "init account configuration")
+		}
+	}
+	if c != nil {
+		chainConf, height, err := metrics.AccountConfiguration(ctx, c)
+		switch {
+		case err == nil:
+			if err := st.InitAccountConfiguration(ctx, height, *chainConf); err != nil {
+				return errors.Wrap(err, "init account configuration")
+			}
+		case !errors.ErrNotFound.Is(err):
+			return errors.Wrap(err, "query account configuration")
+		}
+	}
+
+	var next int64 = 1
+	switch latest, err := st.LatestBlock(ctx); {
+	case err == nil:
+		next = latest.Height + 1
+	case !errors.ErrNotFound.Is(err):
+		return errors.Wrap(err, "latest block")
+	}
+	err := st.InTx(ctx, func(tx *store.Tx) error {
+		if _, err := tx.AccountConfigurationAt(ctx, next); !errors.ErrNotFound.Is(err) {
+			return err
+		}
+		if _, err := tx.AccountConfigurationAt(ctx, math.MaxInt64); err != nil {
+			return err
+		}
+		log.Printf("account configuration is not known at height %d, expiration times are not computed until it is, set ACCOUNT_DOMAIN_RENEW to the genesis configuration to compute them", next)
+		return nil
+	})
+	if errors.ErrNotFound.Is(err) {
+		return errors.Wrap(errors.ErrState,
+			"account configuration is not known, set ACCOUNT_DOMAIN_RENEW or disable the account handler")
+	}
+	return errors.Wrap(err, "account configuration")
+}
+
+// initCashConfiguration records the current cash module configuration of the
+// chain from the height it was read at. Without it, the minimal fee charged
+// for failed transactions of earlier blocks is not recorded by the ledger
+// handler.
+func initCashConfiguration(ctx context.Context, st *store.Store, conf config.Configuration, c metrics.Caller) error {
+	if !handlerEnabled(conf, "ledger") {
+		return nil
+	}
+	chainConf, height, err := metrics.CashConfiguration(ctx, c)
+	switch {
+	case err == nil:
+		return errors.Wrap(st.InitCashConfiguration(ctx, height, *chainConf), "init cash configuration")
+	case errors.ErrNotFound.Is(err):
+		return nil
+	default:
+		return errors.Wrap(err, "query cash configuration")
+	}
+}
+
+// handlerEnabled returns true if messages are decoded and the handler with
+// given name is not disabled.
+func handlerEnabled(conf config.Configuration, name string) bool {
+	if conf.TxDecoder == "consensus" {
+		return false
+	}
+	for _, disabled := range conf.DisabledHandlers {
+		if disabled == name {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList returns comma separated, non empty values.
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func openDB(conf config.Configuration) (*sql.DB, error) {
+	dbUri := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s", conf.DBUser, conf.DBPass,
+		conf.DBHost, conf.DBName, conf.DBSSL)
+	db, err := sql.Open("postgres", dbUri)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to postgres: %s", err)
+	}
+	return db, nil
+}
+
+// dialTendermint returns a client connected to a single node, or a pool if
+// more than one node is configured.
+func dialTendermint(conf config.Configuration) (metrics.Client, error) {
+	opt := metrics.WithRequestTimeout(conf.TendermintTimeout)
+	if len(conf.TendermintURIs) == 0 {
+		return nil, errors.Wrap(errors.ErrInput, "no tendermint URI configured")
+	}
+	if len(conf.TendermintURIs) == 1 {
+		return metrics.Dial(conf.TendermintURIs[0], opt)
+	}
+	return metrics.DialPool(conf.TendermintURIs, opt)
+}
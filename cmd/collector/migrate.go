@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/config"
+	"github.com/iov-one/block-metrics/pkg/store"
+)
+
+// runMigrate implements the migrate command. Use "status" to list all
+// migrations and "up" to apply pending ones. Status is the default.
+func runMigrate(conf config.Configuration, args []string) error {
+	db, err := openDB(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "status":
+		status, err := store.Migrations(ctx, db)
+		if err != nil {
+			return fmt.Errorf("migrations status: %s", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range status {
+			applied := "pending"
+			if m.Applied() {
+				applied = m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return w.Flush()
+	case "up":
+		applied, err := store.Migrate(ctx, db)
+		if err != nil {
+			return fmt.Errorf("migrate: %s", err)
+		}
+		for _, m := range applied {
+			fmt.Printf("applied %d: %s\n", m.Version, m.Name)
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, want status or up", cmd)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/iov-one/block-metrics/pkg/config"
+	"github.com/iov-one/block-metrics/pkg/metrics"
+	"github.com/iov-one/block-metrics/pkg/store"
+)
+
+// runReindex implements the reindex command. It processes again all stored
+// blocks starting at the height given as an argument, without connecting to
+// Tendermint. The optional end height must be the last stored height.
+func runReindex(conf config.Configuration, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: reindex <from height> [<to height>]\n" +
+			"Blocks are reindexed up to the last stored height, which is the only\n" +
+			"valid to height. Reindexing a range that ends earlier would leave the\n" +
+			"current state of accounts, domains and escrows outdated.")
+	}
+	from, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid from height: %s", err)
+	}
+	var to int64
+	if len(args) == 2 {
+		if to, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return fmt.Errorf("invalid to height: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	db, err := openDB(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := store.EnsureSchema(db); err != nil {
+		return fmt.Errorf("ensure schema: %s", err)
+	}
+
+	st := store.NewStore(db)
+	if err := initAccountConfiguration(ctx, st, conf, nil); err != nil {
+		return err
+	}
+
+	handlers := metrics.DefaultHandlers()
+	if err := handlers.Disable(conf.DisabledHandlers...); err != nil {
+		return fmt.Errorf("disable handlers, available: %s: %s", strings.Join(handlers.Names(), ", "), err)
+	}
+	decoder, err := metrics.Decoder(conf.TxDecoder)
+	if err != nil {
+		return fmt.Errorf("%s, available: %s", err, strings.Join(metrics.DecoderNames(), ", "))
+	}
+
+	n, err := metrics.Reindex(ctx, st, conf.Hrp, from, to,
+		metrics.WithBatchSize(conf.BatchSize),
+		metrics.WithHandlers(handlers),
+		metrics.WithDecoder(decoder),
+	)
+	log.Printf("reindexed %d blocks", n)
+	if err != nil {
+		return fmt.Errorf("reindex: %s", err)
+	}
+	return nil
+}
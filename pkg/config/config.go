@@ -1,13 +1,35 @@
 package config
 
+import "time"
+
 type Configuration struct {
 	DBHost string
 	DBUser string
 	DBPass string
 	DBName string
 	DBSSL  string
-	// Tendermint websocket URI
-	TendermintWsURI string
+	// Tendermint API URIs. Scheme selects the transport: ws(s):// for
+	// websocket and http(s):// for plain HTTP. When more than one is
+	// provided, calls are routed to the healthiest node.
+	TendermintURIs []string
+	// Maximum duration of a single Tendermint API call
+	TendermintTimeout time.Duration
+	// Number of block batches fetched concurrently during synchronization
+	FetchWorkers int
+	// Maximum number of heights fetched in a single batch
+	BatchSize int
+	// Names of message handlers that must not be run during
+	// synchronization
+	DisabledHandlers []string
+	// Name of the transaction decoder: "bnsd" or "consensus" to skip
+	// decoding of transactions
+	TxDecoder string
+	// Domain renew and grace periods of the account module, as set in the
+	// genesis. Used until the configuration is updated by a transaction.
+	// If zero, only the current configuration of the chain is known, from
+	// the height it is read at.
+	AccountDomainRenew       time.Duration
+	AccountDomainGracePeriod time.Duration
 	// Derivation path: "tiov" or "iov"
 	Hrp string
 }
@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/errors"
+)
+
+// registerAccountHandlers adds handlers of all account module messages,
+// maintaining domains and accounts the same way the account module does.
+// Expiration times are computed from the block time, so that they match the
+// ones stored on the chain.
+func registerAccountHandlers(h *Handlers) {
+	h.RegisterMsg("account", &account.UpdateConfigurationMsg{}, updateAccountConfigurationHandler)
+	h.RegisterMsg("account", &account.RegisterDomainMsg{}, registerDomainHandler)
+	h.RegisterMsg("account", &account.ReplaceAccountMsgFeesMsg{}, replaceAccountMsgFeesHandler)
+	h.RegisterMsg("account", &account.TransferDomainMsg{}, transferDomainHandler)
+	h.RegisterMsg("account", &account.RenewDomainMsg{}, renewDomainHandler)
+	h.RegisterMsg("account", &account.DeleteDomainMsg{}, deleteDomainHandler)
+	h.RegisterMsg("account", &account.FlushDomainMsg{}, flushDomainHandler)
+	h.RegisterMsg("account", &account.RegisterAccountMsg{}, registerAccountHandler)
+	h.RegisterMsg("account", &account.TransferAccountMsg{}, transferAccountHandler)
+	h.RegisterMsg("account", &account.ReplaceAccountTargetsMsg{}, replaceAccountTargetsHandler)
+	h.RegisterMsg("account", &account.RenewAccountMsg{}, renewAccountHandler)
+	h.RegisterMsg("account", &account.DeleteAccountMsg{}, deleteAccountHandler)
+	h.RegisterMsg("account", &account.AddAccountCertificateMsg{}, addAccountCertificateHandler)
+	h.RegisterMsg("account", &account.DeleteAccountCertificateMsg{}, deleteAccountCertificateHandler)
+}
+
+// updateAccountConfigurationHandler records the patched configuration. A
+// patch of a configuration that is not known is ignored, because it does not
+// contain the fields that were not changed.
+func updateAccountConfigurationHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.UpdateConfigurationMsg)
+	if m.Patch == nil {
+		return nil
+	}
+	conf, err := optionalAccountConfiguration(ctx, mc)
+	if err != nil || conf == nil {
+		return err
+	}
+	return mc.Tx.SetAccountConfiguration(ctx, mc.change(msg), patchAccountConfiguration(*conf, m.Patch))
+}
+
+// AccountConfiguration returns the current configuration of the account
+// module, read from the chain, and the height it was read at. ErrNotFound is
+// returned if the chain has no account module configuration.
+func AccountConfiguration(ctx context.Context, c Caller) (*models.AccountConfiguration, int64, error) {
+	var conf account.Configuration
+	height, err := queryConfiguration(ctx, c, "account", &conf)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := patchAccountConfiguration(models.AccountConfiguration{}, &conf)
+	return &res, height, nil
+}
+
+// patchAccountConfiguration returns the configuration with all non zero
+// fields of the patch applied, same as gconf does.
+func patchAccountConfiguration(c models.AccountConfiguration, patch *account.Configuration) models.AccountConfiguration {
+	if len(patch.Owner) != 0 {
+		c.Owner = patch.Owner.String()
+	}
+	if patch.DomainRenew != 0 {
+		c.DomainRenew = patch.DomainRenew.Duration()
+	}
+	if patch.DomainGracePeriod != 0 {
+		c.DomainGracePeriod = patch.DomainGracePeriod.Duration()
+	}
+	return c
+}
+
+func registerDomainHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.RegisterDomainMsg)
+	conf, err := optionalAccountConfiguration(ctx, mc)
+	if err != nil {
+		return err
+	}
+	msgFees, err := marshalMsgFees(m.MsgFees)
+	if err != nil {
+		return err
+	}
+
+	d := models.Domain{
+		Domain:       m.Domain,
+		Admin:        m.Admin.String(),
+		HasSuperuser: m.HasSuperuser,
+		AccountRenew: m.AccountRenew.Duration(),
+		MsgFees:      msgFees,
+	}
+	if len(m.Broker) != 0 {
+		d.Broker = m.Broker.String()
+	}
+	if conf != nil {
+		d.ValidUntil = validUntil(mc.Time, conf.DomainRenew)
+	}
+	if err := mc.Tx.InsertDomain(ctx, mc.change(msg), d); err != nil {
+		return err
+	}
+
+	// Registering a domain creates an account with an empty name.
+	empty := &account.RegisterAccountMsg{
+		Domain: m.Domain,
+		Owner:  m.Admin,
+	}
+	return mc.Tx.InsertAccount(ctx, mc.change(msg), empty, validUntil(mc.Time, d.AccountRenew))
+}
+
+func replaceAccountMsgFeesHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.ReplaceAccountMsgFeesMsg)
+	msgFees, err := marshalMsgFees(m.NewMsgFees)
+	if err != nil {
+		return err
+	}
+	return mc.Tx.ReplaceDomainMsgFees(ctx, mc.change(msg), m.Domain, msgFees)
+}
+
+func transferDomainHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.TransferDomainMsg)
+	return mc.Tx.TransferDomain(ctx, mc.change(msg), m.Domain, m.NewAdmin)
+}
+
+func renewDomainHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.RenewDomainMsg)
+	conf, err := optionalAccountConfiguration(ctx, mc)
+	if err != nil {
+		return err
+	}
+	d, err := mc.Tx.LoadDomain(ctx, m.Domain)
+	switch {
+	case err == nil:
+	case errors.ErrNotFound.Is(err):
+		return nil
+	default:
+		return errors.Wrap(err, "domain")
+	}
+
+	// A domain is extended by the renew period, unless it has already
+	// expired. Then it is valid for the renew period from now on. Without
+	// the renew period, the renewal is recorded with an unknown
+	// expiration time.
+	var next *time.Time
+	if conf != nil {
+		next = validUntil(mc.Time, conf.DomainRenew)
+		if d.ValidUntil != nil && d.ValidUntil.Add(conf.DomainRenew).After(*next) {
+			next = validUntil(*d.ValidUntil, conf.DomainRenew)
+		}
+	}
+	return mc.Tx.RenewDomain(ctx, mc.change(msg), m.Domain, next)
+}
+
+func deleteDomainHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.DeleteDomainMsg)
+	return mc.Tx.DeleteDomain(ctx, mc.change(msg), m.Domain)
+}
+
+func flushDomainHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.FlushDomainMsg)
+	return mc.Tx.FlushDomain(ctx, mc.change(msg), m.Domain)
+}
+
+func registerAccountHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.RegisterAccountMsg)
+	renew, err := accountRenew(ctx, mc, m.Domain)
+	if err != nil {
+		return err
+	}
+	return mc.Tx.InsertAccount(ctx, mc.change(msg), m, renew)
+}
+
+func transferAccountHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.TransferAccountMsg)
+	return mc.Tx.TransferAccount(ctx, mc.change(msg), m.Domain, m.Name, m.NewOwner)
+}
+
+func replaceAccountTargetsHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	return mc.Tx.ReplaceAccountTargets(ctx, mc.change(msg), msg.(*account.ReplaceAccountTargetsMsg))
+}
+
+func renewAccountHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.RenewAccountMsg)
+	renew, err := accountRenew(ctx, mc, m.Domain)
+	if err != nil || renew == nil {
+		return err
+	}
+	return mc.Tx.RenewAccount(ctx, mc.change(msg), m.Domain, m.Name, renew)
+}
+
+func deleteAccountHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.DeleteAccountMsg)
+	return mc.Tx.DeleteAccount(ctx, mc.change(msg), m.Domain, m.Name)
+}
+
+func addAccountCertificateHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.AddAccountCertificateMsg)
+	return mc.Tx.AddAccountCertificate(ctx, mc.change(msg), m.Domain, m.Name, m.Certificate)
+}
+
+func deleteAccountCertificateHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*account.DeleteAccountCertificateMsg)
+	return mc.Tx.DeleteAccountCertificate(ctx, mc.change(msg), m.Domain, m.Name, m.CertificateHash)
+}
+
+// optionalAccountConfiguration returns the account module configuration as
+// of the message height, or nil if it is not known.
+func optionalAccountConfiguration(ctx context.Context, mc *MsgContext) (*models.AccountConfiguration, error) {
+	conf, err := mc.Tx.AccountConfigurationAt(ctx, mc.Height)
+	switch {
+	case err == nil:
+		return conf, nil
+	case errors.ErrNotFound.Is(err):
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "account configuration")
+	}
+}
+
+// accountRenew returns the expiration time of an account registered or
+// renewed in given domain, or nil if the domain is not known.
+func accountRenew(ctx context.Context, mc *MsgContext, domain string) (*time.Time, error) {
+	d, err := mc.Tx.LoadDomain(ctx, domain)
+	switch {
+	case err == nil:
+		return validUntil(mc.Time, d.AccountRenew), nil
+	case errors.ErrNotFound.Is(err):
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "domain")
+	}
+}
+
+// validUntil returns the expiration time after given renew period. Same as
+// on the chain, it is stored with a second precision.
+func validUntil(now time.Time, renew time.Duration) *time.Time {
+	t := now.Add(renew).UTC().Truncate(time.Second)
+	return &t
+}
+
+func marshalMsgFees(fees []account.AccountMsgFee) (json.RawMessage, error) {
+	if len(fees) == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal(fees)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal message fees")
+	}
+	return raw, nil
+}
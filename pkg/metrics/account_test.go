@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/app"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/weavetest"
+)
+
+func TestPatchAccountConfiguration(t *testing.T) {
+	owner := weavetest.NewCondition().Address()
+	conf := models.AccountConfiguration{
+		Owner:             "previous",
+		DomainRenew:       time.Hour,
+		DomainGracePeriod: time.Minute,
+	}
+
+	got := patchAccountConfiguration(conf, &account.Configuration{
+		DomainRenew: weave.AsUnixDuration(2 * time.Hour),
+	})
+	want := models.AccountConfiguration{
+		Owner:             "previous",
+		DomainRenew:       2 * time.Hour,
+		DomainGracePeriod: time.Minute,
+	}
+	if got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	got = patchAccountConfiguration(conf, &account.Configuration{Owner: owner})
+	want = models.AccountConfiguration{
+		Owner:             owner.String(),
+		DomainRenew:       time.Hour,
+		DomainGracePeriod: time.Minute,
+	}
+	if got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestAccountConfiguration(t *testing.T) {
+	raw, err := (&account.Configuration{
+		Metadata:    &weave.Metadata{Schema: 1},
+		DomainRenew: weave.AsUnixDuration(time.Hour),
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal configuration: %s", err)
+	}
+	values := map[string][]byte{"account": raw}
+
+	ft := newFakeTendermint(t)
+	defer ft.Close()
+	ft.Handle("abci_query", func(params []string) (interface{}, error) {
+		if len(params) != 4 || params[0] != "/gconf" || params[3] != "false" {
+			return nil, fmt.Errorf("unexpected params %q", params)
+		}
+		var pkg string
+		if _, err := fmt.Sscanf(params[1], "%x", &pkg); err != nil {
+			return nil, err
+		}
+		value, err := (&app.ResultSet{Results: [][]byte{values[pkg]}}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"response": map[string]interface{}{"value": value, "height": "7"},
+		}, nil
+	})
+
+	c, err := DialTendermint(ft.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	conf, height, err := AccountConfiguration(ctx, c)
+	if err != nil {
+		t.Fatalf("cannot get configuration: %s", err)
+	}
+	if want := (models.AccountConfiguration{DomainRenew: time.Hour}); *conf != want {
+		t.Fatalf("want %+v, got %+v", want, *conf)
+	}
+	if height != 7 {
+		t.Fatalf("want height 7, got %d", height)
+	}
+
+	delete(values, "account")
+	if _, _, err := AccountConfiguration(ctx, c); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+}
+
+func TestValidUntil(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 600, time.FixedZone("x", 3600))
+	got := validUntil(now, time.Hour)
+	want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !got.Equal(want) || got.Location() != time.UTC {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,288 @@
+package metrics
+
+import (
+	"encoding/json"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/cmd/bnsd/x/preregistration"
+	"github.com/iov-one/weave/cmd/bnsd/x/qualityscore"
+	"github.com/iov-one/weave/cmd/bnsd/x/termdeposit"
+	"github.com/iov-one/weave/cmd/bnsd/x/username"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/x/aswap"
+	"github.com/iov-one/weave/x/cash"
+	"github.com/iov-one/weave/x/distribution"
+	"github.com/iov-one/weave/x/escrow"
+	"github.com/iov-one/weave/x/gov"
+	"github.com/iov-one/weave/x/msgfee"
+	"github.com/iov-one/weave/x/multisig"
+	"github.com/iov-one/weave/x/txfee"
+)
+
+// adaptMessage returns the JSON details of a single message. Addresses are
+// represented using bech32 encoding, for all messages that contain them.
+func adaptMessage(msg weave.Msg, hrp string) (json.RawMessage, error) {
+	adapter, err := messageAdapter(msg, hrp)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(adapter)
+}
+
+// messageAdapter returns the value that is serialized to represent given
+// message. Messages without address fields are returned unchanged.
+func messageAdapter(msg weave.Msg, hrp string) (interface{}, error) {
+	a := addressEncoder{hrp: hrp}
+
+	switch m := msg.(type) {
+	case *cash.SendMsg:
+		res := models.CashSendMsgAdapter{
+			Source:      a.required(m.Source, "source"),
+			Destination: a.required(m.Destination, "destination"),
+			Amount:      m.Amount,
+			Memo:        m.Memo,
+		}
+		return res, a.err
+	case *escrow.CreateMsg:
+		res := models.EscrowCreateMsgAdapter{
+			CreateMsg:   m,
+			Source:      a.required(m.Source, "source"),
+			Arbiter:     a.required(m.Arbiter, "arbiter"),
+			Destination: a.required(m.Destination, "destination"),
+		}
+		return res, a.err
+	case *escrow.UpdatePartiesMsg:
+		res := models.EscrowUpdatePartiesMsgAdapter{
+			UpdatePartiesMsg: m,
+			Source:           a.optional(m.Source, "source"),
+			Arbiter:          a.optional(m.Arbiter, "arbiter"),
+			Destination:      a.optional(m.Destination, "destination"),
+		}
+		return res, a.err
+	case *aswap.CreateMsg:
+		res := models.AswapCreateMsgAdapter{
+			CreateMsg:   m,
+			Source:      a.required(m.Source, "source"),
+			Destination: a.required(m.Destination, "destination"),
+		}
+		return res, a.err
+	case *multisig.CreateMsg:
+		res := models.MultisigCreateMsgAdapter{
+			CreateMsg:    m,
+			Participants: a.participants(m.Participants),
+		}
+		return res, a.err
+	case *multisig.UpdateMsg:
+		res := models.MultisigUpdateMsgAdapter{
+			UpdateMsg:    m,
+			Participants: a.participants(m.Participants),
+		}
+		return res, a.err
+	case *distribution.CreateMsg:
+		res := models.DistributionCreateMsgAdapter{
+			CreateMsg:    m,
+			Admin:        a.required(m.Admin, "admin"),
+			Destinations: a.destinations(m.Destinations),
+		}
+		return res, a.err
+	case *distribution.ResetMsg:
+		res := models.DistributionResetMsgAdapter{
+			ResetMsg:     m,
+			Destinations: a.destinations(m.Destinations),
+		}
+		return res, a.err
+	case *gov.CreateProposalMsg:
+		res := models.GovCreateProposalMsgAdapter{
+			CreateProposalMsg: m,
+			Author:            a.optional(m.Author, "author"),
+		}
+		return res, a.err
+	case *gov.VoteMsg:
+		res := models.GovVoteMsgAdapter{
+			VoteMsg: m,
+			Voter:   a.optional(m.Voter, "voter"),
+		}
+		return res, a.err
+	case *gov.UpdateElectorateMsg:
+		electors := make([]models.GovElectorAdapter, len(m.DiffElectors))
+		for i, e := range m.DiffElectors {
+			electors[i] = models.GovElectorAdapter{
+				Address: a.required(e.Address, "elector"),
+				Weight:  e.Weight,
+			}
+		}
+		res := models.GovUpdateElectorateMsgAdapter{
+			UpdateElectorateMsg: m,
+			DiffElectors:        electors,
+		}
+		return res, a.err
+	case *username.TransferTokenMsg:
+		res := models.UsernameTransferTokenMsgAdapter{
+			TransferTokenMsg: m,
+			NewOwner:         a.required(m.NewOwner, "new owner"),
+		}
+		return res, a.err
+	case *account.RegisterDomainMsg:
+		res := models.AccountRegisterDomainMsgAdapter{
+			RegisterDomainMsg: m,
+			Admin:             a.required(m.Admin, "admin"),
+			Broker:            a.optional(m.Broker, "broker"),
+		}
+		return res, a.err
+	case *account.TransferDomainMsg:
+		res := models.AccountTransferDomainMsgAdapter{
+			TransferDomainMsg: m,
+			NewAdmin:          a.required(m.NewAdmin, "new admin"),
+		}
+		return res, a.err
+	case *account.RegisterAccountMsg:
+		res := models.AccountRegisterAccountMsgAdapter{
+			RegisterAccountMsg: m,
+			Owner:              a.optional(m.Owner, "owner"),
+			Broker:             a.optional(m.Broker, "broker"),
+		}
+		return res, a.err
+	case *account.TransferAccountMsg:
+		res := models.AccountTransferAccountMsgAdapter{
+			TransferAccountMsg: m,
+			NewOwner:           a.required(m.NewOwner, "new owner"),
+		}
+		return res, a.err
+	case *preregistration.RegisterMsg:
+		res := models.PreregistrationRegisterMsgAdapter{
+			RegisterMsg: m,
+			Owner:       a.required(m.Owner, "owner"),
+		}
+		return res, a.err
+	case *termdeposit.DepositMsg:
+		res := models.TermdepositDepositMsgAdapter{
+			DepositMsg: m,
+			Depositor:  a.required(m.Depositor, "depositor"),
+		}
+		return res, a.err
+
+	case *cash.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.CashConfigurationAdapter{
+			Configuration:    m.Patch,
+			Owner:            a.optional(m.Patch.GetOwner(), "owner"),
+			CollectorAddress: a.optional(m.Patch.GetCollectorAddress(), "collector address"),
+		})
+	case *txfee.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.TxfeeConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+		})
+	case *msgfee.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.MsgfeeConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+			FeeAdmin:      a.optional(m.Patch.GetFeeAdmin(), "fee admin"),
+		})
+	case *account.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.AccountConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+		})
+	case *username.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.UsernameConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+		})
+	case *preregistration.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.PreregistrationConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+		})
+	case *qualityscore.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.QualityscoreConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+		})
+	case *termdeposit.UpdateConfigurationMsg:
+		return a.configuration(m.Metadata, m.Patch != nil, models.TermdepositConfigurationAdapter{
+			Configuration: m.Patch,
+			Owner:         a.optional(m.Patch.GetOwner(), "owner"),
+			Admin:         a.optional(m.Patch.GetAdmin(), "admin"),
+			BaseRates:     a.customRates(m.Patch.GetBaseRates()),
+		})
+	default:
+		return msg, nil
+	}
+}
+
+// addressEncoder converts addresses to bech32. Only the first failure is
+// kept, so that several fields can be converted before checking for an
+// error.
+type addressEncoder struct {
+	hrp string
+	err error
+}
+
+// required converts an address that must be set.
+func (a *addressEncoder) required(addr weave.Address, field string) string {
+	if a.err != nil {
+		return ""
+	}
+	s, err := addr.Bech32String(a.hrp)
+	if err != nil {
+		a.err = errors.Wrap(err, field)
+	}
+	return s
+}
+
+// optional converts an address that can be empty. An empty address is
+// represented by an empty string.
+func (a *addressEncoder) optional(addr weave.Address, field string) string {
+	if len(addr) == 0 {
+		return ""
+	}
+	return a.required(addr, field)
+}
+
+func (a *addressEncoder) participants(ps []*multisig.Participant) []models.MultisigParticipantAdapter {
+	res := make([]models.MultisigParticipantAdapter, len(ps))
+	for i, p := range ps {
+		res[i] = models.MultisigParticipantAdapter{
+			Signature: a.required(p.Signature, "participant"),
+			Weight:    p.Weight,
+		}
+	}
+	return res
+}
+
+func (a *addressEncoder) destinations(ds []*distribution.Destination) []models.DistributionDestinationAdapter {
+	res := make([]models.DistributionDestinationAdapter, len(ds))
+	for i, d := range ds {
+		res[i] = models.DistributionDestinationAdapter{
+			Address: a.required(d.Address, "destination"),
+			Weight:  d.Weight,
+		}
+	}
+	return res
+}
+
+// configuration returns the adapter of a configuration update message. The
+// patch is omitted if the message does not contain one.
+func (a *addressEncoder) customRates(rs []termdeposit.CustomRate) []models.TermdepositCustomRateAdapter {
+	res := make([]models.TermdepositCustomRateAdapter, len(rs))
+	for i, r := range rs {
+		res[i] = models.TermdepositCustomRateAdapter{
+			Address: a.required(r.Address, "base rate"),
+			Rate:    r.Rate,
+		}
+	}
+	return res
+}
+
+func (a *addressEncoder) configuration(meta *weave.Metadata, hasPatch bool, patch interface{}) (interface{}, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	res := models.UpdateConfigurationMsgAdapter{Metadata: meta}
+	if hasPatch {
+		res.Patch = patch
+	}
+	return res, nil
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/iov-one/weave"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/cmd/bnsd/x/termdeposit"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/weavetest"
+	"github.com/iov-one/weave/x/cash"
+	"github.com/iov-one/weave/x/escrow"
+	"github.com/iov-one/weave/x/multisig"
+)
+
+func TestAdaptMessage(t *testing.T) {
+	alice := weavetest.NewCondition().Address()
+	bob := weavetest.NewCondition().Address()
+	aliceBech, _ := alice.Bech32String("tiov")
+	bobBech, _ := bob.Bech32String("tiov")
+
+	cases := map[string]struct {
+		msg     weave.Msg
+		want    map[string]interface{}
+		wantErr *errors.Error
+	}{
+		"escrow": {
+			msg: &escrow.CreateMsg{
+				Metadata:    &weave.Metadata{Schema: 1},
+				Source:      alice,
+				Arbiter:     bob,
+				Destination: bob,
+				Amount:      coin.Coins{coin.NewCoinp(1, 0, "IOV")},
+				Memo:        "memo",
+			},
+			want: map[string]interface{}{
+				"source":      aliceBech,
+				"arbiter":     bobBech,
+				"destination": bobBech,
+				"memo":        "memo",
+			},
+		},
+		"multisig participants": {
+			msg: &multisig.CreateMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Participants: []*multisig.Participant{
+					{Signature: alice, Weight: 1},
+				},
+				ActivationThreshold: 1,
+				AdminThreshold:      1,
+			},
+			want: map[string]interface{}{
+				"participants": []interface{}{
+					map[string]interface{}{"signature": aliceBech, "weight": float64(1)},
+				},
+				"activation_threshold": float64(1),
+			},
+		},
+		"account without broker": {
+			msg: &account.RegisterAccountMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Domain:   "iov",
+				Name:     "alice",
+				Owner:    alice,
+			},
+			want: map[string]interface{}{
+				"owner":  aliceBech,
+				"domain": "iov",
+				"broker": nil,
+			},
+		},
+		"configuration patch": {
+			msg: &cash.UpdateConfigurationMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Patch: &cash.Configuration{
+					Metadata:         &weave.Metadata{Schema: 1},
+					CollectorAddress: bob,
+				},
+			},
+			want: map[string]interface{}{
+				"patch": map[string]interface{}{
+					"metadata":          map[string]interface{}{"schema": float64(1)},
+					"collector_address": bobBech,
+					"minimal_fee":       map[string]interface{}{},
+				},
+			},
+		},
+		"termdeposit base rates": {
+			msg: &termdeposit.UpdateConfigurationMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Patch: &termdeposit.Configuration{
+					Metadata: &weave.Metadata{Schema: 1},
+					BaseRates: []termdeposit.CustomRate{
+						{Address: alice, Rate: weave.Fraction{Numerator: 1, Denominator: 10}},
+					},
+				},
+			},
+			want: map[string]interface{}{
+				"patch": map[string]interface{}{
+					"metadata": map[string]interface{}{"schema": float64(1)},
+					"bonuses":  nil,
+					"base_rates": []interface{}{
+						map[string]interface{}{
+							"address": aliceBech,
+							"rate":    map[string]interface{}{"numerator": float64(1), "denominator": float64(10)},
+						},
+					},
+				},
+			},
+		},
+		"missing required address": {
+			msg: &escrow.CreateMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Source:   alice,
+			},
+			wantErr: errors.ErrInput,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			raw, err := adaptMessage(tc.msg, "tiov")
+			if !tc.wantErr.Is(err) {
+				t.Fatalf("want %v error, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(raw, &got); err != nil {
+				t.Fatalf("cannot unmarshal: %s", err)
+			}
+			for name, want := range tc.want {
+				if !jsonEqual(t, got[name], want) {
+					t.Errorf("%s: want %v, got %v", name, want, got[name])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitBatchedMessages(t *testing.T) {
+	alice := weavetest.NewCondition().Address()
+	aliceBech, _ := alice.Bech32String("tiov")
+	msg := &bnsd.ExecuteBatchMsg{
+		Messages: []bnsd.ExecuteBatchMsg_Union{
+			{Sum: &bnsd.ExecuteBatchMsg_Union_AccountTransferDomainMsg{
+				AccountTransferDomainMsg: &account.TransferDomainMsg{
+					Metadata: &weave.Metadata{Schema: 1},
+					Domain:   "iov",
+					NewAdmin: alice,
+				},
+			}},
+			{Sum: &bnsd.ExecuteBatchMsg_Union_AccountTransferDomainMsg{
+				AccountTransferDomainMsg: &account.TransferDomainMsg{
+					Metadata: &weave.Metadata{Schema: 1},
+					Domain:   "iov",
+				},
+			}},
+		},
+	}
+	if _, err := splitMessages(msg, "tiov", nil); !errors.ErrInput.Is(err) {
+		t.Fatalf("want input error, got %v", err)
+	}
+
+	msg.Messages = msg.Messages[:1]
+	messages, err := splitMessages(msg, "tiov", nil)
+	if err != nil {
+		t.Fatalf("cannot split messages: %s", err)
+	}
+	var details map[string]interface{}
+	if err := json.Unmarshal(messages[0].Details, &details); err != nil {
+		t.Fatalf("cannot unmarshal details: %s", err)
+	}
+	if details["new_admin"] != aliceBech {
+		t.Fatalf("want %s new admin, got %v", aliceBech, details["new_admin"])
+	}
+}
+
+func jsonEqual(t testing.TB, a, b interface{}) bool {
+	t.Helper()
+	ra, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	rb, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	return string(ra) == string(rb)
+}
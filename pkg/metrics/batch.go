@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/iov-one/weave/errors"
+)
+
+// BatchCall is a single call of a batch. Result is unmarshaled into Dest.
+// Err is set if this call failed, while the rest of the batch succeeded.
+type BatchCall struct {
+	Method string
+	Args   []interface{}
+	Dest   interface{}
+	Err    error
+}
+
+// Batcher is implemented by clients that can make several jsonrpc calls in a
+// single round trip.
+type Batcher interface {
+	// DoBatch makes all given calls. Returned error means that the whole
+	// batch failed. Result of each call must be checked using its Err
+	// field.
+	DoBatch(ctx context.Context, calls []*BatchCall) error
+}
+
+var (
+	_ Batcher = (*TendermintClient)(nil)
+	_ Batcher = (*HTTPClient)(nil)
+	_ Batcher = (*Pool)(nil)
+)
+
+// DoBatch makes all given calls as a batch if the client is a Batcher.
+// Otherwise calls are made one after another.
+func DoBatch(ctx context.Context, c Caller, calls []*BatchCall) error {
+	if b, ok := c.(Batcher); ok {
+		return b.DoBatch(ctx, calls)
+	}
+	for _, call := range calls {
+		call.Err = c.DoContext(ctx, call.Method, call.Dest, call.Args...)
+		if call.Err != nil && ctx.Err() != nil {
+			return contextErr(ctx.Err(), call.Method)
+		}
+	}
+	return nil
+}
+
+// batchRequests returns a request for each call, using consecutive ids
+// starting with the first id.
+func batchRequests(firstID uint64, calls []*BatchCall) []jsonrpcRequest {
+	reqs := make([]jsonrpcRequest, len(calls))
+	for i, call := range calls {
+		reqs[i] = newRequest(firstID+uint64(i), call.Method, call.Args...)
+	}
+	return reqs
+}
+
+// decodeBatch matches responses with calls using the correlation ID and
+// unmarshals each result.
+func decodeBatch(reqs []jsonrpcRequest, calls []*BatchCall, resps []*jsonrpcResponse) error {
+	byID := make(map[string]*jsonrpcResponse, len(resps))
+	for _, r := range resps {
+		byID[r.CorrelationID] = r
+	}
+	for i, req := range reqs {
+		resp, ok := byID[req.CorrelationID]
+		if !ok {
+			return errors.Wrapf(ErrFailedResponse, "no response for %q call", req.Method)
+		}
+		calls[i].Err = resp.decode(calls[i].Dest)
+	}
+	return nil
+}
+
+// batchMethod returns a short description of the batch, for error messages.
+func batchMethod(calls []*BatchCall) string {
+	if len(calls) == 0 {
+		return "batch"
+	}
+	return calls[0].Method + " batch"
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iov-one/weave/errors"
+)
+
+func TestHTTPClientBatch(t *testing.T) {
+	var batches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []jsonrpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			t.Errorf("cannot decode batch request: %s", err)
+		}
+		batches++
+
+		// Respond in reversed order, so that correlation is tested.
+		resps := make([]map[string]interface{}, 0, len(reqs))
+		for i := len(reqs) - 1; i >= 0; i-- {
+			resp := map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      reqs[i].CorrelationID,
+			}
+			if reqs[i].Method == "echo" {
+				resp["result"] = reqs[i].Params[0]
+			} else {
+				resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+			}
+			resps = append(resps, resp)
+		}
+		// Same as tendermint, a single response is not wrapped.
+		if len(resps) == 1 {
+			_ = json.NewEncoder(w).Encode(resps[0])
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resps)
+	}))
+	defer srv.Close()
+
+	c := NewHTTPClient(srv.URL)
+	defer c.Close()
+
+	ctx := context.Background()
+	var a, b, x string
+	calls := []*BatchCall{
+		{Method: "echo", Args: []interface{}{"a"}, Dest: &a},
+		{Method: "does_not_exist", Dest: &x},
+		{Method: "echo", Args: []interface{}{"b"}, Dest: &b},
+	}
+	if err := c.DoBatch(ctx, calls); err != nil {
+		t.Fatalf("cannot make batch: %s", err)
+	}
+	if a != "a" || b != "b" {
+		t.Fatalf("unexpected results: %q, %q", a, b)
+	}
+	if calls[0].Err != nil || calls[2].Err != nil {
+		t.Fatalf("unexpected errors: %v, %v", calls[0].Err, calls[2].Err)
+	}
+	if !ErrFailedResponse.Is(calls[1].Err) {
+		t.Fatalf("want failed response error, got %v", calls[1].Err)
+	}
+
+	var single string
+	calls = []*BatchCall{{Method: "echo", Args: []interface{}{"single"}, Dest: &single}}
+	if err := c.DoBatch(ctx, calls); err != nil {
+		t.Fatalf("cannot make batch: %s", err)
+	}
+	if single != "single" || calls[0].Err != nil {
+		t.Fatalf("unexpected result: %q, %v", single, calls[0].Err)
+	}
+
+	if batches != 2 {
+		t.Fatalf("want 2 requests, got %d", batches)
+	}
+}
+
+func TestFetchHeights(t *testing.T) {
+	ft := newFakeTendermint(t)
+	defer ft.Close()
+
+	ft.Handle("commit", func(params []string) (interface{}, error) {
+		return map[string]interface{}{
+			"signed_header": map[string]interface{}{
+				"header": map[string]interface{}{
+					"height": params[0],
+					"time":   "2019-10-01T12:00:00Z",
+				},
+			},
+		}, nil
+	})
+	ft.Handle("block", func(params []string) (interface{}, error) {
+		return map[string]interface{}{
+			"block": map[string]interface{}{
+				"header": map[string]interface{}{
+					"height": params[0],
+					"time":   "2019-10-01T12:00:00Z",
+				},
+			},
+		}, nil
+	})
+	ft.Handle("validators", func(params []string) (interface{}, error) {
+		return map[string]interface{}{
+			"block_height": params[0],
+			"validators": []interface{}{
+				map[string]interface{}{
+					"address": "0102",
+					"pub_key": map[string]interface{}{"value": "AwQ="},
+				},
+			},
+		}, nil
+	})
+	ft.Handle("block_results", func(params []string) (interface{}, error) {
+		if params[0] == "5" {
+			return nil, errors.Wrap(errors.ErrNotFound, "results pruned")
+		}
+		return map[string]interface{}{
+			"height": params[0],
+			"results": map[string]interface{}{
+				"deliver_tx": []interface{}{
+					map[string]interface{}{"data": "AQI="},
+					map[string]interface{}{"code": 6, "log": "invalid input"},
+				},
+			},
+		}, nil
+	})
+
+	c, err := DialTendermint(ft.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+
+	heights, err := c.FetchHeights(context.Background(), 3, 7)
+	if err != nil {
+		t.Fatalf("cannot fetch heights: %s", err)
+	}
+	if len(heights) != 5 {
+		t.Fatalf("want 5 heights, got %d", len(heights))
+	}
+	for i, h := range heights {
+		want := int64(3 + i)
+		if h.Commit.Height != want || h.Block.Height != want {
+			t.Fatalf("want height %d, got commit %d and block %d", want, h.Commit.Height, h.Block.Height)
+		}
+		if len(h.Validators) != 1 || !bytes.Equal(h.Validators[0].Address, []byte{1, 2}) || !bytes.Equal(h.Validators[0].PubKey, []byte{3, 4}) {
+			t.Fatalf("unexpected validators: %+v", h.Validators)
+		}
+		if want == 5 {
+			if h.Block.Results != nil || h.Block.RawResults != nil {
+				t.Fatalf("want unknown results, got %+v", h.Block.Results)
+			}
+			continue
+		}
+		if len(h.Block.Results) != 2 || h.Block.Results[1].Code != 6 || len(h.Block.RawResults) == 0 {
+			t.Fatalf("unexpected results: %+v", h.Block.Results)
+		}
+	}
+
+	c.mu.Lock()
+	pending := len(c.resp)
+	c.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("no call must be pending, got %d", pending)
+	}
+	ft.mu.Lock()
+	batches := ft.batches
+	ft.mu.Unlock()
+	if batches != 1 {
+		t.Fatalf("want all calls sent as a single batch, got %d batches", batches)
+	}
+
+	if _, err := c.FetchHeights(context.Background(), 7, 3); err == nil {
+		t.Fatal("invalid range must not be allowed")
+	}
+}
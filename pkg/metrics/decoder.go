@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/iov-one/weave"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/x/cash"
+	"github.com/iov-one/weave/x/multisig"
+	"github.com/iov-one/weave/x/sigs"
+)
+
+// TxDecoder turns binary transactions, as included in a block, into their
+// content.
+type TxDecoder interface {
+	// Decode returns the content of a transaction. Nil is returned if
+	// the decoder does not decode transactions at all, in which case only
+	// the transaction hash is stored.
+	Decode(raw []byte) (*DecodedTx, error)
+}
+
+// TxDecoderFunc is a function implementing the TxDecoder interface.
+type TxDecoderFunc func(raw []byte) (*DecodedTx, error)
+
+// Decode calls the function.
+func (fn TxDecoderFunc) Decode(raw []byte) (*DecodedTx, error) {
+	return fn(raw)
+}
+
+// DecodedTx is the content of a transaction.
+type DecodedTx struct {
+	Msg weave.Msg
+	// Fees is nil if the transaction does not pay any fee.
+	Fees *cash.FeeInfo
+	// Signers are the addresses of all signatures, in order.
+	Signers []weave.Address
+	// Multisig are IDs of multisig contracts used to authorize the
+	// transaction.
+	Multisig [][]byte
+}
+
+// NewWeaveDecoder returns a decoder of transactions of any weave based
+// application. newTx must return a new, empty instance of the application
+// transaction. Fees, signatures and multisig contracts are decoded if the
+// transaction implements the corresponding weave interfaces.
+func NewWeaveDecoder(newTx func() weave.Tx) TxDecoder {
+	return TxDecoderFunc(func(raw []byte) (*DecodedTx, error) {
+		tx := newTx()
+		if err := tx.Unmarshal(raw); err != nil {
+			return nil, errors.Wrap(err, "cannot unmarshal transaction")
+		}
+		msg, err := tx.GetMsg()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot get transaction message")
+		}
+		decoded := DecodedTx{Msg: msg}
+		if t, ok := tx.(cash.FeeTx); ok {
+			decoded.Fees = t.GetFees()
+		}
+		if t, ok := tx.(sigs.SignedTx); ok {
+			for _, sig := range t.GetSignatures() {
+				if sig.Pubkey == nil {
+					continue
+				}
+				decoded.Signers = append(decoded.Signers, sig.Pubkey.Address())
+			}
+		}
+		if t, ok := tx.(multisig.MultiSigTx); ok {
+			decoded.Multisig = t.GetMultisig()
+		}
+		return &decoded, nil
+	})
+}
+
+// BnsdDecoder decodes transactions of the BNS application. It is the
+// default decoder.
+var BnsdDecoder = NewWeaveDecoder(func() weave.Tx { return new(bnsd.Tx) })
+
+// ConsensusDecoder does not decode transactions at all, so that consensus
+// metrics can be collected from any Tendermint chain. Only hashes of
+// transactions are stored.
+var ConsensusDecoder = TxDecoderFunc(func([]byte) (*DecodedTx, error) {
+	return nil, nil
+})
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]TxDecoder{
+		"bnsd":      BnsdDecoder,
+		"consensus": ConsensusDecoder,
+	}
+)
+
+// RegisterDecoder makes a decoder available by name, so that it can be
+// selected by configuration. Registering under an existing name replaces
+// the decoder.
+func RegisterDecoder(name string, d TxDecoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[name] = d
+}
+
+// Decoder returns the decoder registered with given name. ErrNotFound is
+// returned if there is none.
+func Decoder(name string) (TxDecoder, error) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	d, ok := decoders[name]
+	if !ok {
+		return nil, errors.Wrapf(errors.ErrNotFound, "decoder %q", name)
+	}
+	return d, nil
+}
+
+// DecoderNames returns names of all registered decoders, sorted.
+func DecoderNames() []string {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
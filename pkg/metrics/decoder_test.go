@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iov-one/weave"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/crypto"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/x/cash"
+	"github.com/iov-one/weave/x/sigs"
+)
+
+func TestBnsdDecoder(t *testing.T) {
+	key := crypto.GenPrivKeyEd25519()
+	signer := key.PublicKey().Address()
+	fees := &cash.FeeInfo{Fees: coin.NewCoinp(0, 10, "IOV")}
+	tx := &bnsd.Tx{
+		Fees:       fees,
+		Signatures: []*sigs.StdSignature{{Pubkey: key.PublicKey()}},
+		Multisig:   [][]byte{{0x01}},
+		Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+			Metadata:    &weave.Metadata{Schema: 1},
+			Source:      signer,
+			Destination: signer,
+			Amount:      coin.NewCoinp(1, 0, "IOV"),
+		}},
+	}
+	raw, err := tx.Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal transaction: %s", err)
+	}
+
+	decoded, err := BnsdDecoder.Decode(raw)
+	if err != nil {
+		t.Fatalf("cannot decode: %s", err)
+	}
+	if decoded.Msg.Path() != "cash/send" {
+		t.Fatalf("unexpected message: %s", decoded.Msg.Path())
+	}
+	if !reflect.DeepEqual(decoded.Signers, []weave.Address{signer}) {
+		t.Fatalf("unexpected signers: %v", decoded.Signers)
+	}
+	if !decoded.Fees.Fees.Equals(*fees.Fees) || len(decoded.Multisig) != 1 {
+		t.Fatalf("unexpected fees %v and multisig %v", decoded.Fees, decoded.Multisig)
+	}
+
+	if _, err := BnsdDecoder.Decode([]byte{0xff, 0xff}); err == nil {
+		t.Fatal("want decode error")
+	}
+}
+
+func TestConsensusDecoder(t *testing.T) {
+	b := NewTendermintBlock(1, time.Now(), [][]byte{{0xff, 0xff}})
+	processed, err := processTransactions(b, ConsensusDecoder, "tiov")
+	if err != nil {
+		t.Fatalf("cannot process transactions: %s", err)
+	}
+	if len(processed.transactions) != 1 || len(processed.msgs) != 0 {
+		t.Fatalf("want only a transaction hash, got %+v", processed)
+	}
+	if tx := processed.transactions[0]; tx.Hash == "" || tx.DecodeError != "" || tx.Message != nil {
+		t.Fatalf("unexpected transaction: %+v", tx)
+	}
+}
+
+func TestDecoderRegistry(t *testing.T) {
+	if d, err := Decoder("consensus"); err != nil || d == nil {
+		t.Fatalf("want consensus decoder, got %v, %v", d, err)
+	}
+	if _, err := Decoder("unknown"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	RegisterDecoder("test", ConsensusDecoder)
+	if _, err := Decoder("test"); err != nil {
+		t.Fatalf("cannot get registered decoder: %s", err)
+	}
+	want := []string{"bnsd", "consensus", "test"}
+	if got := DecoderNames(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
@@ -9,4 +9,8 @@ var (
 
 	ErrNotImplemented = errors.Register(2100, "not implemented")
 	ErrFailedResponse = errors.Register(2002, "failed response")
+	ErrSubscription   = errors.Register(2101, "subscription")
+	ErrDisconnected   = errors.Register(2102, "disconnected")
+	ErrCancelled      = errors.Register(2103, "cancelled")
+	ErrNoNode         = errors.Register(2104, "no node available")
 )
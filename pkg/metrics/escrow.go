@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/x/escrow"
+)
+
+// registerEscrowHandlers adds handlers of all escrow messages, recording
+// each escrow and its events. The key of a created escrow is known only from
+// the transaction result, so escrows created by transactions fetched without
+// results are not recorded, and neither are their later events.
+func registerEscrowHandlers(h *Handlers) {
+	h.RegisterMsg("escrow", &escrow.CreateMsg{}, createEscrowHandler)
+	h.RegisterMsg("escrow", &escrow.ReleaseMsg{}, releaseEscrowHandler)
+	h.RegisterMsg("escrow", &escrow.ReturnMsg{}, returnEscrowHandler)
+	h.RegisterMsg("escrow", &escrow.UpdatePartiesMsg{}, updateEscrowPartiesHandler)
+}
+
+func createEscrowHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*escrow.CreateMsg)
+	if len(mc.Result) == 0 {
+		return nil
+	}
+	var b bech32
+	e := models.Escrow{
+		ID:          mc.Result,
+		Address:     b.address(mc.Hrp, escrow.Condition(mc.Result).Address()),
+		Source:      b.address(mc.Hrp, m.Source),
+		Arbiter:     b.address(mc.Hrp, m.Arbiter),
+		Destination: b.address(mc.Hrp, m.Destination),
+		Amount:      modelCoins(m.Amount),
+		Timeout:     m.Timeout.Time().UTC(),
+		Memo:        m.Memo,
+		State:       models.EscrowOpen,
+	}
+	if b.err != nil {
+		return b.err
+	}
+	return mc.Tx.SaveEscrow(ctx, mc.change(msg), "create", e.Amount, e)
+}
+
+func releaseEscrowHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*escrow.ReleaseMsg)
+	e, moved, err := escrowRelease(ctx, mc, m)
+	if err != nil || e == nil {
+		return err
+	}
+	remaining, err := weaveCoins(e.Amount).Combine(negativeCoins(moved))
+	if err != nil {
+		return errors.Wrap(err, "remaining amount")
+	}
+	e.Amount = modelCoins(remaining)
+	if !remaining.IsPositive() {
+		// Same as the escrow module, an empty escrow is deleted.
+		e.Amount = nil
+		e.State = models.EscrowReleased
+	}
+	return mc.Tx.SaveEscrow(ctx, mc.change(msg), "release", modelCoins(moved), *e)
+}
+
+// escrowRelease returns the escrow before the release and the amount
+// released. Nil escrow is returned if the escrow is not known.
+func escrowRelease(ctx context.Context, mc *MsgContext, m *escrow.ReleaseMsg) (*models.Escrow, coin.Coins, error) {
+	e, err := loadEscrow(ctx, mc, m.EscrowId)
+	if err != nil || e == nil {
+		return nil, nil, err
+	}
+	// Everything is released if no amount is given.
+	moved := weaveCoins(e.Amount)
+	if len(m.Amount) != 0 {
+		moved = coin.Coins(m.Amount)
+	}
+	return e, moved, nil
+}
+
+func returnEscrowHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*escrow.ReturnMsg)
+	e, err := loadEscrow(ctx, mc, m.EscrowId)
+	if err != nil || e == nil {
+		return err
+	}
+	moved := e.Amount
+	e.Amount = nil
+	e.State = models.EscrowReturned
+	return mc.Tx.SaveEscrow(ctx, mc.change(msg), "return", moved, *e)
+}
+
+func updateEscrowPartiesHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*escrow.UpdatePartiesMsg)
+	e, err := loadEscrow(ctx, mc, m.EscrowId)
+	if err != nil || e == nil {
+		return err
+	}
+	var b bech32
+	if len(m.Source) != 0 {
+		e.Source = b.address(mc.Hrp, m.Source)
+	}
+	if len(m.Arbiter) != 0 {
+		e.Arbiter = b.address(mc.Hrp, m.Arbiter)
+	}
+	if len(m.Destination) != 0 {
+		e.Destination = b.address(mc.Hrp, m.Destination)
+	}
+	if b.err != nil {
+		return b.err
+	}
+	return mc.Tx.SaveEscrow(ctx, mc.change(msg), "update_parties", nil, *e)
+}
+
+// loadEscrow returns the escrow as it is before the message is applied, or
+// nil if it is not known.
+func loadEscrow(ctx context.Context, mc *MsgContext, id []byte) (*models.Escrow, error) {
+	e, err := mc.Tx.EscrowAt(ctx, id, mc.Height)
+	switch {
+	case err == nil:
+		return e, nil
+	case errors.ErrNotFound.Is(err):
+		return nil, nil
+	default:
+		return nil, errors.Wrap(err, "escrow")
+	}
+}
+
+// bech32 encodes addresses, keeping the first error.
+type bech32 struct {
+	err error
+}
+
+func (b *bech32) address(hrp string, a weave.Address) string {
+	s, err := a.Bech32String(hrp)
+	if err != nil && b.err == nil {
+		b.err = errors.Wrap(err, "address")
+	}
+	return s
+}
+
+func modelCoins(coins []*coin.Coin) []models.Coin {
+	var res []models.Coin
+	for _, c := range coins {
+		if c != nil && !c.IsZero() {
+			res = append(res, models.Coin{Ticker: c.Ticker, Whole: c.Whole, Fractional: c.Fractional})
+		}
+	}
+	return res
+}
+
+func weaveCoins(coins []models.Coin) coin.Coins {
+	res := make(coin.Coins, 0, len(coins))
+	for _, c := range coins {
+		res = append(res, &coin.Coin{Ticker: c.Ticker, Whole: c.Whole, Fractional: c.Fractional})
+	}
+	return res
+}
+
+func negativeCoins(coins coin.Coins) coin.Coins {
+	res := make(coin.Coins, 0, len(coins))
+	for _, c := range coins {
+		if c != nil && !c.IsZero() {
+			neg := c.Negative()
+			res = append(res, &neg)
+		}
+	}
+	return res
+}
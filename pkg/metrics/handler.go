@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/block-metrics/pkg/store"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/x/batch"
+)
+
+// MsgContext describes the transaction that a message was sent with.
+type MsgContext struct {
+	Height int64
+	Time   time.Time
+	TxHash string
+	// Signers are the addresses of all transaction signatures.
+	Signers []weave.Address
+	// Fee is the fee paid for the transaction, or nil if none was paid.
+	Fee *models.Fee
+	// Result is the data returned by the chain when delivering the
+	// message, for example the key of a created entity. It is nil if not
+	// known.
+	Result []byte
+	// Failed is true if the chain failed to deliver the transaction.
+	// Messages of a failed transaction did not change the state of the
+	// chain, so only transaction handlers are called.
+	Failed bool
+	// ResultUnknown is true if the result of delivering the transaction is
+	// not known, for example because block results were pruned. The
+	// transaction may have failed, so only transaction handlers are called.
+	ResultUnknown bool
+	// Hrp is the human readable part of bech32 addresses.
+	Hrp string
+	// Tx is the database transaction that the block is inserted with.
+	// All writes done by a handler are committed together with the
+	// block.
+	Tx *store.Tx
+}
+
+// change returns the reference to a message sent with the transaction, used
+// to record history of modified entities.
+func (mc *MsgContext) change(msg weave.Msg) models.Change {
+	return models.Change{
+		Height:  mc.Height,
+		Time:    mc.Time,
+		TxHash:  mc.TxHash,
+		MsgPath: msg.Path(),
+	}
+}
+
+// MsgHandler processes a single message during synchronization. Returning an
+// error stops the synchronization and no data of the block is stored.
+type MsgHandler func(ctx context.Context, mc *MsgContext, msg weave.Msg) error
+
+// Handlers is a registry of message handlers, selected by message path.
+// Handlers are called in registration order.
+//
+// Messages contained in a batch are dispatched one by one, after the batch
+// message itself, each with its own result.
+//
+// Transaction handlers are called once for each transaction, with the
+// transaction message, before any message handler.
+type Handlers struct {
+	byPath   map[string][]*namedHandler
+	byTx     []*namedHandler
+	disabled map[string]bool
+}
+
+type namedHandler struct {
+	name string
+	fn   MsgHandler
+}
+
+// NewHandlers returns an empty registry.
+func NewHandlers() *Handlers {
+	return &Handlers{
+		byPath:   make(map[string][]*namedHandler),
+		disabled: make(map[string]bool),
+	}
+}
+
+// DefaultHandlers returns a registry with all handlers provided by this
+// package.
+func DefaultHandlers() *Handlers {
+	h := NewHandlers()
+	registerAccountHandlers(h)
+	registerLedgerHandlers(h)
+	registerEscrowHandlers(h)
+	registerMultisigHandlers(h)
+	return h
+}
+
+// Register adds a handler for messages with given path. Name is used to
+// enable or disable the handler. Several handlers can share a name.
+func (h *Handlers) Register(name, path string, fn MsgHandler) {
+	h.byPath[path] = append(h.byPath[path], &namedHandler{name: name, fn: fn})
+}
+
+// RegisterTx adds a handler called once for each transaction.
+func (h *Handlers) RegisterTx(name string, fn MsgHandler) {
+	h.byTx = append(h.byTx, &namedHandler{name: name, fn: fn})
+}
+
+// RegisterMsg adds a handler for messages of the same type as given one.
+func (h *Handlers) RegisterMsg(name string, msg weave.Msg, fn MsgHandler) {
+	h.Register(name, msg.Path(), fn)
+}
+
+// Names returns names of all registered handlers, sorted.
+func (h *Handlers) Names() []string {
+	unique := make(map[string]struct{})
+	for _, handlers := range h.byPath {
+		for _, nh := range handlers {
+			unique[nh.name] = struct{}{}
+		}
+	}
+	for _, nh := range h.byTx {
+		unique[nh.name] = struct{}{}
+	}
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Disable turns off all handlers registered with given names. ErrNotFound is
+// returned if no handler is registered with one of the names.
+func (h *Handlers) Disable(names ...string) error {
+	known := make(map[string]bool)
+	for _, name := range h.Names() {
+		known[name] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return errors.Wrapf(errors.ErrNotFound, "handler %q", name)
+		}
+		h.disabled[name] = true
+	}
+	return nil
+}
+
+// Enable turns on handlers previously disabled.
+func (h *Handlers) Enable(names ...string) {
+	for _, name := range names {
+		delete(h.disabled, name)
+	}
+}
+
+// HandleTx calls all enabled transaction handlers and then handles the
+// transaction message, unless the transaction failed or its result is not
+// known.
+func (h *Handlers) HandleTx(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	for _, nh := range h.byTx {
+		if h.disabled[nh.name] {
+			continue
+		}
+		if err := nh.fn(ctx, mc, msg); err != nil {
+			return errors.Wrapf(err, "%s transaction handler", nh.name)
+		}
+	}
+	if mc.Failed || mc.ResultUnknown {
+		return nil
+	}
+	return h.Handle(ctx, mc, msg)
+}
+
+// Handle calls all enabled handlers registered for the message path. If the
+// message is a batch, each contained message is handled as well.
+func (h *Handlers) Handle(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	for _, nh := range h.byPath[msg.Path()] {
+		if h.disabled[nh.name] {
+			continue
+		}
+		if err := nh.fn(ctx, mc, msg); err != nil {
+			return errors.Wrapf(err, "%s handler: %s", nh.name, msg.Path())
+		}
+	}
+
+	b, ok := msg.(batchMsg)
+	if !ok {
+		return nil
+	}
+	list, err := b.MsgList()
+	if err != nil {
+		return errors.Wrap(err, "batch messages")
+	}
+	results := batchResults(mc.Result, len(list))
+	for i, m := range list {
+		sub := *mc
+		sub.Result = results[i]
+		if err := h.Handle(ctx, &sub, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchResults returns the result of each of n batched messages. Results
+// are nil if the batch result is not known.
+func batchResults(data []byte, n int) [][]byte {
+	var list batch.ByteArrayList
+	if data == nil || list.Unmarshal(data) != nil || len(list.Elements) != n {
+		return make([][]byte, n)
+	}
+	return list.Elements
+}
+
+// batchMsg is implemented by all weave batch messages.
+type batchMsg interface {
+	MsgList() ([]weave.Msg, error)
+}
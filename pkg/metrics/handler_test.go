@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/weavetest"
+	"github.com/iov-one/weave/x/batch"
+)
+
+// testBatchMsg is a batch of messages, same as all weave batch
+// implementations.
+type testBatchMsg struct {
+	weavetest.Msg
+	msgs []weave.Msg
+}
+
+func (m *testBatchMsg) MsgList() ([]weave.Msg, error) {
+	return m.msgs, nil
+}
+
+func TestHandlers(t *testing.T) {
+	var handled []string
+	record := func(name string) MsgHandler {
+		return func(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+			handled = append(handled, fmt.Sprintf("%s:%s:%s", name, mc.TxHash, msg.Path()))
+			return nil
+		}
+	}
+
+	h := NewHandlers()
+	h.Register("first", "test/a", record("first"))
+	h.RegisterMsg("second", &weavetest.Msg{RoutePath: "test/a"}, record("second"))
+	h.Register("second", "test/b", record("second"))
+
+	ctx := context.Background()
+	mc := &MsgContext{TxHash: "tx"}
+	batch := &testBatchMsg{
+		Msg: weavetest.Msg{RoutePath: "test/batch"},
+		msgs: []weave.Msg{
+			&weavetest.Msg{RoutePath: "test/b"},
+			&weavetest.Msg{RoutePath: "test/unknown"},
+			&weavetest.Msg{RoutePath: "test/a"},
+		},
+	}
+	if err := h.Handle(ctx, mc, batch); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	want := []string{"second:tx:test/b", "first:tx:test/a", "second:tx:test/a"}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, handled)
+	}
+
+	handled = nil
+	if err := h.Disable("second"); err != nil {
+		t.Fatalf("cannot disable: %s", err)
+	}
+	if err := h.Handle(ctx, mc, batch); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	want = []string{"first:tx:test/a"}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, handled)
+	}
+
+	if err := h.Disable("does-not-exist"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	h.Register("failing", "test/a", func(context.Context, *MsgContext, weave.Msg) error {
+		return errors.ErrHuman
+	})
+	if err := h.Handle(ctx, mc, &weavetest.Msg{RoutePath: "test/a"}); !errors.ErrHuman.Is(err) {
+		t.Fatalf("want handler error, got %v", err)
+	}
+}
+
+func TestTxHandlers(t *testing.T) {
+	var handled []string
+	record := func(name string) MsgHandler {
+		return func(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+			handled = append(handled, fmt.Sprintf("%s:%s", name, msg.Path()))
+			return nil
+		}
+	}
+
+	h := NewHandlers()
+	h.Register("msg", "test/a", record("msg"))
+	h.RegisterTx("tx", record("tx"))
+
+	ctx := context.Background()
+	batch := &testBatchMsg{
+		Msg: weavetest.Msg{RoutePath: "test/batch"},
+		msgs: []weave.Msg{
+			&weavetest.Msg{RoutePath: "test/a"},
+			&weavetest.Msg{RoutePath: "test/a"},
+		},
+	}
+	if err := h.HandleTx(ctx, &MsgContext{}, batch); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	want := []string{"tx:test/batch", "msg:test/a", "msg:test/a"}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, handled)
+	}
+
+	handled = nil
+	if err := h.Disable("tx"); err != nil {
+		t.Fatalf("cannot disable: %s", err)
+	}
+	if err := h.HandleTx(ctx, &MsgContext{}, &weavetest.Msg{RoutePath: "test/a"}); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	want = []string{"msg:test/a"}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, handled)
+	}
+
+	// Messages of failed transactions are not handled.
+	handled = nil
+	h.Enable("tx")
+	if err := h.HandleTx(ctx, &MsgContext{Failed: true}, &weavetest.Msg{RoutePath: "test/a"}); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	want = []string{"tx:test/a"}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, handled)
+	}
+
+	// Nor are messages of transactions which result is not known.
+	handled = nil
+	if err := h.HandleTx(ctx, &MsgContext{ResultUnknown: true}, &weavetest.Msg{RoutePath: "test/a"}); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, handled)
+	}
+}
+
+func TestBatchResults(t *testing.T) {
+	var results []string
+	h := NewHandlers()
+	h.Register("test", "test/a", func(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+		results = append(results, string(mc.Result))
+		return nil
+	})
+
+	msg := &testBatchMsg{
+		Msg: weavetest.Msg{RoutePath: "test/batch"},
+		msgs: []weave.Msg{
+			&weavetest.Msg{RoutePath: "test/a"},
+			&weavetest.Msg{RoutePath: "test/a"},
+		},
+	}
+	data, err := (&batch.ByteArrayList{Elements: [][]byte{[]byte("first"), []byte("second")}}).Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal batch result: %s", err)
+	}
+	mc := &MsgContext{Result: data}
+	if err := h.Handle(context.Background(), mc, msg); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	if want := []string{"first", "second"}; fmt.Sprint(results) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, results)
+	}
+	if string(mc.Result) != string(data) {
+		t.Fatal("batch result must not be modified")
+	}
+
+	results = nil
+	if err := h.Handle(context.Background(), &MsgContext{}, msg); err != nil {
+		t.Fatalf("cannot handle: %s", err)
+	}
+	if want := []string{"", ""}; fmt.Sprint(results) != fmt.Sprint(want) {
+		t.Fatalf("want %v, got %v", want, results)
+	}
+}
@@ -0,0 +1,179 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/iov-one/weave/errors"
+)
+
+// HTTPClient is a Tendermint API client that is using plain HTTP(S) POST
+// requests with the same JSONRPC envelope as the websocket client.
+// Connections are kept alive and reused between calls.
+//
+// Use this client only if the websocket connection is not available,
+// because it does not support subscriptions.
+type HTTPClient struct {
+	idCnt uint64
+
+	url  string
+	http *http.Client
+	conf clientConfig
+}
+
+// NewHTTPClient returns a client that is using given HTTP(S) address of the
+// tendermint API.
+func NewHTTPClient(httpURL string, opts ...ClientOption) *HTTPClient {
+	return &HTTPClient{
+		url: httpURL,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        16,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		conf: newClientConfig(opts),
+	}
+}
+
+// Close releases all idle connections.
+func (c *HTTPClient) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// Do makes a jsonrpc call. This method is safe for concurrent calls.
+func (c *HTTPClient) Do(method string, dest interface{}, args ...interface{}) error {
+	return c.DoContext(context.Background(), method, dest, args...)
+}
+
+// DoContext makes a jsonrpc call, same as Do. The call is aborted when the
+// context is cancelled or its deadline is exceeded. The default request
+// timeout applies if the context deadline is not sooner.
+func (c *HTTPClient) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	ctx, cancel := c.conf.withTimeout(ctx)
+	defer cancel()
+
+	req := newRequest(atomic.AddUint64(&c.idCnt, 1), method, args...)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "marshal request")
+	}
+
+	var resp jsonrpcResponse
+	if err := c.post(ctx, body, &resp); err != nil {
+		if ctx.Err() != nil {
+			return contextErr(ctx.Err(), method)
+		}
+		return err
+	}
+	return resp.decode(dest)
+}
+
+// DoBatch makes all given calls using a single JSONRPC batch request.
+func (c *HTTPClient) DoBatch(ctx context.Context, calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	ctx, cancel := c.conf.withTimeout(ctx)
+	defer cancel()
+
+	firstID := atomic.AddUint64(&c.idCnt, uint64(len(calls))) - uint64(len(calls)) + 1
+	reqs := batchRequests(firstID, calls)
+	body, err := json.Marshal(reqs)
+	if err != nil {
+		return errors.Wrap(err, "marshal request")
+	}
+
+	var raw json.RawMessage
+	if err := c.post(ctx, body, &raw); err != nil {
+		if ctx.Err() != nil {
+			return contextErr(ctx.Err(), batchMethod(calls))
+		}
+		return err
+	}
+
+	// Tendermint returns a single object instead of an array, if the
+	// batch contains only one request or if the whole batch failed.
+	var resps []*jsonrpcResponse
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '{' {
+		var resp jsonrpcResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return errors.Wrapf(ErrFailedResponse, "cannot unmarshal response: %s", err)
+		}
+		if len(reqs) > 1 && resp.Error != nil {
+			return resp.decode(nil)
+		}
+		resps = append(resps, &resp)
+	} else if err := json.Unmarshal(raw, &resps); err != nil {
+		return errors.Wrapf(ErrFailedResponse, "cannot unmarshal response: %s", err)
+	}
+	return decodeBatch(reqs, calls, resps)
+}
+
+// post sends the body and unmarshals the response into dest.
+func (c *HTTPClient) post(ctx context.Context, body []byte, dest interface{}) error {
+	hreq, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	hreq = hreq.WithContext(ctx)
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hresp, err := c.http.Do(hreq)
+	if err != nil {
+		return errors.Wrapf(ErrDisconnected, "post: %s", err)
+	}
+	defer hresp.Body.Close()
+
+	// Always consume the whole body, so that the connection can be
+	// reused.
+	raw, err := ioutil.ReadAll(io.LimitReader(hresp.Body, maxResponseSize))
+	if err != nil {
+		return errors.Wrapf(ErrDisconnected, "read response: %s", err)
+	}
+
+	// Tendermint is using HTTP status codes together with the JSONRPC
+	// error, so the response is decoded regardless of the status.
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return errors.Wrapf(ErrFailedResponse, "%s: cannot unmarshal response: %s", hresp.Status, err)
+	}
+	return nil
+}
+
+// maxResponseSize limits the size of a single HTTP response.
+const maxResponseSize = 64 << 20
+
+// AbciInfo implements TendermintRPC.
+func (c *HTTPClient) AbciInfo(ctx context.Context) (*ABCIInfo, error) {
+	return AbciInfo(ctx, c)
+}
+
+// Commit implements TendermintRPC.
+func (c *HTTPClient) Commit(ctx context.Context, height int64) (*TendermintCommit, error) {
+	return Commit(ctx, c, height)
+}
+
+// FetchBlock implements TendermintRPC.
+func (c *HTTPClient) FetchBlock(ctx context.Context, height int64) (*TendermintBlock, error) {
+	return FetchBlock(ctx, c, height)
+}
+
+// FetchHeights implements TendermintRPC.
+func (c *HTTPClient) FetchHeights(ctx context.Context, fromHeight, toHeight int64) ([]*TendermintHeight, error) {
+	return FetchHeights(ctx, c, fromHeight, toHeight)
+}
+
+// Validators implements TendermintRPC.
+func (c *HTTPClient) Validators(ctx context.Context, height int64) ([]*TendermintValidator, error) {
+	return Validators(ctx, c, height)
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iov-one/weave/errors"
+)
+
+func TestHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		var req jsonrpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("cannot decode request: %s", err)
+		}
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.CorrelationID,
+		}
+		switch req.Method {
+		case "abci_info":
+			resp["result"] = map[string]interface{}{
+				"response": map[string]interface{}{"last_block_height": "7"},
+			}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	c, err := Dial(srv.URL)
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+	if _, ok := c.(*HTTPClient); !ok {
+		t.Fatalf("want HTTP client, got %T", c)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		info, err := c.AbciInfo(ctx)
+		if err != nil {
+			t.Fatalf("cannot get info: %s", err)
+		}
+		if info.LastBlockHeight != 7 {
+			t.Fatalf("unexpected height: %d", info.LastBlockHeight)
+		}
+	}
+
+	var dest json.RawMessage
+	if err := c.DoContext(ctx, "does_not_exist", &dest); !ErrFailedResponse.Is(err) {
+		t.Fatalf("want failed response error, got %v", err)
+	}
+
+	if _, err := Dial("ftp://localhost"); !errors.ErrInput.Is(err) {
+		t.Fatalf("want input error, got %v", err)
+	}
+}
@@ -0,0 +1,262 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/cmd/bnsd/x/termdeposit"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/x/cash"
+	"github.com/iov-one/weave/x/escrow"
+)
+
+// registerLedgerHandlers adds handlers recording balance changes of
+// addresses. Addresses of escrows and term deposits are assigned by the
+// chain. Funds moved into them are recorded as debits of the sender only,
+// unless the key is known from the transaction result. Funds moved out of
+// escrows are recorded only for escrows recorded by the escrow handlers,
+// which must run after these. Funds released from term deposits are recorded
+// only for deposits which address was credited. Fees are recorded as debits
+// of the payer only, because the fee collector address is not known.
+func registerLedgerHandlers(h *Handlers) {
+	h.RegisterTx("ledger", feeLedgerHandler)
+	h.RegisterMsg("ledger", &cash.UpdateConfigurationMsg{}, updateCashConfigurationHandler)
+	h.RegisterMsg("ledger", &cash.SendMsg{}, sendLedgerHandler)
+	h.RegisterMsg("ledger", &escrow.CreateMsg{}, createEscrowLedgerHandler)
+	h.RegisterMsg("ledger", &escrow.ReleaseMsg{}, releaseEscrowLedgerHandler)
+	h.RegisterMsg("ledger", &escrow.ReturnMsg{}, returnEscrowLedgerHandler)
+	h.RegisterMsg("ledger", &termdeposit.DepositMsg{}, depositLedgerHandler)
+	h.RegisterMsg("ledger", &termdeposit.ReleaseDepositMsg{}, releaseDepositLedgerHandler)
+}
+
+// feeLedgerHandler records the fee paid for a transaction. Same as the cash
+// module does, only the minimal fee is charged if the transaction failed to
+// deliver.
+func feeLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	f := mc.Fee
+	if f == nil {
+		return nil
+	}
+	amount := models.Coin{Ticker: f.Ticker, Whole: f.Whole, Fractional: f.Fractional}
+	if mc.Failed {
+		conf, err := mc.Tx.CashConfigurationAt(ctx, mc.Height)
+		switch {
+		case err == nil:
+			amount = conf.MinimalFee
+		case errors.ErrNotFound.Is(err):
+			return nil
+		default:
+			return errors.Wrap(err, "cash configuration")
+		}
+		if amount.Whole == 0 && amount.Fractional == 0 {
+			return nil
+		}
+	}
+	return mc.Tx.InsertLedgerEntries(ctx, []models.LedgerEntry{{
+		Change:     mc.change(msg),
+		Address:    f.Payer,
+		Ticker:     amount.Ticker,
+		Whole:      -amount.Whole,
+		Fractional: -amount.Fractional,
+		Kind:       "fee",
+	}})
+}
+
+// updateCashConfigurationHandler records the patched configuration. A patch
+// of a configuration that is not known is ignored, unless it sets the minimal
+// fee, which is the only field recorded.
+func updateCashConfigurationHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*cash.UpdateConfigurationMsg)
+	if m.Patch == nil {
+		return nil
+	}
+	conf, err := mc.Tx.CashConfigurationAt(ctx, mc.Height)
+	switch {
+	case err == nil:
+	case errors.ErrNotFound.Is(err):
+		if m.Patch.MinimalFee.IsZero() && m.Patch.MinimalFee.Ticker == "" {
+			return nil
+		}
+		conf = &models.CashConfiguration{}
+	default:
+		return errors.Wrap(err, "cash configuration")
+	}
+	return mc.Tx.SetCashConfiguration(ctx, mc.change(msg), patchCashConfiguration(*conf, m.Patch))
+}
+
+// patchCashConfiguration returns the configuration with all non zero fields
+// of the patch applied, same as gconf does.
+func patchCashConfiguration(c models.CashConfiguration, patch *cash.Configuration) models.CashConfiguration {
+	if !patch.MinimalFee.IsZero() || patch.MinimalFee.Ticker != "" {
+		c.MinimalFee = models.Coin{
+			Ticker:     patch.MinimalFee.Ticker,
+			Whole:      patch.MinimalFee.Whole,
+			Fractional: patch.MinimalFee.Fractional,
+		}
+	}
+	return c
+}
+
+// CashConfiguration returns the current configuration of the cash module,
+// read from the chain, and the height it was read at. ErrNotFound is returned
+// if the chain has no cash module configuration.
+func CashConfiguration(ctx context.Context, c Caller) (*models.CashConfiguration, int64, error) {
+	var conf cash.Configuration
+	height, err := queryConfiguration(ctx, c, "cash", &conf)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := patchCashConfiguration(models.CashConfiguration{}, &conf)
+	return &res, height, nil
+}
+
+func sendLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*cash.SendMsg)
+	if m.Amount == nil {
+		return nil
+	}
+	l := ledger{mc: mc, msg: msg}
+	l.transfer("send", m.Source, m.Destination, *m.Amount)
+	return l.insert(ctx)
+}
+
+func createEscrowLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*escrow.CreateMsg)
+	var dst weave.Address
+	if len(mc.Result) != 0 {
+		dst = escrow.Condition(mc.Result).Address()
+	}
+	l := ledger{mc: mc, msg: msg}
+	for _, c := range m.Amount {
+		if c != nil {
+			l.transfer("escrow", m.Source, dst, *c)
+		}
+	}
+	return l.insert(ctx)
+}
+
+func releaseEscrowLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	e, moved, err := escrowRelease(ctx, mc, msg.(*escrow.ReleaseMsg))
+	if err != nil || e == nil {
+		return err
+	}
+	l := ledger{mc: mc, msg: msg}
+	for _, c := range modelCoins(moved) {
+		l.move("escrow", e.Address, e.Destination, c)
+	}
+	return l.insert(ctx)
+}
+
+func returnEscrowLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	e, err := loadEscrow(ctx, mc, msg.(*escrow.ReturnMsg).EscrowId)
+	if err != nil || e == nil {
+		return err
+	}
+	l := ledger{mc: mc, msg: msg}
+	for _, c := range e.Amount {
+		l.move("escrow", e.Address, e.Source, c)
+	}
+	return l.insert(ctx)
+}
+
+func depositLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*termdeposit.DepositMsg)
+	var dst weave.Address
+	if len(mc.Result) != 0 {
+		dst = depositAddress(mc.Result)
+	}
+	l := ledger{mc: mc, msg: msg}
+	l.transfer("term_deposit", m.Depositor, dst, m.Amount)
+	return l.insert(ctx)
+}
+
+// releaseDepositLedgerHandler records the release of all funds held by a
+// term deposit, which are the deposited principal and the interest sent to
+// the deposit address, back to the depositor.
+func releaseDepositLedgerHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*termdeposit.ReleaseDepositMsg)
+	l := ledger{mc: mc, msg: msg}
+	src := l.address(mc.Hrp, depositAddress(m.DepositID))
+	if l.err != nil {
+		return l.err
+	}
+	// The depositor is known from the deposit credit.
+	depositor, err := mc.Tx.LedgerCounterparty(ctx, src, "term_deposit")
+	switch {
+	case err == nil:
+	case errors.ErrNotFound.Is(err):
+		return nil
+	default:
+		return errors.Wrap(err, "depositor")
+	}
+	funds, err := mc.Tx.BalanceAt(ctx, src, mc.Height)
+	if err != nil {
+		return errors.Wrap(err, "deposit balance")
+	}
+	for _, b := range funds {
+		if b.Whole > 0 || b.Fractional > 0 {
+			l.move("term_deposit", src, depositor, models.Coin{Ticker: b.Ticker, Whole: b.Whole, Fractional: b.Fractional})
+		}
+	}
+	return l.insert(ctx)
+}
+
+// depositAddress returns the address holding funds of a term deposit, same
+// as the term deposit module does.
+func depositAddress(key []byte) weave.Address {
+	return weave.NewCondition("deposit", "seq", key).Address()
+}
+
+// ledger collects entries of a single message. The first address encoding
+// error is kept and returned by insert.
+type ledger struct {
+	bech32
+	mc      *MsgContext
+	msg     weave.Msg
+	entries []models.LedgerEntry
+}
+
+// transfer records a movement of funds between two addresses. Only the
+// debit is recorded if the destination is not known.
+func (l *ledger) transfer(kind string, from, to weave.Address, amount coin.Coin) {
+	src := l.address(l.mc.Hrp, from)
+	var dst string
+	if len(to) != 0 {
+		dst = l.address(l.mc.Hrp, to)
+	}
+	l.add(kind, src, dst, amount.Negative())
+	if dst != "" {
+		l.add(kind, dst, src, amount)
+	}
+}
+
+// move records a movement of funds between two bech32 addresses.
+func (l *ledger) move(kind, from, to string, c models.Coin) {
+	amount := coin.Coin{Ticker: c.Ticker, Whole: c.Whole, Fractional: c.Fractional}
+	l.add(kind, from, to, amount.Negative())
+	l.add(kind, to, from, amount)
+}
+
+func (l *ledger) add(kind, address, counterparty string, amount coin.Coin) {
+	l.entries = append(l.entries, models.LedgerEntry{
+		Change:       l.mc.change(l.msg),
+		Address:      address,
+		Ticker:       amount.Ticker,
+		Whole:        amount.Whole,
+		Fractional:   amount.Fractional,
+		Kind:         kind,
+		Counterparty: counterparty,
+	})
+}
+
+func (l *ledger) insert(ctx context.Context) error {
+	if l.err != nil {
+		return l.err
+	}
+	if len(l.entries) == 0 {
+		return nil
+	}
+	return l.mc.Tx.InsertLedgerEntries(ctx, l.entries)
+}
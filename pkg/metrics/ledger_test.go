@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/weavetest"
+	"github.com/iov-one/weave/x/cash"
+)
+
+func TestLedgerTransfer(t *testing.T) {
+	alice := weavetest.NewCondition().Address()
+	bob := weavetest.NewCondition().Address()
+	aliceBech, _ := alice.Bech32String("tiov")
+	bobBech, _ := bob.Bech32String("tiov")
+
+	mc := &MsgContext{Height: 7, TxHash: "tx", Hrp: "tiov"}
+	l := ledger{mc: mc, msg: &weavetest.Msg{RoutePath: "cash/send"}}
+	l.transfer("send", alice, bob, coin.NewCoin(1, 500, "IOV"))
+	l.transfer("escrow", alice, nil, coin.NewCoin(2, 0, "IOV"))
+	if l.err != nil {
+		t.Fatalf("unexpected error: %s", l.err)
+	}
+
+	type entry struct {
+		address, counterparty string
+		whole, fractional     int64
+	}
+	want := []entry{
+		{aliceBech, bobBech, -1, -500},
+		{bobBech, aliceBech, 1, 500},
+		{aliceBech, "", -2, 0},
+	}
+	if len(l.entries) != len(want) {
+		t.Fatalf("want %d entries, got %+v", len(want), l.entries)
+	}
+	for i, e := range l.entries {
+		got := entry{e.Address, e.Counterparty, e.Whole, e.Fractional}
+		if got != want[i] {
+			t.Errorf("entry %d: want %+v, got %+v", i, want[i], got)
+		}
+		if e.Height != 7 || e.TxHash != "tx" || e.MsgPath != "cash/send" || e.Ticker != "IOV" {
+			t.Errorf("entry %d: unexpected change %+v", i, e)
+		}
+	}
+
+	l = ledger{mc: mc, msg: &weavetest.Msg{}}
+	l.transfer("send", nil, bob, coin.NewCoin(1, 0, "IOV"))
+	if l.err == nil {
+		t.Fatal("want invalid address error")
+	}
+}
+
+func TestPatchCashConfiguration(t *testing.T) {
+	conf := models.CashConfiguration{MinimalFee: models.Coin{Ticker: "IOV", Whole: 1}}
+
+	got := patchCashConfiguration(conf, &cash.Configuration{})
+	if got != conf {
+		t.Fatalf("want %+v, got %+v", conf, got)
+	}
+
+	got = patchCashConfiguration(conf, &cash.Configuration{MinimalFee: coin.NewCoin(0, 5, "IOV")})
+	want := models.CashConfiguration{MinimalFee: models.Coin{Ticker: "IOV", Fractional: 5}}
+	if got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
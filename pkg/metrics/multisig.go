@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/x/multisig"
+)
+
+// registerMultisigHandlers adds handlers recording multisig contracts. The
+// key of a created contract is known only from the transaction result, so
+// contracts created by transactions fetched without results are recorded
+// only once they are updated.
+func registerMultisigHandlers(h *Handlers) {
+	h.RegisterMsg("multisig", &multisig.CreateMsg{}, createMultisigHandler)
+	h.RegisterMsg("multisig", &multisig.UpdateMsg{}, updateMultisigHandler)
+}
+
+func createMultisigHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*multisig.CreateMsg)
+	if len(mc.Result) == 0 {
+		return nil
+	}
+	return saveMultisigContract(ctx, mc, msg, mc.Result, m.Participants, m.ActivationThreshold, m.AdminThreshold)
+}
+
+func updateMultisigHandler(ctx context.Context, mc *MsgContext, msg weave.Msg) error {
+	m := msg.(*multisig.UpdateMsg)
+	// Same as the multisig module, the contract is replaced.
+	return saveMultisigContract(ctx, mc, msg, m.ContractID, m.Participants, m.ActivationThreshold, m.AdminThreshold)
+}
+
+func saveMultisigContract(ctx context.Context, mc *MsgContext, msg weave.Msg, id []byte, participants []*multisig.Participant, activation, admin multisig.Weight) error {
+	var b bech32
+	c := models.MultisigContract{
+		ID:                  id,
+		Address:             b.address(mc.Hrp, multisig.MultiSigCondition(id).Address()),
+		ActivationThreshold: int32(activation),
+		AdminThreshold:      int32(admin),
+	}
+	for _, p := range participants {
+		if p == nil {
+			continue
+		}
+		c.Participants = append(c.Participants, models.MultisigParticipant{
+			Address: b.address(mc.Hrp, p.Signature),
+			Weight:  int32(p.Weight),
+		})
+	}
+	if b.err != nil {
+		return b.err
+	}
+	return mc.Tx.SaveMultisigContract(ctx, mc.change(msg), c)
+}
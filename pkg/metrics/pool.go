@@ -0,0 +1,364 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iov-one/weave/errors"
+)
+
+// Caller is implemented by clients that can make a Tendermint JSONRPC call.
+// All clients provided by this package implement it.
+type Caller interface {
+	DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error
+}
+
+// Subscriber is implemented by clients that can deliver Tendermint events.
+type Subscriber interface {
+	Subscribe(ctx context.Context, query string) (<-chan json.RawMessage, error)
+	Unsubscribe(ctx context.Context, query string) error
+}
+
+const (
+	// healthCheckInterval is how often the height of each node is
+	// refreshed.
+	healthCheckInterval = 5 * time.Second
+	// errorWindow is how long a failed call is counted against a node.
+	errorWindow = time.Minute
+	// DefaultMaxLag is the default number of blocks a node can be behind
+	// the highest node and still be considered healthy.
+	DefaultMaxLag = 2
+)
+
+// heightMethods lists the API methods which first argument is the block
+// height.
+var heightMethods = map[string]bool{
+	"block":         true,
+	"block_results": true,
+	"commit":        true,
+	"validators":    true,
+}
+
+// Pool routes calls to the healthiest of several Tendermint nodes. Nodes are
+// ranked by the number of recently failed calls and by their height as
+// reported by abci_info. A call for a certain height is never sent to a node
+// that has not reached that height yet. A failed call is retried using the
+// next best node.
+type Pool struct {
+	nodes  []*poolNode
+	maxLag int64
+
+	stop chan struct{}
+
+	mu sync.Mutex
+	// subs maps subscription query to the node that serves it.
+	subs map[string]*poolNode
+}
+
+type poolNode struct {
+	name string
+	c    Caller
+
+	mu          sync.Mutex
+	height      int64
+	failures    int
+	lastFailure time.Time
+}
+
+// NewPool returns a pool that routes calls to given nodes. Names are used
+// for logging only. Node heights are refreshed in the background until the
+// pool is closed.
+func NewPool(names []string, clients []Caller, maxLag int64) *Pool {
+	p := &Pool{
+		maxLag: maxLag,
+		stop:   make(chan struct{}),
+		subs:   make(map[string]*poolNode),
+	}
+	for i, c := range clients {
+		p.nodes = append(p.nodes, &poolNode{name: names[i], c: c})
+	}
+	p.checkHealth()
+	go p.healthLoop()
+	return p
+}
+
+// DialPool returns a pool of clients, one for each given URL. Transport of
+// each client is selected by the URL scheme, same as Dial does.
+func DialPool(urls []string, opts ...ClientOption) (*Pool, error) {
+	var clients []Caller
+	for _, u := range urls {
+		c, err := Dial(u, opts...)
+		if err != nil {
+			for _, c := range clients {
+				c.(io.Closer).Close()
+			}
+			return nil, errors.Wrapf(err, "dial %s", u)
+		}
+		clients = append(clients, c)
+	}
+	return NewPool(urls, clients, DefaultMaxLag), nil
+}
+
+// Close stops the health checks and closes all nodes that can be closed.
+func (p *Pool) Close() error {
+	close(p.stop)
+	var err error
+	for _, n := range p.nodes {
+		if c, ok := n.c.(io.Closer); ok {
+			err = errors.Append(err, c.Close())
+		}
+	}
+	return err
+}
+
+func (p *Pool) healthLoop() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth refreshes the height of all nodes concurrently.
+func (p *Pool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *poolNode) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), healthCheckInterval)
+			defer cancel()
+
+			info, err := AbciInfo(ctx, n.c)
+			if err != nil {
+				log.Printf("pool node %s: health check: %s", n.name, err)
+				n.failed()
+				return
+			}
+			n.mu.Lock()
+			n.height = info.LastBlockHeight
+			n.mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+}
+
+func (n *poolNode) failed() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failures++
+	n.lastFailure = time.Now()
+}
+
+// state returns the height and the number of recently failed calls.
+func (n *poolNode) state() (height int64, failures int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if time.Since(n.lastFailure) > errorWindow {
+		n.failures = 0
+	}
+	return n.height, n.failures
+}
+
+// candidates returns nodes that can serve a call for given height (zero if
+// not relevant), best first. Nodes that are lagging behind are moved to the
+// end of the list.
+func (p *Pool) candidates(minHeight int64) []*poolNode {
+	type ranked struct {
+		node     *poolNode
+		height   int64
+		failures int
+	}
+	var (
+		all []ranked
+		top int64
+	)
+	for _, n := range p.nodes {
+		h, f := n.state()
+		if h < minHeight {
+			continue
+		}
+		if h > top {
+			top = h
+		}
+		all = append(all, ranked{node: n, height: h, failures: f})
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		iLag := top-all[i].height > p.maxLag
+		jLag := top-all[j].height > p.maxLag
+		if iLag != jLag {
+			return jLag
+		}
+		if all[i].failures != all[j].failures {
+			return all[i].failures < all[j].failures
+		}
+		return all[i].height > all[j].height
+	})
+
+	nodes := make([]*poolNode, len(all))
+	for i, r := range all {
+		nodes[i] = r.node
+	}
+	return nodes
+}
+
+// nodesAt returns candidates for a call for given height. Heights are
+// refreshed only periodically, so a block that was just announced may not be
+// reflected yet. If no node qualifies, heights are refreshed immediately
+// before giving up.
+func (p *Pool) nodesAt(minHeight int64) []*poolNode {
+	nodes := p.candidates(minHeight)
+	if len(nodes) == 0 && minHeight > 0 {
+		p.checkHealth()
+		nodes = p.candidates(minHeight)
+	}
+	return nodes
+}
+
+// DoContext makes a jsonrpc call using the best node available. If the call
+// fails, it is retried using the next best node.
+func (p *Pool) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	var minHeight int64
+	if heightMethods[method] && len(args) > 0 {
+		minHeight = heightArg(args[0])
+	}
+
+	nodes := p.nodesAt(minHeight)
+	if len(nodes) == 0 {
+		return errors.Wrapf(ErrNoNode, "no node at height %d", minHeight)
+	}
+
+	var err error
+	for _, n := range nodes {
+		if err = n.c.DoContext(ctx, method, dest, args...); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Printf("pool node %s: %s: %s", n.name, method, err)
+		n.failed()
+	}
+	return err
+}
+
+// DoBatch makes all given calls using the best node that has reached the
+// highest height requested by the batch. If the whole batch fails, it is
+// retried using the next best node. Same for failed calls of the batch, for
+// example block results that were pruned by the node. Each call's Err is
+// left set only if no node could serve it.
+func (p *Pool) DoBatch(ctx context.Context, calls []*BatchCall) error {
+	var minHeight int64
+	for _, call := range calls {
+		if heightMethods[call.Method] && len(call.Args) > 0 {
+			if h := heightArg(call.Args[0]); h > minHeight {
+				minHeight = h
+			}
+		}
+	}
+
+	nodes := p.nodesAt(minHeight)
+	if len(nodes) == 0 {
+		return errors.Wrapf(ErrNoNode, "no node at height %d", minHeight)
+	}
+
+	var (
+		pending = calls
+		err     error
+	)
+	for _, n := range nodes {
+		if err = DoBatch(ctx, n.c, pending); err == nil {
+			if pending = failedCalls(pending); len(pending) == 0 {
+				return nil
+			}
+			log.Printf("pool node %s: %s: %s", n.name, batchMethod(pending), pending[0].Err)
+		} else {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("pool node %s: %s: %s", n.name, batchMethod(pending), err)
+		}
+		n.failed()
+	}
+	if err != nil && len(pending) == len(calls) {
+		return err
+	}
+	// Some calls were served, so the batch did not fail as a whole.
+	if err != nil {
+		for _, call := range pending {
+			call.Err = err
+		}
+	}
+	return nil
+}
+
+// failedCalls returns the calls that have an error set.
+func failedCalls(calls []*BatchCall) []*BatchCall {
+	var failed []*BatchCall
+	for _, call := range calls {
+		if call.Err != nil {
+			failed = append(failed, call)
+		}
+	}
+	return failed
+}
+
+func heightArg(arg interface{}) int64 {
+	switch h := arg.(type) {
+	case int64:
+		return h
+	case int:
+		return int64(h)
+	}
+	return 0
+}
+
+// Subscribe registers for events using the best node that supports
+// subscriptions. The subscription is not moved to another node if the
+// serving node fails. Instead the events channel is closed and the
+// subscription must be renewed.
+func (p *Pool) Subscribe(ctx context.Context, query string) (<-chan json.RawMessage, error) {
+	var err error = errors.Wrap(ErrNoNode, "no node supports subscriptions")
+	for _, n := range p.candidates(0) {
+		s, ok := n.c.(Subscriber)
+		if !ok {
+			continue
+		}
+		var events <-chan json.RawMessage
+		if events, err = s.Subscribe(ctx, query); err == nil {
+			p.mu.Lock()
+			p.subs[query] = n
+			p.mu.Unlock()
+			return events, nil
+		}
+		log.Printf("pool node %s: subscribe: %s", n.name, err)
+		n.failed()
+	}
+	return nil, err
+}
+
+// Unsubscribe cancels subscription for given query.
+func (p *Pool) Unsubscribe(ctx context.Context, query string) error {
+	p.mu.Lock()
+	n, ok := p.subs[query]
+	delete(p.subs, query)
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return n.c.(Subscriber).Unsubscribe(ctx, query)
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestPoolRouting(t *testing.T) {
+	newNode := func(height int64, served *[]int) *fakeTendermint {
+		ft := newFakeTendermint(t)
+		ft.Handle("abci_info", func([]string) (interface{}, error) {
+			return map[string]interface{}{
+				"response": map[string]interface{}{"last_block_height": fmt.Sprint(height)},
+			}, nil
+		})
+		ft.Handle("block", func([]string) (interface{}, error) {
+			*served = append(*served, int(height))
+			return map[string]interface{}{}, nil
+		})
+		return ft
+	}
+
+	var served []int
+	low := newNode(10, &served)
+	defer low.Close()
+	high := newNode(20, &served)
+	defer high.Close()
+
+	pool, err := DialPool([]string{low.URL(), high.URL()})
+	if err != nil {
+		t.Fatalf("cannot dial pool: %s", err)
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	info, err := AbciInfo(ctx, pool)
+	if err != nil {
+		t.Fatalf("cannot get info: %s", err)
+	}
+	if info.LastBlockHeight != 20 {
+		t.Fatalf("info must be served by the highest node, got %d", info.LastBlockHeight)
+	}
+
+	var dest json.RawMessage
+	if err := pool.DoContext(ctx, "block", &dest, int64(15)); err != nil {
+		t.Fatalf("cannot get block: %s", err)
+	}
+	if err := pool.DoContext(ctx, "block", &dest, int64(21)); !ErrNoNode.Is(err) {
+		t.Fatalf("want no node error, got %v", err)
+	}
+
+	// Make the highest node fail. The call must fail over to the
+	// remaining node.
+	high.Handle("block", func([]string) (interface{}, error) {
+		return nil, ErrFailedResponse
+	})
+	if err := pool.DoContext(ctx, "block", &dest, int64(5)); err != nil {
+		t.Fatalf("cannot get block: %s", err)
+	}
+
+	if want := []int{20, 10}; fmt.Sprint(served) != fmt.Sprint(want) {
+		t.Fatalf("want blocks served by %v, got %v", want, served)
+	}
+
+	// A node that has just reached a height must be found without waiting
+	// for the periodic health check.
+	high.Handle("abci_info", func([]string) (interface{}, error) {
+		return map[string]interface{}{
+			"response": map[string]interface{}{"last_block_height": "25"},
+		}, nil
+	})
+	high.Handle("block", func([]string) (interface{}, error) {
+		return map[string]interface{}{}, nil
+	})
+	if err := pool.DoContext(ctx, "block", &dest, int64(22)); err != nil {
+		t.Fatalf("cannot get block: %s", err)
+	}
+
+	// A call that failed within a batch is retried using the next node,
+	// while the rest of the batch is served by the best node.
+	var commits []int
+	for _, n := range []struct {
+		ft     *fakeTendermint
+		height int
+	}{{low, 10}, {high, 25}} {
+		height := n.height
+		n.ft.Handle("commit", func([]string) (interface{}, error) {
+			if height == 25 {
+				return nil, ErrFailedResponse
+			}
+			commits = append(commits, height)
+			return map[string]interface{}{}, nil
+		})
+	}
+	served = nil
+	high.Handle("block", func([]string) (interface{}, error) {
+		served = append(served, 25)
+		return map[string]interface{}{}, nil
+	})
+	calls := []*BatchCall{
+		{Method: "block", Args: []interface{}{int64(5)}, Dest: &dest},
+		{Method: "commit", Args: []interface{}{int64(5)}, Dest: &dest},
+	}
+	if err := pool.DoBatch(ctx, calls); err != nil {
+		t.Fatalf("cannot do batch: %s", err)
+	}
+	for _, call := range calls {
+		if call.Err != nil {
+			t.Fatalf("%s: %s", call.Method, call.Err)
+		}
+	}
+	if fmt.Sprint(served) != "[25]" || fmt.Sprint(commits) != "[10]" {
+		t.Fatalf("want block served by the highest node and commit by the other, got %v and %v", served, commits)
+	}
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/block-metrics/pkg/store"
+	"github.com/iov-one/weave/errors"
+)
+
+// Reindex processes again all stored blocks within given height range,
+// including both ends, without accessing the network. Transactions are
+// decoded from their stored binary representation, all data derived from them
+// is replaced and message handlers are called again. Blocks are processed in
+// height order, in batches of the configured size, each batch within a single
+// database transaction. Fetch workers setting is ignored.
+//
+// Domains and accounts are first restored to their state before the range
+// using their history, so that handlers apply each change to the state it was
+// originally applied to. The range must end at the last stored block, which
+// is used if toHeight is zero, so that the state is current once all blocks
+// are reindexed. If reindexing fails, it must be run again from the same
+// height.
+//
+// Blocks stored without raw data cannot be reindexed. It always returns the
+// number of blocks reindexed, even if returning an error.
+func Reindex(ctx context.Context, st *store.Store, hrp string, fromHeight, toHeight int64, opts ...SyncOption) (uint, error) {
+	last, err := st.LatestBlock(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "last stored block")
+	}
+	if toHeight == 0 {
+		toHeight = last.Height
+	}
+	if toHeight != last.Height {
+		return 0, errors.Wrapf(errors.ErrInput, "range must end at the last stored block %d", last.Height)
+	}
+	if fromHeight < 1 || toHeight < fromHeight {
+		return 0, errors.Wrapf(errors.ErrInput, "invalid range %d-%d", fromHeight, toHeight)
+	}
+	conf := newSyncConfig(opts)
+
+	var reindexed uint
+	for start := fromHeight; start <= toHeight; start += int64(conf.batchSize) {
+		if err := ctx.Err(); err != nil {
+			return reindexed, err
+		}
+		end := start + int64(conf.batchSize) - 1
+		if end > toHeight {
+			end = toHeight
+		}
+
+		stored, err := st.LoadRawBlocks(ctx, start, end)
+		if err != nil {
+			return reindexed, errors.Wrapf(err, "load blocks %d-%d", start, end)
+		}
+		blocks := make([]*pendingBlock, len(stored))
+		for i, b := range stored {
+			if blocks[i], err = reprocessBlock(b, conf.decoder, hrp); err != nil {
+				return reindexed, errors.Wrapf(err, "block %d", b.Height)
+			}
+		}
+
+		err = st.InTx(ctx, func(tx *store.Tx) error {
+			if start == fromHeight {
+				if err := tx.RewindAccounts(ctx, fromHeight-1); err != nil {
+					return errors.Wrapf(err, "rewind accounts to %d", fromHeight-1)
+				}
+			}
+			for _, b := range blocks {
+				if err := tx.ReindexBlock(ctx, b.block); err != nil {
+					return errors.Wrapf(err, "reindex block %d", b.block.Height)
+				}
+				if err := handleBlock(ctx, conf.handlers, hrp, tx, b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return reindexed, err
+		}
+		reindexed += uint(len(blocks))
+	}
+	return reindexed, nil
+}
+
+// reprocessBlock returns the block with all transaction data derived again
+// from its raw transactions.
+func reprocessBlock(b *models.Block, dec TxDecoder, hrp string) (*pendingBlock, error) {
+	if len(b.Header) == 0 {
+		return nil, errors.Wrap(errors.ErrState, "no raw data stored")
+	}
+	tmblock := NewTendermintBlock(b.Height, b.Time, b.RawTransactions)
+	results, err := parseTxResults(b.Results)
+	if err != nil {
+		return nil, err
+	}
+	tmblock.Results = results
+	processed, err := processTransactions(tmblock, dec, hrp)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingBlock{
+		block: models.Block{
+			Height:       b.Height,
+			Hash:         b.Hash,
+			Time:         b.Time,
+			Messages:     processed.messages,
+			Fees:         processed.fees,
+			Transactions: processed.transactions,
+		},
+		msgs: processed.msgs,
+	}, nil
+}
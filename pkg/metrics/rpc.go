@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/url"
+
+	"github.com/iov-one/weave/errors"
+)
+
+// TendermintRPC is the set of Tendermint API calls required to synchronize
+// the chain. All clients provided by this package implement it. Implement it
+// to provide a different transport or to replay recorded data.
+//
+// If an implementation is a Subscriber as well, StreamSync is using
+// subscriptions instead of polling.
+type TendermintRPC interface {
+	AbciInfo(ctx context.Context) (*ABCIInfo, error)
+	Commit(ctx context.Context, height int64) (*TendermintCommit, error)
+	FetchBlock(ctx context.Context, height int64) (*TendermintBlock, error)
+	FetchHeights(ctx context.Context, fromHeight, toHeight int64) ([]*TendermintHeight, error)
+	Validators(ctx context.Context, height int64) ([]*TendermintValidator, error)
+}
+
+// Client is a connection to a Tendermint node, regardless of the transport
+// used.
+type Client interface {
+	Caller
+	TendermintRPC
+	io.Closer
+}
+
+var (
+	_ Client = (*TendermintClient)(nil)
+	_ Client = (*HTTPClient)(nil)
+	_ Client = (*Pool)(nil)
+)
+
+// Dial returns a client for given tendermint API address. The transport is
+// selected by the URL scheme. Use ws:// or wss:// for a websocket connection
+// and http:// or https:// for plain HTTP requests.
+func Dial(rawurl string, opts ...ClientOption) (Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(errors.ErrInput, err.Error())
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		return DialTendermint(rawurl, opts...)
+	case "http", "https":
+		return NewHTTPClient(rawurl, opts...), nil
+	default:
+		return nil, errors.Wrapf(errors.ErrInput, "unsupported scheme %q", u.Scheme)
+	}
+}
+
+// AbciInfo implements TendermintRPC.
+func (c *TendermintClient) AbciInfo(ctx context.Context) (*ABCIInfo, error) {
+	return AbciInfo(ctx, c)
+}
+
+// Commit implements TendermintRPC.
+func (c *TendermintClient) Commit(ctx context.Context, height int64) (*TendermintCommit, error) {
+	return Commit(ctx, c, height)
+}
+
+// FetchBlock implements TendermintRPC.
+func (c *TendermintClient) FetchBlock(ctx context.Context, height int64) (*TendermintBlock, error) {
+	return FetchBlock(ctx, c, height)
+}
+
+// FetchHeights implements TendermintRPC.
+func (c *TendermintClient) FetchHeights(ctx context.Context, fromHeight, toHeight int64) ([]*TendermintHeight, error) {
+	return FetchHeights(ctx, c, fromHeight, toHeight)
+}
+
+// Validators implements TendermintRPC.
+func (c *TendermintClient) Validators(ctx context.Context, height int64) ([]*TendermintValidator, error) {
+	return Validators(ctx, c, height)
+}
+
+// AbciInfo implements TendermintRPC.
+func (p *Pool) AbciInfo(ctx context.Context) (*ABCIInfo, error) {
+	return AbciInfo(ctx, p)
+}
+
+// Commit implements TendermintRPC.
+func (p *Pool) Commit(ctx context.Context, height int64) (*TendermintCommit, error) {
+	return Commit(ctx, p, height)
+}
+
+// FetchBlock implements TendermintRPC.
+func (p *Pool) FetchBlock(ctx context.Context, height int64) (*TendermintBlock, error) {
+	return FetchBlock(ctx, p, height)
+}
+
+// FetchHeights implements TendermintRPC.
+func (p *Pool) FetchHeights(ctx context.Context, fromHeight, toHeight int64) ([]*TendermintHeight, error) {
+	return FetchHeights(ctx, p, fromHeight, toHeight)
+}
+
+// Validators implements TendermintRPC.
+func (p *Pool) Validators(ctx context.Context, height int64) ([]*TendermintValidator, error) {
+	return Validators(ctx, p, height)
+}
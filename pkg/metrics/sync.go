@@ -5,10 +5,11 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"log"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/iov-one/weave/cmd/bnsd/x/account"
-
 	"github.com/iov-one/block-metrics/pkg/models"
 	"github.com/iov-one/block-metrics/pkg/store"
 	"github.com/iov-one/weave"
@@ -20,242 +21,662 @@ import (
 
 const syncRetryTimeout = 3 * time.Second
 
+const (
+	// DefaultFetchWorkers is the default number of batches fetched
+	// concurrently.
+	DefaultFetchWorkers = 4
+	// DefaultBatchSize is the default maximum number of heights fetched in
+	// a single batch.
+	DefaultBatchSize = 20
+)
+
+// syncConfig is the configuration of the synchronization process.
+type syncConfig struct {
+	workers   int
+	batchSize int
+	handlers  *Handlers
+	decoder   TxDecoder
+}
+
+func newSyncConfig(opts []SyncOption) syncConfig {
+	conf := syncConfig{
+		workers:   DefaultFetchWorkers,
+		batchSize: DefaultBatchSize,
+		handlers:  DefaultHandlers(),
+		decoder:   BnsdDecoder,
+	}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return conf
+}
+
+// SyncOption configures Sync, StreamSync and Reindex.
+type SyncOption func(*syncConfig)
+
+// WithFetchWorkers sets the number of batches that are fetched concurrently,
+// ahead of the block that is inserted. Blocks are always inserted in height
+// order. Value lower than one is ignored.
+func WithFetchWorkers(n int) SyncOption {
+	return func(c *syncConfig) {
+		if n > 0 {
+			c.workers = n
+		}
+	}
+}
+
+// WithHandlers sets the registry of handlers that each synchronized message is
+// passed to. DefaultHandlers are used if not set.
+func WithHandlers(h *Handlers) SyncOption {
+	return func(c *syncConfig) {
+		c.handlers = h
+	}
+}
+
+// WithDecoder sets the decoder of transactions. BnsdDecoder is used if not
+// set.
+func WithDecoder(d TxDecoder) SyncOption {
+	return func(c *syncConfig) {
+		c.decoder = d
+	}
+}
+
+// WithBatchSize sets the maximum number of heights fetched in a single batch.
+// Value lower than one is ignored.
+func WithBatchSize(n int) SyncOption {
+	return func(c *syncConfig) {
+		if n > 0 {
+			c.batchSize = n
+		}
+	}
+}
+
 // Sync uploads to local store all blocks that are not present yet, starting
 // with the blocks with the lowest hight first. It always returns the number of
 // blocks inserted, even if returning an error.
-func Sync(ctx context.Context, tmc *TendermintClient, st *store.Store, hrp string) (uint, error) {
-	var (
-		inserted        uint
-		syncedHeight    int64
-		lastKnownHeight int64
-	)
+func Sync(ctx context.Context, tmc TendermintRPC, st *store.Store, hrp string, opts ...SyncOption) (uint, error) {
+	s, err := newSyncer(ctx, tmc, st, hrp, newSyncConfig(opts))
+	if err != nil {
+		return 0, err
+	}
+	err = s.poll(ctx)
+	return s.inserted, err
+}
 
-	switch block, err := st.LatestBlock(ctx); {
-	case errors.ErrNotFound.Is(err):
-		syncedHeight = 0
-	case err == nil:
-		syncedHeight = block.Height
-	default:
-		return inserted, errors.Wrap(err, "latest block")
+// StreamSync works similar to Sync, but instead of polling for new blocks it
+// subscribes to new block events, if the client supports subscriptions. All
+// missing blocks are uploaded first, then each new block is inserted as soon
+// as it is published.
+//
+// This function never returns unless the context was cancelled. Any failure
+// is logged and the synchronization is restarted after a short delay.
+func StreamSync(ctx context.Context, tmc TendermintRPC, st *store.Store, hrp string, opts ...SyncOption) error {
+	conf := newSyncConfig(opts)
+	for {
+		err := streamSync(ctx, tmc, st, hrp, conf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("stream sync: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(syncRetryTimeout):
+		}
 	}
+}
 
-	// Keep the mapping for validator address to their numeric ID in memory
-	// to avoid querying the database for every insert.
-	validatorIDs := newValidatorsCache(tmc, st)
-	var vSet []*TendermintValidator
-	var vHash []byte
+func streamSync(ctx context.Context, tmc TendermintRPC, st *store.Store, hrp string, conf syncConfig) error {
+	s, err := newSyncer(ctx, tmc, st, hrp, conf)
+	if err != nil {
+		return err
+	}
+
+	sub, ok := tmc.(Subscriber)
+	if !ok {
+		return s.poll(ctx)
+	}
+
+	// Subscribe before catching up so that no block that is created in
+	// the meantime is missed.
+	events, err := sub.Subscribe(ctx, newBlockQuery)
+	if err != nil {
+		return errors.Wrap(err, "subscribe")
+	}
+	defer func() {
+		// Context might be already cancelled.
+		if err := sub.Unsubscribe(context.Background(), newBlockQuery); err != nil {
+			log.Printf("cannot unsubscribe: %s", err)
+		}
+	}()
+
+	info, err := tmc.AbciInfo(ctx)
+	if err != nil {
+		return errors.Wrap(err, "info")
+	}
+	if err := s.syncTo(ctx, info.LastBlockHeight); err != nil {
+		return err
+	}
 
 	for {
-		nextHeight := syncedHeight + 1
-		if lastKnownHeight < nextHeight {
-			info, err := AbciInfo(tmc)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return errors.Wrap(ErrSubscription, "new block subscription closed")
+			}
+			height, err := NewBlockHeight(ev)
 			if err != nil {
-				return inserted, errors.Wrap(err, "info")
+				return errors.Wrap(err, "new block event")
+			}
+			// Events might have been dropped. Upload all blocks
+			// up to the announced one.
+			if err := s.syncTo(ctx, height); err != nil {
+				return err
 			}
+		}
+	}
+}
+
+// syncer holds the state of the synchronization process.
+type syncer struct {
+	tmc  TendermintRPC
+	st   *store.Store
+	hrp  string
+	conf syncConfig
+
+	inserted     uint
+	syncedHeight int64
+
+	// Keep the mapping for validator address to their numeric ID in memory
+	// to avoid querying the database for every insert.
+	validatorIDs *validatorsCache
+}
 
-			lastKnownHeight = info.LastBlockHeight
+func newSyncer(ctx context.Context, tmc TendermintRPC, st *store.Store, hrp string, conf syncConfig) (*syncer, error) {
+	s := &syncer{
+		tmc:          tmc,
+		st:           st,
+		hrp:          hrp,
+		conf:         conf,
+		validatorIDs: newValidatorsCache(st),
+	}
+
+	switch block, err := st.LatestBlock(ctx); {
+	case errors.ErrNotFound.Is(err):
+		s.syncedHeight = 0
+	case err == nil:
+		s.syncedHeight = block.Height
+	default:
+		return nil, errors.Wrap(err, "latest block")
+	}
+	return s, nil
+}
+
+// poll uploads all blocks that are not present yet and then checks for new
+// blocks periodically. It returns only on failure.
+func (s *syncer) poll(ctx context.Context) error {
+	for {
+		info, err := s.tmc.AbciInfo(ctx)
+		if err != nil {
+			return errors.Wrap(err, "info")
 		}
 
-		if lastKnownHeight < nextHeight {
+		if info.LastBlockHeight <= s.syncedHeight {
 			select {
 			case <-ctx.Done():
-				return inserted, ctx.Err()
+				return ctx.Err()
 			case <-time.After(syncRetryTimeout):
 			}
 			// make sure we don't run into the bug where we try to retrieve a commit for non-existent height
 			continue
 		}
 
-		c, err := Commit(ctx, tmc, nextHeight)
-		if err != nil {
-			// BUG this can happen when the commit does not exist.
-			// There is no sane way to distinguish this case from
-			// any other tendermint API error.
-			return inserted, errors.Wrapf(err, "blocks for %d", syncedHeight+1)
+		if err := s.syncTo(ctx, info.LastBlockHeight); err != nil {
+			return err
 		}
-		syncedHeight = c.Height
+	}
+}
 
-		propID, err := validatorIDs.DatabaseID(ctx, c.ProposerAddress, c.Height)
-		if err != nil {
-			return inserted, errors.Wrap(err, "validator ID")
-		}
+// syncTo uploads all blocks that are not present yet, up to and including
+// given height.
+//
+// Heights are fetched in batches by several workers, ahead of the block that
+// is inserted. Blocks are inserted strictly in height order, so that the
+// latest block in the store is always the last synchronized one. Fetching
+// is paused when the writer falls behind.
+func (s *syncer) syncTo(ctx context.Context, height int64) error {
+	if s.syncedHeight >= height {
+		return nil
+	}
 
-		participantIDs, err := validatorIDs.DatabaseIDs(ctx, c.ParticipantAddresses, c.Height)
-		if err != nil {
-			return inserted, errors.Wrap(err, "validator ID")
-		}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	// pending holds results of batches in height order. Its capacity
+	// limits how far ahead of the writer fetching can get.
+	pending := make(chan chan fetchResult, s.conf.workers)
+	// workers limits the number of concurrent fetches.
+	workers := make(chan struct{}, s.conf.workers)
+
+	// Writer is updating syncedHeight, so it must not be read by the
+	// fetching goroutine.
+	start := s.syncedHeight + 1
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+
+		for from := start; from <= height; from += int64(s.conf.batchSize) {
+			to := from + int64(s.conf.batchSize) - 1
+			if to > height {
+				to = height
+			}
+
+			// Buffered, so that the worker never blocks, even if
+			// the result is no longer expected.
+			resc := make(chan fetchResult, 1)
+			select {
+			case pending <- resc:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
 
-		// only query when validator hash changes
-		if !bytes.Equal(c.ValidatorsHash, vHash) {
-			var err error
-			vSet, err = Validators(ctx, tmc, c.Height)
+			wg.Add(1)
+			go func(from, to int64) {
+				defer wg.Done()
+				defer func() { <-workers }()
+
+				heights, err := s.tmc.FetchHeights(ctx, from, to)
+				if err != nil {
+					// BUG this can happen when the commit does not exist.
+					// There is no sane way to distinguish this case from
+					// any other tendermint API error.
+					err = errors.Wrapf(err, "blocks for %d-%d", from, to)
+				}
+				resc <- fetchResult{heights: heights, err: err}
+			}(from, to)
+		}
+	}()
+
+	for resc := range pending {
+		var res fetchResult
+		select {
+		case res = <-resc:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+		blocks := make([]*pendingBlock, 0, len(res.heights))
+		for _, h := range res.heights {
+			b, err := s.prepareBlock(ctx, h)
 			if err != nil {
-				return inserted, errors.Wrap(err, "cannot get validator set")
+				return err
 			}
-			vHash = c.ValidatorsHash
+			blocks = append(blocks, b)
+		}
+		if err := s.insert(ctx, blocks); err != nil {
+			return err
 		}
+	}
+	return ctx.Err()
+}
 
-		missing := SubtractSets(ValidatorAddresses(vSet), c.ParticipantAddresses)
-		missingIDs, err := validatorIDs.DatabaseIDs(ctx, missing, c.Height)
-		if err != nil {
-			return inserted, errors.Wrap(err, "validator ID")
+// pendingBlock is a block that is ready to be inserted, together with all
+// messages that must be handled.
+type pendingBlock struct {
+	block models.Block
+	msgs  []*pendingMsg
+}
+
+// pendingMsg is a message together with the transaction it was sent with.
+type pendingMsg struct {
+	msg     weave.Msg
+	txHash  string
+	signers []weave.Address
+	fee     *models.Fee
+	// result is the data returned by delivering the transaction, or nil
+	// if not known.
+	result []byte
+	// failed is true if delivering the transaction failed.
+	failed bool
+	// unknown is true if the result of delivering the transaction is not
+	// known.
+	unknown bool
+}
+
+// insert writes all given blocks within a single database transaction.
+func (s *syncer) insert(ctx context.Context, blocks []*pendingBlock) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	err := s.st.InTx(ctx, func(tx *store.Tx) error {
+		for _, b := range blocks {
+			if err := tx.InsertBlock(ctx, b.block); err != nil {
+				return errors.Wrapf(err, "insert block %d", b.block.Height)
+			}
+			if err := handleBlock(ctx, s.conf.handlers, s.hrp, tx, b); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.syncedHeight = blocks[len(blocks)-1].block.Height
+	s.inserted += uint(len(blocks))
+	return nil
+}
 
-		tmblock, err := FetchBlock(ctx, tmc, nextHeight)
-		if err != nil {
-			return inserted, errors.Wrapf(err, "blocks for %d", syncedHeight+1)
+// handleBlock calls handlers for all messages of the block.
+func handleBlock(ctx context.Context, handlers *Handlers, hrp string, tx *store.Tx, b *pendingBlock) error {
+	for _, m := range b.msgs {
+		mc := &MsgContext{
+			Height:        b.block.Height,
+			Time:          b.block.Time,
+			TxHash:        m.txHash,
+			Signers:       m.signers,
+			Fee:           m.fee,
+			Result:        m.result,
+			Failed:        m.failed,
+			ResultUnknown: m.unknown,
+			Hrp:           hrp,
+			Tx:            tx,
 		}
+		if err := handlers.HandleTx(ctx, mc, m.msg); err != nil {
+			return errors.Wrapf(err, "block %d, transaction %s", b.block.Height, m.txHash)
+		}
+	}
+	return nil
+}
 
-		var feeFrac uint64
-		messages := make([]string, 0) // Avoid nil array
-		transactions := make([]models.Transaction, 0, len(tmblock.Transactions))
-		for k, tx := range tmblock.Transactions {
-			if info := tx.GetFees(); info != nil {
-				if info.Fees.Ticker != "IOV" {
-					panic("fees in currency other than IOV are not supported")
-				}
-				feeFrac += uint64(info.Fees.GetWhole()*coin.FracUnit + info.Fees.GetFractional())
-			}
+// fetchResult is the result of fetching a batch of heights.
+type fetchResult struct {
+	heights []*TendermintHeight
+	err     error
+}
 
-			// The batch message is not split to expose each
-			// message separaterly. This would be a nice feature.
-			// Similar with getting details of the proposal.
-			msg, err := tx.GetMsg()
-			if err != nil {
-				return inserted, errors.Wrap(err, "cannot get transaction message")
-			}
-			switch message := msg.(type) {
-			case *account.RegisterAccountMsg:
-				if err := st.InsertAccount(ctx, message); err != nil {
-					return inserted, errors.Wrapf(err, "insert account message %d", c.Height)
+// prepareBlock returns the block of given height, ready to be inserted.
+func (s *syncer) prepareBlock(ctx context.Context, h *TendermintHeight) (*pendingBlock, error) {
+	c, tmblock := h.Commit, h.Block
 
-				}
-			case *account.ReplaceAccountTargetsMsg:
+	propID, err := s.validatorIDs.DatabaseID(ctx, c.ProposerAddress, h)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
 
-			}
-			messages = append(messages, msg.Path())
-			msgDetails, err := messageDetails(msg, hrp, tx.Multisig)
-			if err != nil {
-				return inserted, errors.Wrap(err, "cannot get transaction message detail")
-			}
+	participantIDs, err := s.validatorIDs.DatabaseIDs(ctx, c.ParticipantAddresses, h)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
+
+	missing := SubtractSets(ValidatorAddresses(h.Validators), c.ParticipantAddresses)
+	missingIDs, err := s.validatorIDs.DatabaseIDs(ctx, missing, h)
+	if err != nil {
+		return nil, errors.Wrap(err, "validator ID")
+	}
+
+	processed, err := processTransactions(tmblock, s.conf.decoder, s.hrp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "block %d", c.Height)
+	}
 
+	return &pendingBlock{
+		block: models.Block{
+			Height:          c.Height,
+			Hash:            hex.EncodeToString(c.Hash),
+			Time:            c.Time.UTC(),
+			ProposerID:      propID,
+			ParticipantIDs:  participantIDs,
+			MissingIDs:      missingIDs,
+			Messages:        processed.messages,
+			Fees:            processed.fees,
+			Transactions:    processed.transactions,
+			Header:          c.RawHeader,
+			Commit:          c.RawCommit,
+			Results:         tmblock.RawResults,
+			RawTransactions: tmblock.RawTransactions,
+		},
+		msgs: processed.msgs,
+	}, nil
+}
+
+// processedTransactions is the data derived from all transactions of a
+// block.
+type processedTransactions struct {
+	transactions []models.Transaction
+	// messages are paths of all transaction messages.
+	messages []string
+	// fees are the fee totals of the block.
+	fees []models.Fee
+	msgs []*pendingMsg
+}
+
+// processTransactions returns the data of all block transactions, ready to
+// be stored. A transaction that cannot be decoded or processed does not stop
+// the synchronization. It is stored with its raw data and the decode error
+// instead, so that it can be reprocessed once the decoder is updated.
+//
+// Transactions that failed to deliver, or which result is not known, are
+// marked as such, so that only transaction handlers are called for them.
+func processTransactions(b *TendermintBlock, dec TxDecoder, hrp string) (*processedTransactions, error) {
+	var (
+		fees []*models.Fee
+		msgs []*pendingMsg
+	)
+	messages := make([]string, 0) // Avoid nil array
+	transactions := make([]models.Transaction, 0, len(b.RawTransactions))
+	for k, raw := range b.RawTransactions {
+		txHash := hex.EncodeToString(b.TransactionHashes[k][:])
+
+		var (
+			transaction *models.Transaction
+			m           *pendingMsg
+		)
+		decoded, err := dec.Decode(raw)
+		if err == nil && decoded == nil {
+			// Decoder does not support transactions.
+			transactions = append(transactions, models.Transaction{Hash: txHash})
+			continue
+		}
+		if err == nil {
+			transaction, m, err = processTransaction(decoded, txHash, hrp)
+		}
+		if err != nil {
+			log.Printf("block %d: cannot decode transaction %s: %s", b.Height, txHash, err)
 			transactions = append(transactions, models.Transaction{
-				Hash:    hex.EncodeToString(tmblock.TransactionHashes[k][:]),
-				Message: json.RawMessage(msgDetails),
+				Hash:        txHash,
+				DecodeError: err.Error(),
+				Raw:         raw,
 			})
+			continue
 		}
 
-		block := models.Block{
-			Height:         c.Height,
-			Hash:           hex.EncodeToString(c.Hash),
-			Time:           c.Time.UTC(),
-			ProposerID:     propID,
-			ParticipantIDs: participantIDs,
-			MissingIDs:     missingIDs,
-			Messages:       messages,
-			FeeFrac:        feeFrac,
-			Transactions:   transactions,
+		transactions = append(transactions, *transaction)
+		messages = append(messages, m.msg.Path())
+		if res := b.result(k); res != nil {
+			m.result = res.Data
+			m.failed = res.Code != 0
+		} else {
+			m.unknown = true
 		}
-		if err := st.InsertBlock(ctx, block); err != nil {
-			return inserted, errors.Wrapf(err, "insert block %d", c.Height)
+		msgs = append(msgs, m)
+		if transaction.Fee != nil {
+			fees = append(fees, transaction.Fee)
 		}
-		inserted++
 	}
-}
 
-func messageDetails(msg weave.Msg, hrp string, multisigs [][]byte) (string, error) {
-	var multisigstr []string
-	for _, m := range multisigs {
-		multisigstr = append(multisigstr, hex.EncodeToString(m))
+	totals, err := sumFees(fees)
+	if err != nil {
+		return nil, errors.Wrap(err, "fees")
 	}
+	return &processedTransactions{
+		transactions: transactions,
+		messages:     messages,
+		fees:         totals,
+		msgs:         msgs,
+	}, nil
+}
 
-	switch message := msg.(type) {
-	case batch.Msg:
-		list, err := message.MsgList()
+// processTransaction returns the data of a single decoded transaction.
+func processTransaction(tx *DecodedTx, txHash, hrp string) (*models.Transaction, *pendingMsg, error) {
+	var signerAddrs []string
+	for _, addr := range tx.Signers {
+		bech, err := addr.Bech32String(hrp)
 		if err != nil {
-			return "", err
+			return nil, nil, errors.Wrap(err, "signer")
 		}
+		signerAddrs = append(signerAddrs, bech)
+	}
 
-		messages := make([]models.Message, len(list))
+	fee, err := txFee(tx.Fees, tx.Signers, hrp)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "fee")
+	}
 
-		for k, v := range list {
-			details, err := json.Marshal(v)
-			if err != nil {
-				return "", err
-			}
-			messages[k] = models.Message{
-				Path:      v.Path(),
-				Details:   json.RawMessage(details),
-				Multisigs: multisigstr,
-			}
-		}
+	txMessages, err := splitMessages(tx.Msg, hrp, tx.Multisig)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot get transaction messages")
+	}
+	msgDetails, err := messageDetails(tx.Msg, txMessages)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot get transaction message detail")
+	}
 
-		res, err := json.Marshal(messages)
-		return string(res), err
-	case *cash.SendMsg:
-		source, err := message.Source.Bech32String(hrp)
-		if err != nil {
-			return "", nil
+	transaction := &models.Transaction{
+		Hash:      txHash,
+		Message:   json.RawMessage(msgDetails),
+		Fee:       fee,
+		Signers:   signerAddrs,
+		Messages:  txMessages,
+		Multisigs: tx.Multisig,
+	}
+	return transaction, &pendingMsg{msg: tx.Msg, txHash: txHash, signers: tx.Signers, fee: fee}, nil
+}
+
+// txFee returns the fee paid for a transaction or nil if no fee was paid.
+// Same as weave does, the main signer is charged if the payer is not set.
+func txFee(info *cash.FeeInfo, signers []weave.Address, hrp string) (*models.Fee, error) {
+	if info == nil || info.Fees == nil || info.Fees.IsZero() {
+		return nil, nil
+	}
+	payer := info.Payer
+	if len(payer) == 0 {
+		if len(signers) == 0 {
+			return nil, errors.Wrap(errors.ErrEmpty, "no fee payer")
 		}
-		dest, err := message.Destination.Bech32String(hrp)
+		payer = signers[0]
+	}
+	addr, err := payer.Bech32String(hrp)
+	if err != nil {
+		return nil, errors.Wrap(err, "payer address")
+	}
+	return &models.Fee{
+		Payer:      addr,
+		Ticker:     info.Fees.Ticker,
+		Whole:      info.Fees.Whole,
+		Fractional: info.Fees.Fractional,
+	}, nil
+}
+
+// sumFees returns totals of given fees, one per ticker, sorted by ticker.
+func sumFees(fees []*models.Fee) ([]models.Fee, error) {
+	totals := make(map[string]coin.Coin)
+	for _, f := range fees {
+		total, err := totals[f.Ticker].Add(coin.NewCoin(f.Whole, f.Fractional, f.Ticker))
 		if err != nil {
-			return "", nil
+			return nil, errors.Wrapf(err, "%s total", f.Ticker)
 		}
-		msg := models.CashSendMsgAdapter{
-			Source:      source,
-			Destination: dest,
-			Amount:      message.Amount,
-			Memo:        message.Memo,
-		}
-		details, err := json.Marshal(msg)
-		if err != nil {
-			return "", err
+		totals[f.Ticker] = total
+	}
+
+	var res []models.Fee
+	for ticker, total := range totals {
+		res = append(res, models.Fee{
+			Ticker:     ticker,
+			Whole:      total.Whole,
+			Fractional: total.Fractional,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Ticker < res[j].Ticker })
+	return res, nil
+}
+
+// splitMessages returns all messages of a transaction. A batch message is
+// split into the messages it contains.
+func splitMessages(msg weave.Msg, hrp string, multisigs [][]byte) ([]models.Message, error) {
+	var multisigstr []string
+	for _, m := range multisigs {
+		multisigstr = append(multisigstr, hex.EncodeToString(m))
+	}
+
+	list := []weave.Msg{msg}
+	if b, ok := msg.(batch.Msg); ok {
+		var err error
+		if list, err = b.MsgList(); err != nil {
+			return nil, errors.Wrap(err, "batch messages")
 		}
+	}
 
-		res, err := json.Marshal(
-			models.Message{
-				Path:      message.Path(),
-				Details:   json.RawMessage(details),
-				Multisigs: multisigstr,
-			})
-		return string(res), err
-	default:
-		details, err := json.Marshal(message)
+	messages := make([]models.Message, len(list))
+	for k, m := range list {
+		details, err := adaptMessage(m, hrp)
 		if err != nil {
-			return "", err
+			return nil, errors.Wrapf(err, "message %d: %s", k, m.Path())
+		}
+		messages[k] = models.Message{
+			Path:      m.Path(),
+			Details:   details,
+			Multisigs: multisigstr,
 		}
+	}
+	return messages, nil
+}
 
-		res, err := json.Marshal(
-			models.Message{
-				Path:      message.Path(),
-				Details:   json.RawMessage(details),
-				Multisigs: multisigstr,
-			})
+// messageDetails returns the representation of a transaction message, that
+// is stored with the transaction. A batch is represented as an array of all
+// messages it contains.
+func messageDetails(msg weave.Msg, messages []models.Message) (string, error) {
+	if _, ok := msg.(batch.Msg); ok {
+		res, err := json.Marshal(messages)
 		return string(res), err
 	}
+	res, err := json.Marshal(messages[0])
+	return string(res), err
 }
 
 // validatorsCache maintain a cache for the mapping of validator address to
 // that validator database ID.
 type validatorsCache struct {
 	cache map[string]int64
-	tmc   *TendermintClient
 	st    *store.Store
 }
 
-func newValidatorsCache(tmc *TendermintClient, st *store.Store) *validatorsCache {
+func newValidatorsCache(st *store.Store) *validatorsCache {
 	return &validatorsCache{
 		cache: make(map[string]int64),
-		tmc:   tmc,
 		st:    st,
 	}
 }
 
 // DatabaseIDs is a helper of DatabaseID to query a whole set at once
-func (vc *validatorsCache) DatabaseIDs(ctx context.Context, addresses [][]byte, blockHeight int64) ([]int64, error) {
+func (vc *validatorsCache) DatabaseIDs(ctx context.Context, addresses [][]byte, h *TendermintHeight) ([]int64, error) {
 	res := make([]int64, len(addresses))
 	for i, addr := range addresses {
-		id, err := vc.DatabaseID(ctx, addr, blockHeight)
+		id, err := vc.DatabaseID(ctx, addr, h)
 		if err != nil {
 			return nil, err
 		}
@@ -265,9 +686,9 @@ func (vc *validatorsCache) DatabaseIDs(ctx context.Context, addresses [][]byte,
 }
 
 // DatabaseID will return an ID of a validator with given address. If not
-// present in the database it will query tendermint for the information,
-// register that validator in the database and return its ID.
-func (vc *validatorsCache) DatabaseID(ctx context.Context, address []byte, blockHeight int64) (int64, error) {
+// present in the database it will look it up in the validator set of given
+// height, register that validator in the database and return its ID.
+func (vc *validatorsCache) DatabaseID(ctx context.Context, address []byte, h *TendermintHeight) (int64, error) {
 	id, ok := vc.cache[string(address)]
 	if ok {
 		return id, nil
@@ -287,12 +708,7 @@ func (vc *validatorsCache) DatabaseID(ctx context.Context, address []byte, block
 		return 0, errors.Wrap(err, "query validator ID")
 	}
 
-	vs, err := Validators(ctx, vc.tmc, blockHeight)
-	if err != nil {
-		return 0, errors.Wrap(err, "fetch validators")
-	}
-
-	for _, v := range vs {
+	for _, v := range h.Validators {
 		if !bytes.Equal(v.Address, address) {
 			continue
 		}
@@ -304,11 +720,5 @@ func (vc *validatorsCache) DatabaseID(ctx context.Context, address []byte, block
 		vc.cache[string(address)] = id
 		return id, nil
 	}
-	return 0, errors.Wrapf(errors.ErrNotFound, "validator %x not present at height %d", address, blockHeight)
-}
-
-// StreamSync is expected to work similar to Sync but to use websocket and
-// never quit unless context was cancelled.
-func StreamSync(ctx context.Context) error {
-	return ErrNotImplemented
+	return 0, errors.Wrapf(errors.ErrNotFound, "validator %x not present at height %d", address, h.Commit.Height)
 }
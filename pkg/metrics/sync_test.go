@@ -0,0 +1,506 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/block-metrics/pkg/store"
+	"github.com/iov-one/weave"
+	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/errors"
+	"github.com/iov-one/weave/weavetest"
+	"github.com/iov-one/weave/x/cash"
+)
+
+// fakeRPC is a TendermintRPC implementation that serves a chain where every
+// block is signed by all validators.
+type fakeRPC struct {
+	height     int64
+	validators []*TendermintValidator
+	// txs are raw transactions of blocks, by height.
+	txs map[int64][][]byte
+}
+
+func (f *fakeRPC) AbciInfo(ctx context.Context) (*ABCIInfo, error) {
+	return &ABCIInfo{LastBlockHeight: f.height}, nil
+}
+
+func (f *fakeRPC) Commit(ctx context.Context, height int64) (*TendermintCommit, error) {
+	if height > f.height {
+		return nil, errors.Wrapf(errors.ErrNotFound, "height %d", height)
+	}
+	return &TendermintCommit{
+		Height:               height,
+		Hash:                 []byte{byte(height)},
+		Time:                 time.Unix(height, 0).UTC(),
+		ProposerAddress:      f.validators[0].Address,
+		ValidatorsHash:       []byte("validators"),
+		ParticipantAddresses: ValidatorAddresses(f.validators),
+		RawHeader:            json.RawMessage(`{}`),
+		RawCommit:            json.RawMessage(`{}`),
+	}, nil
+}
+
+// FetchBlock returns the block at given height. All its transactions were
+// delivered successfully.
+func (f *fakeRPC) FetchBlock(ctx context.Context, height int64) (*TendermintBlock, error) {
+	b := NewTendermintBlock(height, time.Unix(height, 0), f.txs[height])
+	b.Results = make([]TxResult, len(b.RawTransactions))
+	raw, err := json.Marshal(map[string]interface{}{
+		"results": map[string]interface{}{"deliver_tx": make([]struct{}, len(b.RawTransactions))},
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.RawResults = raw
+	return b, nil
+}
+
+func (f *fakeRPC) FetchHeights(ctx context.Context, fromHeight, toHeight int64) ([]*TendermintHeight, error) {
+	var heights []*TendermintHeight
+	for h := fromHeight; h <= toHeight; h++ {
+		c, err := f.Commit(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		b, err := f.FetchBlock(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		heights = append(heights, &TendermintHeight{Commit: c, Block: b, Validators: f.validators})
+	}
+	return heights, nil
+}
+
+func (f *fakeRPC) Validators(ctx context.Context, height int64) ([]*TendermintValidator, error) {
+	return f.validators, nil
+}
+
+func TestSyncTo(t *testing.T) {
+	db, cleanup := store.EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	st := store.NewStore(db)
+	rpc := &fakeRPC{
+		height: 5,
+		validators: []*TendermintValidator{
+			{Address: []byte{0x01}, PubKey: []byte{0x01, 0x01}},
+			{Address: []byte{0x02}, PubKey: []byte{0x02, 0x02}},
+		},
+	}
+
+	s, err := newSyncer(ctx, rpc, st, "tiov", newSyncConfig(nil))
+	if err != nil {
+		t.Fatalf("cannot create syncer: %s", err)
+	}
+	if err := s.syncTo(ctx, rpc.height); err != nil {
+		t.Fatalf("cannot sync: %s", err)
+	}
+	if s.inserted != 5 {
+		t.Fatalf("want 5 blocks inserted, got %d", s.inserted)
+	}
+
+	latest, err := st.LatestBlock(ctx)
+	if err != nil {
+		t.Fatalf("cannot get latest block: %s", err)
+	}
+	if latest.Height != 5 {
+		t.Fatalf("want latest block 5, got %d", latest.Height)
+	}
+	if len(latest.ParticipantIDs) != 2 || len(latest.MissingIDs) != 0 {
+		t.Fatalf("unexpected participants: %v, missing: %v", latest.ParticipantIDs, latest.MissingIDs)
+	}
+
+	// Syncing again must continue from the last stored block.
+	rpc.height = 7
+	s, err = newSyncer(ctx, rpc, st, "tiov", newSyncConfig(nil))
+	if err != nil {
+		t.Fatalf("cannot create syncer: %s", err)
+	}
+	if err := s.syncTo(ctx, rpc.height); err != nil {
+		t.Fatalf("cannot sync: %s", err)
+	}
+	if s.inserted != 2 {
+		t.Fatalf("want 2 blocks inserted, got %d", s.inserted)
+	}
+
+	// Many small batches fetched concurrently must be inserted in order.
+	rpc.height = 30
+	conf := newSyncConfig([]SyncOption{WithFetchWorkers(3), WithBatchSize(2)})
+	s, err = newSyncer(ctx, rpc, st, "tiov", conf)
+	if err != nil {
+		t.Fatalf("cannot create syncer: %s", err)
+	}
+	if err := s.syncTo(ctx, rpc.height); err != nil {
+		t.Fatalf("cannot sync: %s", err)
+	}
+	if s.inserted != 23 {
+		t.Fatalf("want 23 blocks inserted, got %d", s.inserted)
+	}
+	for h := int64(1); h <= rpc.height; h++ {
+		if _, err := st.LoadBlock(ctx, h); err != nil {
+			t.Fatalf("cannot load block %d: %s", h, err)
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	db, cleanup := store.EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	st := store.NewStore(db)
+
+	send := &bnsd.Tx{
+		Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+			Metadata:    &weave.Metadata{Schema: 1},
+			Source:      weavetest.NewCondition().Address(),
+			Destination: weavetest.NewCondition().Address(),
+			Amount:      coin.NewCoinp(1, 0, "IOV"),
+			Memo:        "reindexed",
+		}},
+	}
+	raw, err := send.Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal transaction: %s", err)
+	}
+	rpc := &fakeRPC{
+		height: 3,
+		validators: []*TendermintValidator{
+			{Address: []byte{0x01}, PubKey: []byte{0x01, 0x01}},
+		},
+		txs: map[int64][][]byte{2: {raw}},
+	}
+
+	var handled int
+	handlers := NewHandlers()
+	handlers.RegisterMsg("count", &cash.SendMsg{}, func(context.Context, *MsgContext, weave.Msg) error {
+		handled++
+		return nil
+	})
+
+	s, err := newSyncer(ctx, rpc, st, "tiov", newSyncConfig([]SyncOption{WithHandlers(handlers)}))
+	if err != nil {
+		t.Fatalf("cannot create syncer: %s", err)
+	}
+	if err := s.syncTo(ctx, rpc.height); err != nil {
+		t.Fatalf("cannot sync: %s", err)
+	}
+	if handled != 1 {
+		t.Fatalf("want message handled once, got %d", handled)
+	}
+
+	if _, err := Reindex(ctx, st, "tiov", 1, 2, WithHandlers(handlers)); !errors.ErrInput.Is(err) {
+		t.Fatalf("want range before the last block rejected, got %v", err)
+	}
+	n, err := Reindex(ctx, st, "tiov", 1, 0, WithHandlers(handlers), WithBatchSize(2))
+	if err != nil {
+		t.Fatalf("cannot reindex: %s", err)
+	}
+	if n != 3 {
+		t.Fatalf("want 3 blocks reindexed, got %d", n)
+	}
+	if handled != 2 {
+		t.Fatalf("want message handled again, got %d", handled)
+	}
+	if txs, err := st.LoadTxsByMemo(ctx, "reindexed"); err != nil || len(txs) != 1 {
+		t.Fatalf("want reindexed transaction, got %v, %v", txs, err)
+	}
+}
+
+func TestReindexAccounts(t *testing.T) {
+	db, cleanup := store.EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	st := store.NewStore(db)
+	if err := st.InitAccountConfiguration(ctx, 0, models.AccountConfiguration{DomainRenew: time.Hour}); err != nil {
+		t.Fatalf("cannot init configuration: %s", err)
+	}
+
+	admin := weavetest.NewCondition().Address()
+	msgs := map[int64][]bnsd.Tx{
+		1: {
+			{Sum: &bnsd.Tx_AccountRegisterDomainMsg{AccountRegisterDomainMsg: &account.RegisterDomainMsg{
+				Metadata:     &weave.Metadata{Schema: 1},
+				Domain:       "wonderland",
+				Admin:        admin,
+				AccountRenew: weave.AsUnixDuration(time.Hour),
+			}}},
+			{Sum: &bnsd.Tx_AccountRegisterAccountMsg{AccountRegisterAccountMsg: &account.RegisterAccountMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Domain:   "wonderland",
+				Name:     "alice",
+				Owner:    admin,
+			}}},
+		},
+		2: {
+			{Sum: &bnsd.Tx_AccountRenewDomainMsg{AccountRenewDomainMsg: &account.RenewDomainMsg{
+				Metadata: &weave.Metadata{Schema: 1},
+				Domain:   "wonderland",
+			}}},
+			{Sum: &bnsd.Tx_AccountAddAccountCertificateMsg{AccountAddAccountCertificateMsg: &account.AddAccountCertificateMsg{
+				Metadata:    &weave.Metadata{Schema: 1},
+				Domain:      "wonderland",
+				Name:        "alice",
+				Certificate: []byte("cert"),
+			}}},
+		},
+	}
+	rpc := &fakeRPC{
+		height: 2,
+		validators: []*TendermintValidator{
+			{Address: []byte{0x01}, PubKey: []byte{0x01, 0x01}},
+		},
+		txs: make(map[int64][][]byte),
+	}
+	for height, txs := range msgs {
+		for _, tx := range txs {
+			raw, err := tx.Marshal()
+			if err != nil {
+				t.Fatalf("cannot marshal transaction: %s", err)
+			}
+			rpc.txs[height] = append(rpc.txs[height], raw)
+		}
+	}
+
+	handlers := NewHandlers()
+	registerAccountHandlers(handlers)
+	s, err := newSyncer(ctx, rpc, st, "tiov", newSyncConfig([]SyncOption{WithHandlers(handlers)}))
+	if err != nil {
+		t.Fatalf("cannot create syncer: %s", err)
+	}
+	if err := s.syncTo(ctx, rpc.height); err != nil {
+		t.Fatalf("cannot sync: %s", err)
+	}
+
+	type state struct {
+		Domain   *models.Domain
+		Account  *models.Account
+		Renewals []models.Renewal
+		History  []models.AccountVersion
+	}
+	load := func() state {
+		t.Helper()
+		var (
+			s   state
+			err error
+		)
+		if s.Domain, err = st.LoadDomain(ctx, "wonderland"); err != nil {
+			t.Fatalf("cannot load domain: %s", err)
+		}
+		if s.Account, err = st.LoadAccount(ctx, "alice", "wonderland"); err != nil {
+			t.Fatalf("cannot load account: %s", err)
+		}
+		if s.Renewals, err = st.DomainRenewals(ctx, "wonderland"); err != nil {
+			t.Fatalf("cannot load renewals: %s", err)
+		}
+		if s.History, err = st.AccountHistory(ctx, "wonderland", "alice"); err != nil {
+			t.Fatalf("cannot load history: %s", err)
+		}
+		// Rows restored from history get new IDs.
+		s.Domain.ID, s.Account.ID = 0, 0
+		return s
+	}
+
+	want := load()
+	if want.Domain.ValidUntil == nil || !want.Domain.ValidUntil.Equal(time.Unix(1, 0).Add(2*time.Hour)) {
+		t.Fatalf("unexpected domain expiration: %v", want.Domain.ValidUntil)
+	}
+	if len(want.Account.Certificates) != 1 {
+		t.Fatalf("want one certificate, got %d", len(want.Account.Certificates))
+	}
+
+	// Reindexing must not apply the renewal or the certificate again,
+	// regardless of where it starts.
+	for _, from := range []int64{2, 1} {
+		if _, err := Reindex(ctx, st, "tiov", from, 0, WithHandlers(handlers)); err != nil {
+			t.Fatalf("cannot reindex from %d: %s", from, err)
+		}
+		if got := load(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("reindexing from %d changed the state\nwant %+v\n got %+v", from, want, got)
+		}
+	}
+}
+
+func TestProcessUndecodableTransactions(t *testing.T) {
+	send := &bnsd.Tx{
+		Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+			Metadata:    &weave.Metadata{Schema: 1},
+			Source:      weavetest.NewCondition().Address(),
+			Destination: weavetest.NewCondition().Address(),
+			Amount:      coin.NewCoinp(1, 0, "IOV"),
+		}},
+	}
+	valid, err := send.Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal transaction: %s", err)
+	}
+	// A transaction without a message is what an unknown message type
+	// is decoded to.
+	unknown, err := (&bnsd.Tx{}).Marshal()
+	if err != nil {
+		t.Fatalf("cannot marshal transaction: %s", err)
+	}
+	garbage := []byte{0xff, 0xff, 0xff}
+
+	b := NewTendermintBlock(1, time.Now(), [][]byte{garbage, valid, unknown})
+	processed, err := processTransactions(b, BnsdDecoder, "tiov")
+	if err != nil {
+		t.Fatalf("cannot process transactions: %s", err)
+	}
+	if len(processed.transactions) != 3 {
+		t.Fatalf("want all 3 transactions, got %d", len(processed.transactions))
+	}
+	for i, raw := range [][]byte{garbage, nil, unknown} {
+		tx := processed.transactions[i]
+		if (tx.DecodeError != "") != (raw != nil) || !reflect.DeepEqual(tx.Raw, raw) {
+			t.Fatalf("unexpected transaction %d: %+v", i, tx)
+		}
+	}
+	if len(processed.msgs) != 1 || !reflect.DeepEqual(processed.messages, []string{"cash/send"}) {
+		t.Fatalf("want only the valid message, got %v", processed.messages)
+	}
+}
+
+func TestProcessFailedTransactions(t *testing.T) {
+	var raws [][]byte
+	for i := 0; i < 3; i++ {
+		send := &bnsd.Tx{
+			Sum: &bnsd.Tx_CashSendMsg{CashSendMsg: &cash.SendMsg{
+				Metadata:    &weave.Metadata{Schema: 1},
+				Source:      weavetest.NewCondition().Address(),
+				Destination: weavetest.NewCondition().Address(),
+				Amount:      coin.NewCoinp(int64(i+1), 0, "IOV"),
+			}},
+		}
+		raw, err := send.Marshal()
+		if err != nil {
+			t.Fatalf("cannot marshal transaction: %s", err)
+		}
+		raws = append(raws, raw)
+	}
+
+	b := NewTendermintBlock(1, time.Now(), raws)
+	// The last transaction result is not known.
+	b.Results = []TxResult{{Data: []byte("ok")}, {Code: 6, Log: "failed"}}
+	processed, err := processTransactions(b, BnsdDecoder, "tiov")
+	if err != nil {
+		t.Fatalf("cannot process transactions: %s", err)
+	}
+	if len(processed.transactions) != 3 {
+		t.Fatalf("want all 3 transactions, got %d", len(processed.transactions))
+	}
+	if len(processed.msgs) != 3 {
+		t.Fatalf("want messages of 3 transactions, got %d", len(processed.msgs))
+	}
+	if string(processed.msgs[0].result) != "ok" || processed.msgs[2].result != nil {
+		t.Fatalf("unexpected results: %q, %q", processed.msgs[0].result, processed.msgs[2].result)
+	}
+	for i, want := range []bool{false, true, false} {
+		if processed.msgs[i].failed != want {
+			t.Fatalf("message %d: want failed %t", i, want)
+		}
+		if unknown := i == 2; processed.msgs[i].unknown != unknown {
+			t.Fatalf("message %d: want unknown result %t", i, unknown)
+		}
+	}
+}
+
+func TestReprocessBlockWithoutRawData(t *testing.T) {
+	_, err := reprocessBlock(&models.Block{Height: 1}, BnsdDecoder, "tiov")
+	if !errors.ErrState.Is(err) {
+		t.Fatalf("want state error, got %v", err)
+	}
+}
+
+func TestFees(t *testing.T) {
+	signer := weavetest.NewCondition().Address()
+	payer := weavetest.NewCondition().Address()
+
+	fee, err := txFee(&cash.FeeInfo{Fees: coin.NewCoinp(1, 5, "ETH")}, []weave.Address{signer}, "tiov")
+	if err != nil {
+		t.Fatalf("cannot get fee: %s", err)
+	}
+	if want, _ := signer.Bech32String("tiov"); fee.Payer != want {
+		t.Fatalf("main signer must pay the fee, got %q", fee.Payer)
+	}
+
+	other, err := txFee(&cash.FeeInfo{Payer: payer, Fees: coin.NewCoinp(0, 999999999, "ETH")}, []weave.Address{signer}, "tiov")
+	if err != nil {
+		t.Fatalf("cannot get fee: %s", err)
+	}
+	if want, _ := payer.Bech32String("tiov"); other.Payer != want {
+		t.Fatalf("payer must pay the fee, got %q", other.Payer)
+	}
+
+	if fee, err := txFee(&cash.FeeInfo{}, nil, "tiov"); err != nil || fee != nil {
+		t.Fatalf("want no fee, got %+v, %v", fee, err)
+	}
+
+	iov := &models.Fee{Ticker: "IOV", Whole: 2}
+	totals, err := sumFees([]*models.Fee{fee, iov, other})
+	if err != nil {
+		t.Fatalf("cannot sum fees: %s", err)
+	}
+	want := []models.Fee{
+		{Ticker: "ETH", Whole: 2, Fractional: 4},
+		{Ticker: "IOV", Whole: 2},
+	}
+	if !reflect.DeepEqual(totals, want) {
+		t.Fatalf("want %+v, got %+v", want, totals)
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	alice := weavetest.NewCondition().Address()
+	bob := weavetest.NewCondition().Address()
+	send := func(memo string) *cash.SendMsg {
+		return &cash.SendMsg{
+			Metadata:    &weave.Metadata{Schema: 1},
+			Source:      alice,
+			Destination: bob,
+			Amount:      coin.NewCoinp(1, 0, "IOV"),
+			Memo:        memo,
+		}
+	}
+	msg := &bnsd.ExecuteBatchMsg{
+		Messages: []bnsd.ExecuteBatchMsg_Union{
+			{Sum: &bnsd.ExecuteBatchMsg_Union_CashSendMsg{CashSendMsg: send("first")}},
+			{Sum: &bnsd.ExecuteBatchMsg_Union_CashSendMsg{CashSendMsg: send("second")}},
+		},
+	}
+
+	messages, err := splitMessages(msg, "tiov", nil)
+	if err != nil {
+		t.Fatalf("cannot split messages: %s", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("want 2 messages, got %d", len(messages))
+	}
+	source, _ := alice.Bech32String("tiov")
+	for i, memo := range []string{"first", "second"} {
+		var details models.CashSendMsgAdapter
+		if err := json.Unmarshal(messages[i].Details, &details); err != nil {
+			t.Fatalf("cannot unmarshal details: %s", err)
+		}
+		if messages[i].Path != "cash/send" || details.Memo != memo || details.Source != source {
+			t.Fatalf("unexpected message %d: %s %+v", i, messages[i].Path, details)
+		}
+	}
+
+	single, err := splitMessages(send("single"), "tiov", nil)
+	if err != nil {
+		t.Fatalf("cannot split messages: %s", err)
+	}
+	if len(single) != 1 {
+		t.Fatalf("want 1 message, got %d", len(single))
+	}
+}
@@ -4,121 +4,568 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 
-	bnsd "github.com/iov-one/weave/cmd/bnsd/app"
+	"github.com/iov-one/weave/app"
 	"github.com/iov-one/weave/errors"
 )
 
 type TendermintClient struct {
 	idCnt uint64
 
-	conn *websocket.Conn
+	url string
 
 	stop chan struct{}
 
-	mu   sync.Mutex
+	// Websocket connection does not support concurrent writers.
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// conn is nil while the client is disconnected.
+	conn *websocket.Conn
 	resp map[string]chan<- *jsonrpcResponse
+	// subs maps subscription correlation ID to the channel that events
+	// are delivered to.
+	subs map[string]chan json.RawMessage
+	// queries maps subscription query to its correlation ID.
+	queries map[string]string
+
+	conf clientConfig
+}
+
+// DefaultRequestTimeout is the default maximum duration of a single JSONRPC
+// call.
+const DefaultRequestTimeout = 30 * time.Second
+
+// clientConfig is the configuration shared by all client implementations.
+type clientConfig struct {
+	// timeout is the default deadline of each call. Zero means no
+	// timeout.
+	timeout time.Duration
+}
+
+func newClientConfig(opts []ClientOption) clientConfig {
+	conf := clientConfig{
+		timeout: DefaultRequestTimeout,
+	}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return conf
 }
 
+// ClientOption configures a client.
+type ClientOption func(*clientConfig)
+
+// WithRequestTimeout sets the default maximum duration of each call. Context
+// passed to DoContext can set a shorter deadline. Zero disables the default
+// timeout.
+func WithRequestTimeout(d time.Duration) ClientOption {
+	return func(c *clientConfig) {
+		c.timeout = d
+	}
+}
+
+const (
+	// pongWait is the time allowed to read the next message or pong from
+	// the server before the connection is considered dead.
+	pongWait = 60 * time.Second
+	// pingPeriod must be less than pongWait.
+	pingPeriod = pongWait * 9 / 10
+
+	// Reconnection delay is doubled after each failed attempt, within
+	// given limits.
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
 // DialTendermint returns a client that is maintains a websocket connection to
 // tendermint API. The websocket is used instead of standard HTTP connection to
 // lower the latency, bypass throttling and to allow subscription requests.
-func DialTendermint(websocketURL string) (*TendermintClient, error) {
+//
+// When the connection is lost, all pending calls fail with ErrDisconnected,
+// all subscriptions are cancelled and the client redials in the background.
+// Calls made while the client is disconnected fail with ErrDisconnected.
+func DialTendermint(websocketURL string, opts ...ClientOption) (*TendermintClient, error) {
 	c, _, err := websocket.DefaultDialer.Dial(websocketURL, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "dial")
 	}
 	cli := &TendermintClient{
-		conn: c,
-		stop: make(chan struct{}),
-		resp: make(map[string]chan<- *jsonrpcResponse),
+		url:     websocketURL,
+		conn:    c,
+		stop:    make(chan struct{}),
+		resp:    make(map[string]chan<- *jsonrpcResponse),
+		subs:    make(map[string]chan json.RawMessage),
+		queries: make(map[string]string),
+		conf:    newClientConfig(opts),
 	}
-	go cli.readLoop()
+	go cli.run(c)
 	return cli, nil
 }
 
 func (c *TendermintClient) Close() error {
 	close(c.stop)
-	return c.conn.Close()
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
 }
 
-func (c *TendermintClient) readLoop() {
+// run maintains the connection. It reads from the connection until it is
+// broken and then redials. It returns only when the client is closed.
+func (c *TendermintClient) run(conn *websocket.Conn) {
+	for {
+		done := make(chan struct{})
+		go c.pingLoop(conn, done)
+		err := c.readLoop(conn)
+		close(done)
+		_ = conn.Close()
+		c.disconnected(err)
+
+		if conn = c.redial(); conn == nil {
+			return
+		}
+
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+	}
+}
+
+// disconnected fails all pending calls and cancels all subscriptions.
+func (c *TendermintClient) disconnected(err error) {
+	select {
+	case <-c.stop:
+	default:
+		log.Printf("tendermint connection lost: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn = nil
+	for id, respc := range c.resp {
+		// nil response signals that the connection was lost.
+		respc <- nil
+		delete(c.resp, id)
+	}
+	for id := range c.subs {
+		c.dropSubscription(id)
+	}
+}
+
+// redial returns a new connection, retrying with an exponential backoff
+// until successful. It returns nil if the client was closed.
+func (c *TendermintClient) redial() *websocket.Conn {
+	backoff := minReconnectBackoff
 	for {
 		select {
 		case <-c.stop:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+		if err == nil {
+			log.Printf("tendermint connection restored")
+			return conn
+		}
+		log.Printf("cannot reconnect, retrying in %s: %s", backoff, err)
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// pingLoop periodically pings the server so that a dead connection is
+// detected by the read loop, even if the server is not sending anything.
+func (c *TendermintClient) pingLoop(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
 			return
-		default:
+		case <-ticker.C:
+			// WriteControl is safe to use concurrently with other
+			// writes.
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingPeriod)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop consumes all messages from given connection. It returns only
+// when the connection is broken.
+func (c *TendermintClient) readLoop(conn *websocket.Conn) error {
+	extendDeadline := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+	conn.SetPongHandler(extendDeadline)
+
+	for {
+		if err := extendDeadline(""); err != nil {
+			return err
+		}
+
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return err
 		}
 
-		var resp jsonrpcResponse
-		if err := c.conn.ReadJSON(&resp); err != nil {
+		// Responses of a batch are delivered as a single array.
+		var resps []*jsonrpcResponse
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+			err = json.Unmarshal(raw, &resps)
+		} else {
+			var resp jsonrpcResponse
+			err = json.Unmarshal(raw, &resp)
+			resps = append(resps, &resp)
+		}
+		if err != nil {
+			// The message is malformed but the connection is
+			// still usable.
 			log.Printf("cannot unmarshal JSONRPC message: %s", err)
 			continue
 		}
+		for _, resp := range resps {
+			c.dispatch(resp)
+		}
+	}
+}
+
+// dispatch passes a response to the call that is waiting for it.
+func (c *TendermintClient) dispatch(resp *jsonrpcResponse) {
+	if strings.HasSuffix(resp.CorrelationID, eventSuffix) {
+		c.dispatchEvent(resp)
+		return
+	}
+
+	c.mu.Lock()
+	respc, ok := c.resp[resp.CorrelationID]
+	delete(c.resp, resp.CorrelationID)
+	c.mu.Unlock()
 
+	if ok {
+		// repc is expected to be a buffered channel so this
+		// operation must never block.
+		respc <- resp
+	} else if resp.Error != nil {
+		log.Printf("unexpected JSONRPC error %q: %d: %s", resp.CorrelationID, resp.Error.Code, resp.Error.Message)
+	}
+}
+
+// eventSuffix is appended by tendermint to the subscription request
+// correlation ID for every event published for that subscription.
+const eventSuffix = "#event"
+
+// dispatchEvent passes the event to the subscription it belongs to. Events
+// are never blocking the read loop. If the subscriber is not consuming fast
+// enough, the event is dropped.
+func (c *TendermintClient) dispatchEvent(resp *jsonrpcResponse) {
+	id := strings.TrimSuffix(resp.CorrelationID, eventSuffix)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	events, ok := c.subs[id]
+	if !ok {
+		return
+	}
+
+	if resp.Error != nil {
+		// Subscription was cancelled by the server.
+		log.Printf("subscription %s cancelled: %d: %s", id, resp.Error.Code, resp.Error.Message)
+		c.dropSubscription(id)
+		return
+	}
+
+	var payload struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Result, &payload); err != nil {
+		log.Printf("cannot unmarshal subscription %s event: %s", id, err)
+		return
+	}
+
+	select {
+	case events <- payload.Data:
+	default:
+		log.Printf("subscription %s is not consumed, event dropped", id)
+	}
+}
+
+// dropSubscription removes the subscription with given correlation ID and
+// closes its events channel. Caller must hold the lock.
+func (c *TendermintClient) dropSubscription(id string) {
+	events, ok := c.subs[id]
+	if !ok {
+		return
+	}
+	delete(c.subs, id)
+	for q, qid := range c.queries {
+		if qid == id {
+			delete(c.queries, q)
+		}
+	}
+	close(events)
+}
+
+// Subscribe registers for events matching given query, for example
+// "tm.event='NewBlock'". Each event data is delivered as raw JSON to the
+// returned channel. Events are dropped if the channel is not consumed fast
+// enough. The channel is closed when the subscription is cancelled, either
+// by calling Unsubscribe or by the server.
+//
+// Only one subscription for a given query can be active at a time.
+func (c *TendermintClient) Subscribe(ctx context.Context, query string) (<-chan json.RawMessage, error) {
+	req := newRequest(atomic.AddUint64(&c.idCnt, 1), "subscribe", query)
+	events := make(chan json.RawMessage, 64)
+
+	c.mu.Lock()
+	if _, ok := c.queries[query]; ok {
+		c.mu.Unlock()
+		return nil, errors.Wrapf(errors.ErrDuplicate, "subscription %q", query)
+	}
+	c.subs[req.CorrelationID] = events
+	c.queries[query] = req.CorrelationID
+	c.mu.Unlock()
+
+	var result json.RawMessage
+	if err := c.call(ctx, req, &result); err != nil {
 		c.mu.Lock()
-		respc, ok := c.resp[resp.CorrelationID]
-		delete(c.resp, resp.CorrelationID)
+		c.dropSubscription(req.CorrelationID)
 		c.mu.Unlock()
+		return nil, errors.Wrap(err, "subscribe")
+	}
+	return events, nil
+}
 
-		if ok {
-			// repc is expected to be a buffered channel so this
-			// operation must never block.
-			respc <- &resp
-		}
+// Unsubscribe cancels subscription for given query. Events channel returned
+// by Subscribe is closed.
+func (c *TendermintClient) Unsubscribe(ctx context.Context, query string) error {
+	c.mu.Lock()
+	id, ok := c.queries[query]
+	if ok {
+		c.dropSubscription(id)
 	}
+	c.mu.Unlock()
+
+	// A subscription that is not active was already cancelled by the
+	// server or by a lost connection.
+	if !ok {
+		return nil
+	}
+
+	var result json.RawMessage
+	if err := c.DoContext(ctx, "unsubscribe", &result, query); err != nil {
+		return errors.Wrap(err, "unsubscribe")
+	}
+	return nil
 }
 
 // Do makes a jsonrpc call. This method is safe for concurrent calls.
 //
 // Use API as described in https://tendermint.com/rpc/
 func (c *TendermintClient) Do(method string, dest interface{}, args ...interface{}) error {
-	params := make([]string, len(args))
-	for i, v := range args {
-		params[i] = fmt.Sprint(v)
-	}
-	req := jsonrpcRequest{
-		ProtocolVersion: "2.0",
-		CorrelationID:   fmt.Sprint(atomic.AddUint64(&c.idCnt, 1)),
-		Method:          method,
-		Params:          params,
+	return c.DoContext(context.Background(), method, dest, args...)
+}
+
+// DoContext makes a jsonrpc call, same as Do. The call is aborted when the
+// context is cancelled or its deadline is exceeded. The default request
+// timeout applies if the context deadline is not sooner.
+func (c *TendermintClient) DoContext(ctx context.Context, method string, dest interface{}, args ...interface{}) error {
+	return c.call(ctx, newRequest(atomic.AddUint64(&c.idCnt, 1), method, args...), dest)
+}
+
+func (c *TendermintClient) call(ctx context.Context, req jsonrpcRequest, dest interface{}) error {
+	ctx, cancel := c.conf.withTimeout(ctx)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return contextErr(err, req.Method)
 	}
 
 	respc := make(chan *jsonrpcResponse, 1)
 	c.mu.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return errors.Wrap(ErrDisconnected, "no connection")
+	}
 	c.resp[req.CorrelationID] = respc
 	c.mu.Unlock()
 
-	if err := c.conn.WriteJSON(req); err != nil {
-		return errors.Wrap(err, "write JSON")
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetWriteDeadline(deadline)
+	err := conn.WriteJSON(req)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.resp, req.CorrelationID)
+		c.mu.Unlock()
+		writeFailed(conn)
+		return errors.Wrapf(ErrDisconnected, "write JSON: %s", err)
 	}
 
-	resp := <-respc
+	var resp *jsonrpcResponse
+	select {
+	case resp = <-respc:
+	case <-ctx.Done():
+		// Response is no longer expected.
+		c.mu.Lock()
+		delete(c.resp, req.CorrelationID)
+		c.mu.Unlock()
+		return contextErr(ctx.Err(), req.Method)
+	}
+	if resp == nil {
+		return errors.Wrap(ErrDisconnected, "connection lost")
+	}
+	return resp.decode(dest)
+}
 
-	if resp.Error != nil {
-		return errors.Wrapf(ErrFailedResponse,
-			"%d: %s",
-			resp.Error.Code, resp.Error.Message)
+// DoBatch makes all given calls in a single round trip. All requests are
+// written as a single JSONRPC array. Responses are matched with calls using
+// the correlation ID.
+func (c *TendermintClient) DoBatch(ctx context.Context, calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
 	}
-	if err := json.Unmarshal(resp.Result, dest); err != nil {
-		return errors.Wrap(err, "cannot unmarshal result")
+
+	ctx, cancel := c.conf.withTimeout(ctx)
+	defer cancel()
+	method := batchMethod(calls)
+	if err := ctx.Err(); err != nil {
+		return contextErr(err, method)
 	}
-	return nil
+
+	firstID := atomic.AddUint64(&c.idCnt, uint64(len(calls))) - uint64(len(calls)) + 1
+	reqs := batchRequests(firstID, calls)
+
+	// All responses are delivered to the same channel, so it must be
+	// able to buffer all of them.
+	respc := make(chan *jsonrpcResponse, len(reqs))
+	c.mu.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return errors.Wrap(ErrDisconnected, "no connection")
+	}
+	for _, req := range reqs {
+		c.resp[req.CorrelationID] = respc
+	}
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		for _, req := range reqs {
+			delete(c.resp, req.CorrelationID)
+		}
+		c.mu.Unlock()
+	}
+
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetWriteDeadline(deadline)
+	err := conn.WriteJSON(reqs)
+	c.writeMu.Unlock()
+	if err != nil {
+		forget()
+		writeFailed(conn)
+		return errors.Wrapf(ErrDisconnected, "write JSON: %s", err)
+	}
+
+	resps := make([]*jsonrpcResponse, 0, len(reqs))
+	for len(resps) < len(reqs) {
+		select {
+		case resp := <-respc:
+			if resp == nil {
+				forget()
+				return errors.Wrap(ErrDisconnected, "connection lost")
+			}
+			resps = append(resps, resp)
+		case <-ctx.Done():
+			// Remaining responses are no longer expected.
+			forget()
+			return contextErr(ctx.Err(), method)
+		}
+	}
+	return decodeBatch(reqs, calls, resps)
+}
+
+// writeFailed closes a connection after a failed write. A websocket
+// connection cannot be written to after a write error, including an exceeded
+// write deadline. Closing it makes the read loop fail, so that the client
+// redials.
+func writeFailed(conn *websocket.Conn) {
+	_ = conn.Close()
+}
+
+// withTimeout returns a context that is cancelled when the default timeout
+// is exceeded.
+func (c clientConfig) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func newRequest(id uint64, method string, args ...interface{}) jsonrpcRequest {
+	params := make([]json.RawMessage, len(args))
+	for i, v := range args {
+		params[i] = param(v)
+	}
+	return jsonrpcRequest{
+		ProtocolVersion: "2.0",
+		CorrelationID:   fmt.Sprint(id),
+		Method:          method,
+		Params:          params,
+	}
+}
+
+// param returns the JSON representation of a call argument. Tendermint
+// expects all arguments as strings, including numbers, except for booleans.
+func param(v interface{}) json.RawMessage {
+	if b, ok := v.(bool); ok {
+		return json.RawMessage(strconv.FormatBool(b))
+	}
+	raw, _ := json.Marshal(fmt.Sprint(v))
+	return raw
+}
+
+// contextErr returns an error describing why the call was aborted.
+func contextErr(err error, method string) error {
+	if err == context.DeadlineExceeded {
+		return errors.Wrapf(errors.ErrTimeout, "call %q", method)
+	}
+	return errors.Wrapf(ErrCancelled, "call %q", method)
 }
 
 type jsonrpcRequest struct {
-	ProtocolVersion string   `json:"jsonrpc"`
-	CorrelationID   string   `json:"id"`
-	Method          string   `json:"method"`
-	Params          []string `json:"params,omitempty"`
+	ProtocolVersion string            `json:"jsonrpc"`
+	CorrelationID   string            `json:"id"`
+	Method          string            `json:"method"`
+	Params          []json.RawMessage `json:"params,omitempty"`
 }
 
 type jsonrpcResponse struct {
@@ -131,15 +578,28 @@ type jsonrpcResponse struct {
 	}
 }
 
+// decode unmarshals the result into dest or returns the response error.
+func (resp *jsonrpcResponse) decode(dest interface{}) error {
+	if resp.Error != nil {
+		return errors.Wrapf(ErrFailedResponse,
+			"%d: %s",
+			resp.Error.Code, resp.Error.Message)
+	}
+	if err := json.Unmarshal(resp.Result, dest); err != nil {
+		return errors.Wrap(err, "cannot unmarshal result")
+	}
+	return nil
+}
+
 // AbciInfo returns abci_info.
-func AbciInfo(c *TendermintClient) (*ABCIInfo, error) {
+func AbciInfo(ctx context.Context, c Caller) (*ABCIInfo, error) {
 	var payload struct {
 		Response struct {
 			LastBlockHeight sint64 `json:"last_block_height"`
 		} `json:"response"`
 	}
 
-	if err := c.Do("abci_info", &payload); err != nil {
+	if err := c.DoContext(ctx, "abci_info", &payload); err != nil {
 		return nil, errors.Wrap(err, "query tendermint")
 	}
 
@@ -150,28 +610,79 @@ type ABCIInfo struct {
 	LastBlockHeight int64 `json:"last_block_height"`
 }
 
-// Validators return all validators as represented on the block at given
-// height.
-func Validators(ctx context.Context, c *TendermintClient, blockHeight int64) ([]*TendermintValidator, error) {
+// AbciQuery returns the values found by a weave query of the latest state,
+// and the height of that state. Weave does not support queries of an earlier
+// state. ErrFailedResponse is returned if the application rejects the query.
+func AbciQuery(ctx context.Context, c Caller, path string, data []byte) ([][]byte, int64, error) {
 	var payload struct {
-		Validators []struct {
-			Address hexstring
-			PubKey  struct {
-				Value []byte
-			} `json:"pub_key"`
-		}
+		Response struct {
+			Code   uint32 `json:"code"`
+			Log    string `json:"log"`
+			Value  []byte `json:"value"`
+			Height sint64 `json:"height"`
+		} `json:"response"`
+	}
+
+	if err := c.DoContext(ctx, "abci_query", &payload, path, hex.EncodeToString(data), 0, false); err != nil {
+		return nil, 0, errors.Wrap(err, "query tendermint")
 	}
-	if err := c.Do("validators", &payload, blockHeight); err != nil {
+	if payload.Response.Code != 0 {
+		return nil, 0, errors.Wrapf(ErrFailedResponse, "query %s: %d: %s", path, payload.Response.Code, payload.Response.Log)
+	}
+
+	var values app.ResultSet
+	if err := values.Unmarshal(payload.Response.Value); err != nil {
+		return nil, 0, errors.Wrap(err, "cannot unmarshal query result")
+	}
+	return values.Results, int64(payload.Response.Height), nil
+}
+
+// queryConfiguration loads the current configuration of given extension,
+// as stored by gconf, and returns the height it was loaded at. ErrNotFound is
+// returned if the extension has no configuration.
+func queryConfiguration(ctx context.Context, c Caller, pkg string, dest interface{ Unmarshal([]byte) error }) (int64, error) {
+	values, height, err := AbciQuery(ctx, c, "/gconf", []byte(pkg))
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s configuration", pkg)
+	}
+	if len(values) == 0 || len(values[0]) == 0 {
+		return 0, errors.Wrapf(errors.ErrNotFound, "%s configuration", pkg)
+	}
+	if err := dest.Unmarshal(values[0]); err != nil {
+		return 0, errors.Wrapf(err, "unmarshal %s configuration", pkg)
+	}
+	return height, nil
+}
+
+// Validators return all validators as represented on the block at given
+// height.
+func Validators(ctx context.Context, c Caller, blockHeight int64) ([]*TendermintValidator, error) {
+	var payload validatorsPayload
+	if err := c.DoContext(ctx, "validators", &payload, blockHeight); err != nil {
 		return nil, errors.Wrap(err, "query tendermint")
 	}
+	return payload.validators(), nil
+}
+
+// validatorsPayload is the result of the validators API call.
+type validatorsPayload struct {
+	Validators []struct {
+		Address hexstring
+		PubKey  struct {
+			Value []byte
+		} `json:"pub_key"`
+	}
+}
+
+func (p *validatorsPayload) validators() []*TendermintValidator {
 	var validators []*TendermintValidator
-	for _, v := range payload.Validators {
+	for _, v := range p.Validators {
 		validators = append(validators, &TendermintValidator{
 			Address: v.Address,
 			PubKey:  v.PubKey.Value,
 		})
 	}
-	return validators, nil
+	return validators
 }
 
 type TendermintValidator struct {
@@ -209,39 +720,56 @@ func contains(haystack [][]byte, needle []byte) bool {
 	return false
 }
 
-func Commit(ctx context.Context, c *TendermintClient, height int64) (*TendermintCommit, error) {
-	var payload struct {
-		SignedHeader struct {
-			Header struct {
-				Height          sint64    `json:"height"`
-				Time            time.Time `json:"time"`
-				ProposerAddress hexstring `json:"proposer_address"`
-				ValidatorsHash  hexstring `json:"validators_hash"`
-			} `json:"header"`
-			Commit struct {
-				BlockID struct {
-					Hash hexstring `json:"hash"`
-				} `json:"block_id"`
-				Precommits []*struct {
-					ValidatorAddress hexstring `json:"validator_address"`
-				} `json:"precommits"`
-			} `json:"commit"`
-		} `json:"signed_header"`
-	}
-
-	if err := c.Do("commit", &payload, height); err != nil {
+func Commit(ctx context.Context, c Caller, height int64) (*TendermintCommit, error) {
+	var payload commitPayload
+	if err := c.DoContext(ctx, "commit", &payload, height); err != nil {
 		return nil, errors.Wrap(err, "query tendermint")
 	}
+	return payload.commit()
+}
+
+// commitPayload is the result of the commit API call. Header and commit are
+// kept in their original form, so that they can be stored.
+type commitPayload struct {
+	SignedHeader struct {
+		Header json.RawMessage `json:"header"`
+		Commit json.RawMessage `json:"commit"`
+	} `json:"signed_header"`
+}
+
+func (payload *commitPayload) commit() (*TendermintCommit, error) {
+	var header struct {
+		Height          sint64    `json:"height"`
+		Time            time.Time `json:"time"`
+		ProposerAddress hexstring `json:"proposer_address"`
+		ValidatorsHash  hexstring `json:"validators_hash"`
+	}
+	if err := unmarshalOptional(payload.SignedHeader.Header, &header); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal header")
+	}
+	var data struct {
+		BlockID struct {
+			Hash hexstring `json:"hash"`
+		} `json:"block_id"`
+		Precommits []*struct {
+			ValidatorAddress hexstring `json:"validator_address"`
+		} `json:"precommits"`
+	}
+	if err := unmarshalOptional(payload.SignedHeader.Commit, &data); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal commit")
+	}
 
 	commit := TendermintCommit{
-		Height:          payload.SignedHeader.Header.Height.Int64(),
-		Hash:            payload.SignedHeader.Commit.BlockID.Hash,
-		Time:            payload.SignedHeader.Header.Time.UTC(),
-		ProposerAddress: payload.SignedHeader.Header.ProposerAddress,
-		ValidatorsHash:  payload.SignedHeader.Header.ValidatorsHash,
+		Height:          header.Height.Int64(),
+		Hash:            data.BlockID.Hash,
+		Time:            header.Time.UTC(),
+		ProposerAddress: header.ProposerAddress,
+		ValidatorsHash:  header.ValidatorsHash,
+		RawHeader:       payload.SignedHeader.Header,
+		RawCommit:       payload.SignedHeader.Commit,
 	}
 
-	for _, pc := range payload.SignedHeader.Commit.Precommits {
+	for _, pc := range data.Precommits {
 		if pc == nil {
 			continue
 		}
@@ -251,6 +779,14 @@ func Commit(ctx context.Context, c *TendermintClient, height int64) (*Tendermint
 	return &commit, nil
 }
 
+// unmarshalOptional decodes raw JSON into dest, unless it is missing.
+func unmarshalOptional(raw json.RawMessage, dest interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, dest)
+}
+
 type TendermintCommit struct {
 	Height               int64
 	Hash                 []byte
@@ -258,45 +794,220 @@ type TendermintCommit struct {
 	ProposerAddress      []byte
 	ValidatorsHash       []byte
 	ParticipantAddresses [][]byte
+	// RawHeader and RawCommit are the header and the commit as returned
+	// by the API.
+	RawHeader json.RawMessage
+	RawCommit json.RawMessage
 }
 
-func FetchBlock(ctx context.Context, c *TendermintClient, height int64) (*TendermintBlock, error) {
-	var payload struct {
-		Block struct {
-			Header struct {
-				Height sint64    `json:"height"`
-				Time   time.Time `json:"time"`
-			} `json:"header"`
-			Data struct {
-				Txs [][]byte `json:"txs"`
-			} `json:"data"`
-		} `json:"block"`
-	}
-
-	if err := c.Do("block", &payload, height); err != nil {
+func FetchBlock(ctx context.Context, c Caller, height int64) (*TendermintBlock, error) {
+	var payload blockPayload
+	if err := c.DoContext(ctx, "block", &payload, height); err != nil {
 		return nil, errors.Wrap(err, "query tendermint")
 	}
+	return payload.block(), nil
+}
+
+// blockPayload is the result of the block API call.
+type blockPayload struct {
+	Block struct {
+		Header struct {
+			Height sint64    `json:"height"`
+			Time   time.Time `json:"time"`
+		} `json:"header"`
+		Data struct {
+			Txs [][]byte `json:"txs"`
+		} `json:"data"`
+	} `json:"block"`
+}
 
+func (payload *blockPayload) block() *TendermintBlock {
+	return NewTendermintBlock(
+		payload.Block.Header.Height.Int64(),
+		payload.Block.Header.Time,
+		payload.Block.Data.Txs,
+	)
+}
+
+// NewTendermintBlock returns a block with given binary transactions.
+// Transactions are not decoded, as that depends on the application.
+func NewTendermintBlock(height int64, t time.Time, rawTxs [][]byte) *TendermintBlock {
 	block := TendermintBlock{
-		Height: payload.Block.Header.Height.Int64(),
-		Time:   payload.Block.Header.Time.UTC(),
+		Height:          height,
+		Time:            t.UTC(),
+		RawTransactions: rawTxs,
 	}
-
-	for _, rawTx := range payload.Block.Data.Txs {
-		var tx bnsd.Tx
-		if err := tx.Unmarshal(rawTx); err != nil {
-			return nil, errors.Wrap(err, "cannot unmarshal transaction")
-		}
-		block.Transactions = append(block.Transactions, &tx)
+	for _, rawTx := range rawTxs {
 		block.TransactionHashes = append(block.TransactionHashes, sha256.Sum256(rawTx))
 	}
-
-	return &block, nil
+	return &block
 }
 
 type TendermintBlock struct {
 	Height            int64
 	Time              time.Time
-	Transactions      []*bnsd.Tx
 	TransactionHashes [][32]byte
+	RawTransactions   [][]byte
+	// Results are the results of delivering each transaction, in the
+	// same order. It is nil if results were not fetched.
+	Results []TxResult
+	// RawResults are the block results as returned by the API.
+	RawResults json.RawMessage
+}
+
+// result returns the result of delivering the transaction with given index,
+// or nil if it is not known.
+func (b *TendermintBlock) result(i int) *TxResult {
+	if i >= len(b.Results) {
+		return nil
+	}
+	return &b.Results[i]
+}
+
+// TxResult is the result of delivering a transaction.
+type TxResult struct {
+	// Code is zero if the transaction succeeded.
+	Code uint32
+	// Data is returned by the application, for example the key of a
+	// created entity.
+	Data []byte
+	Log  string
+}
+
+// parseTxResults returns the results of all transactions from the result of
+// the block_results API call, or nil if raw is empty. Transaction results are
+// listed under a different key depending on the Tendermint version.
+func parseTxResults(raw json.RawMessage) ([]TxResult, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var payload struct {
+		Results struct {
+			DeliverTx []*txResultPayload `json:"DeliverTx"`
+			// Used since Tendermint 0.32.
+			DeliverTxSnake []*txResultPayload `json:"deliver_tx"`
+		} `json:"results"`
+		// Used since Tendermint 0.33.
+		TxsResults []*txResultPayload `json:"txs_results"`
+	}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal block results")
+	}
+	list := payload.TxsResults
+	if list == nil {
+		list = payload.Results.DeliverTxSnake
+	}
+	if list == nil {
+		list = payload.Results.DeliverTx
+	}
+
+	results := make([]TxResult, len(list))
+	for i, r := range list {
+		if r != nil {
+			results[i] = TxResult{Code: r.Code, Data: r.Data, Log: r.Log}
+		}
+	}
+	return results, nil
+}
+
+type txResultPayload struct {
+	Code uint32 `json:"code"`
+	Data []byte `json:"data"`
+	Log  string `json:"log"`
+}
+
+// newBlockQuery is the subscription query matching all new block events.
+const newBlockQuery = "tm.event='NewBlock'"
+
+// NewBlockHeight returns the height of the block from the NewBlock event
+// data, as delivered by a subscription.
+func NewBlockHeight(data json.RawMessage) (int64, error) {
+	var payload struct {
+		Value struct {
+			Block struct {
+				Header struct {
+					Height sint64 `json:"height"`
+				} `json:"header"`
+			} `json:"block"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return 0, errors.Wrap(err, "cannot unmarshal new block event")
+	}
+	if payload.Value.Block.Header.Height == 0 {
+		return 0, errors.Wrap(errors.ErrInput, "new block event without height")
+	}
+	return payload.Value.Block.Header.Height.Int64(), nil
+}
+
+// TendermintHeight holds all information fetched for a single block height.
+// Block contains the transaction results.
+type TendermintHeight struct {
+	Commit *TendermintCommit
+	Block  *TendermintBlock
+	// Validators is the validator set of the block.
+	Validators []*TendermintValidator
+}
+
+// FetchHeights returns the commit, the validator set and the block with
+// transaction results for each height in given range, including both ends.
+// If the client is a Batcher, all calls are made in a single batch. Nodes may
+// prune block results, so a failed block_results call leaves the results of
+// that block unknown instead of failing.
+func FetchHeights(ctx context.Context, c Caller, fromHeight, toHeight int64) ([]*TendermintHeight, error) {
+	if toHeight < fromHeight {
+		return nil, errors.Wrapf(errors.ErrInput, "invalid range %d-%d", fromHeight, toHeight)
+	}
+
+	// Calls of each height are grouped, block_results being the last.
+	const perHeight = 4
+
+	n := int(toHeight - fromHeight + 1)
+	commits := make([]commitPayload, n)
+	blocks := make([]blockPayload, n)
+	validators := make([]validatorsPayload, n)
+	results := make([]json.RawMessage, n)
+	calls := make([]*BatchCall, 0, perHeight*n)
+	for i := 0; i < n; i++ {
+		height := fromHeight + int64(i)
+		calls = append(calls,
+			&BatchCall{Method: "commit", Args: []interface{}{height}, Dest: &commits[i]},
+			&BatchCall{Method: "block", Args: []interface{}{height}, Dest: &blocks[i]},
+			&BatchCall{Method: "validators", Args: []interface{}{height}, Dest: &validators[i]},
+			&BatchCall{Method: "block_results", Args: []interface{}{height}, Dest: &results[i]},
+		)
+	}
+	if err := DoBatch(ctx, c, calls); err != nil {
+		return nil, errors.Wrap(err, "query tendermint")
+	}
+
+	heights := make([]*TendermintHeight, n)
+	for i := 0; i < n; i++ {
+		height := fromHeight + int64(i)
+		group := calls[perHeight*i : perHeight*(i+1)]
+		for _, call := range group[:perHeight-1] {
+			if call.Err != nil {
+				return nil, errors.Wrapf(call.Err, "%s for %d", call.Method, height)
+			}
+		}
+		if call := group[perHeight-1]; call.Err != nil {
+			log.Printf("%s for %d: %s", call.Method, height, call.Err)
+			results[i] = nil
+		}
+		commit, err := commits[i].commit()
+		if err != nil {
+			return nil, errors.Wrapf(err, "commit %d", height)
+		}
+		block := blocks[i].block()
+		if block.Results, err = parseTxResults(results[i]); err != nil {
+			return nil, errors.Wrapf(err, "block results %d", height)
+		}
+		block.RawResults = results[i]
+		heights[i] = &TendermintHeight{
+			Commit:     commit,
+			Block:      block,
+			Validators: validators[i].validators(),
+		}
+	}
+	return heights, nil
 }
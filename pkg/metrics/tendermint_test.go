@@ -0,0 +1,363 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iov-one/weave/errors"
+)
+
+// fakeTendermint is a websocket server that responds to JSONRPC requests
+// using the registered handlers. It is a minimal tendermint API
+// implementation, good enough for testing the client.
+type fakeTendermint struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]func(params []string) (interface{}, error)
+	conns    []*websocket.Conn
+	// batches is the number of batch requests received.
+	batches int
+}
+
+func newFakeTendermint(t *testing.T) *fakeTendermint {
+	t.Helper()
+
+	ft := &fakeTendermint{
+		t:        t,
+		handlers: make(map[string]func([]string) (interface{}, error)),
+	}
+	ft.srv = httptest.NewServer(http.HandlerFunc(ft.serve))
+	return ft
+}
+
+// URL returns the websocket address of the server.
+func (ft *fakeTendermint) URL() string {
+	return "ws" + strings.TrimPrefix(ft.srv.URL, "http")
+}
+
+func (ft *fakeTendermint) Close() {
+	ft.srv.Close()
+}
+
+// Handle registers a handler for given method. Handler result is returned
+// as the JSONRPC result.
+func (ft *fakeTendermint) Handle(method string, fn func(params []string) (interface{}, error)) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.handlers[method] = fn
+}
+
+// Publish writes an event to all connected clients.
+func (ft *fakeTendermint) Publish(correlationID string, data interface{}) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	for _, c := range ft.conns {
+		msg := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      correlationID + eventSuffix,
+			"result":  map[string]interface{}{"query": newBlockQuery, "data": data},
+		}
+		if err := c.WriteJSON(msg); err != nil {
+			ft.t.Logf("cannot publish event: %s", err)
+		}
+	}
+}
+
+// DropConnections closes all client connections.
+func (ft *fakeTendermint) DropConnections() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	for _, c := range ft.conns {
+		c.Close()
+	}
+	ft.conns = nil
+}
+
+func (ft *fakeTendermint) serve(w http.ResponseWriter, r *http.Request) {
+	c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		ft.t.Logf("cannot upgrade: %s", err)
+		return
+	}
+	ft.mu.Lock()
+	ft.conns = append(ft.conns, c)
+	ft.mu.Unlock()
+
+	for {
+		_, raw, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// A batch is answered with an array of responses.
+		var resp interface{}
+		var reqs []jsonrpcRequest
+		if err := json.Unmarshal(raw, &reqs); err == nil {
+			ft.mu.Lock()
+			ft.batches++
+			ft.mu.Unlock()
+			resps := make([]interface{}, len(reqs))
+			for i, req := range reqs {
+				resps[i] = ft.respond(req)
+			}
+			resp = resps
+		} else {
+			var req jsonrpcRequest
+			if err := json.Unmarshal(raw, &req); err != nil {
+				return
+			}
+			resp = ft.respond(req)
+		}
+
+		ft.mu.Lock()
+		err = c.WriteJSON(resp)
+		ft.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// respond returns the response to a single request.
+func (ft *fakeTendermint) respond(req jsonrpcRequest) map[string]interface{} {
+	ft.mu.Lock()
+	fn, ok := ft.handlers[req.Method]
+	ft.mu.Unlock()
+
+	resp := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      req.CorrelationID,
+	}
+	if !ok {
+		resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+	} else if result, err := fn(stringParams(req.Params)); err != nil {
+		resp["error"] = map[string]interface{}{"code": -32603, "message": err.Error()}
+	} else {
+		resp["result"] = result
+	}
+	return resp
+}
+
+// stringParams returns request parameters as strings. Parameters that are
+// not JSON strings are returned as they are encoded.
+func stringParams(params []json.RawMessage) []string {
+	res := make([]string, len(params))
+	for i, p := range params {
+		if err := json.Unmarshal(p, &res[i]); err != nil {
+			res[i] = string(p)
+		}
+	}
+	return res
+}
+
+func TestTendermintClientDo(t *testing.T) {
+	ft := newFakeTendermint(t)
+	defer ft.Close()
+
+	ft.Handle("abci_info", func([]string) (interface{}, error) {
+		return map[string]interface{}{
+			"response": map[string]interface{}{"last_block_height": "42"},
+		}, nil
+	})
+
+	c, err := DialTendermint(ft.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+
+	info, err := AbciInfo(context.Background(), c)
+	if err != nil {
+		t.Fatalf("cannot get info: %s", err)
+	}
+	if info.LastBlockHeight != 42 {
+		t.Fatalf("unexpected height: %d", info.LastBlockHeight)
+	}
+
+	var dest json.RawMessage
+	if err := c.Do("does_not_exist", &dest); !ErrFailedResponse.Is(err) {
+		t.Fatalf("want failed response error, got %v", err)
+	}
+}
+
+func TestTendermintClientSubscribe(t *testing.T) {
+	ft := newFakeTendermint(t)
+	defer ft.Close()
+
+	subscribed := make(chan string, 1)
+	ft.Handle("subscribe", func(params []string) (interface{}, error) {
+		subscribed <- params[0]
+		return map[string]interface{}{}, nil
+	})
+	ft.Handle("unsubscribe", func([]string) (interface{}, error) {
+		return map[string]interface{}{}, nil
+	})
+
+	c, err := DialTendermint(ft.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+
+	events, err := c.Subscribe(context.Background(), newBlockQuery)
+	if err != nil {
+		t.Fatalf("cannot subscribe: %s", err)
+	}
+	if q := <-subscribed; q != newBlockQuery {
+		t.Fatalf("unexpected query: %q", q)
+	}
+	if _, err := c.Subscribe(context.Background(), newBlockQuery); err == nil {
+		t.Fatal("duplicated subscription must not be allowed")
+	}
+
+	// First request sent by the client has correlation ID 1.
+	ft.Publish("1", map[string]interface{}{
+		"type": "tendermint/event/NewBlock",
+		"value": map[string]interface{}{
+			"block": map[string]interface{}{
+				"header": map[string]interface{}{"height": "1234"},
+			},
+		},
+	})
+
+	select {
+	case ev := <-events:
+		height, err := NewBlockHeight(ev)
+		if err != nil {
+			t.Fatalf("cannot read height: %s", err)
+		}
+		if height != 1234 {
+			t.Fatalf("unexpected height: %d", height)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered")
+	}
+
+	if err := c.Unsubscribe(context.Background(), newBlockQuery); err != nil {
+		t.Fatalf("cannot unsubscribe: %s", err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("events channel must be closed")
+	}
+}
+
+func TestTendermintClientDoContext(t *testing.T) {
+	ft := newFakeTendermint(t)
+	defer ft.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	ft.Handle("slow", func([]string) (interface{}, error) {
+		<-release
+		return map[string]interface{}{}, nil
+	})
+
+	c, err := DialTendermint(ft.URL(), WithRequestTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+
+	var dest json.RawMessage
+	if err := c.DoContext(context.Background(), "slow", &dest); !errors.ErrTimeout.Is(err) {
+		t.Fatalf("want timeout error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.DoContext(ctx, "slow", &dest); !ErrCancelled.Is(err) {
+		t.Fatalf("want cancelled error, got %v", err)
+	}
+
+	c.mu.Lock()
+	pending := len(c.resp)
+	c.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("aborted calls must not be pending, got %d", pending)
+	}
+}
+
+func TestTendermintClientReconnect(t *testing.T) {
+	ft := newFakeTendermint(t)
+	defer ft.Close()
+
+	ft.Handle("abci_info", func([]string) (interface{}, error) {
+		return map[string]interface{}{
+			"response": map[string]interface{}{"last_block_height": "42"},
+		}, nil
+	})
+	ft.Handle("hang", func([]string) (interface{}, error) {
+		ft.DropConnections()
+		return nil, errors.ErrHuman
+	})
+
+	c, err := DialTendermint(ft.URL())
+	if err != nil {
+		t.Fatalf("cannot dial: %s", err)
+	}
+	defer c.Close()
+
+	var dest json.RawMessage
+	if err := c.Do("hang", &dest); !ErrDisconnected.Is(err) {
+		t.Fatalf("want disconnected error, got %v", err)
+	}
+
+	// Client must reconnect in the background and continue serving new
+	// calls.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := AbciInfo(context.Background(), c)
+		if err == nil {
+			break
+		}
+		if !ErrDisconnected.Is(err) {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client did not reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestParseTxResults(t *testing.T) {
+	want := []TxResult{
+		{Data: []byte{1, 2}},
+		{Code: 6, Log: "invalid input"},
+	}
+	cases := map[string]string{
+		"tendermint 0.31": `{"height": "1", "results": {"DeliverTx": [{"data": "AQI="}, {"code": 6, "log": "invalid input"}]}}`,
+		"tendermint 0.32": `{"height": "1", "results": {"deliver_tx": [{"data": "AQI="}, {"code": 6, "log": "invalid input"}]}}`,
+		"tendermint 0.33": `{"height": "1", "txs_results": [{"data": "AQI="}, {"code": 6, "log": "invalid input"}]}`,
+	}
+	for name, raw := range cases {
+		t.Run(name, func(t *testing.T) {
+			results, err := parseTxResults(json.RawMessage(raw))
+			if err != nil {
+				t.Fatalf("cannot parse: %s", err)
+			}
+			if !reflect.DeepEqual(results, want) {
+				t.Fatalf("want %+v, got %+v", want, results)
+			}
+		})
+	}
+
+	if results, err := parseTxResults(nil); err != nil || results != nil {
+		t.Fatalf("want no results, got %+v, %v", results, err)
+	}
+	if results, err := parseTxResults(json.RawMessage(`{"height": "1", "results": {}}`)); err != nil || len(results) != 0 {
+		t.Fatalf("want empty results, got %+v, %v", results, err)
+	}
+}
@@ -1,11 +1,22 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// Addresses of the account module are hex encoded.
+
 type Account struct {
 	ID     int64  `json:"-"`
 	Domain string `json:"domain"`
 	Name   string `json:"name"`
 	Owner  string `json:"owner"`
 	Broker string `json:"broker"`
+	// ValidUntil is nil if the expiration is not known, because the
+	// account was registered before expiration was tracked.
+	ValidUntil   *time.Time `json:"valid_until,omitempty"`
+	Certificates [][]byte   `json:"certificates,omitempty"`
 }
 
 type AccountTarget struct {
@@ -14,3 +25,76 @@ type AccountTarget struct {
 	BlockchainID string `json:"blockchain_id"`
 	Address      string `json:"address"`
 }
+
+type Domain struct {
+	ID           int64  `json:"-"`
+	Domain       string `json:"domain"`
+	Admin        string `json:"admin"`
+	Broker       string `json:"broker,omitempty"`
+	HasSuperuser bool   `json:"has_superuser"`
+	// AccountRenew is the validity period of accounts registered or
+	// renewed in the domain.
+	AccountRenew time.Duration   `json:"account_renew"`
+	MsgFees      json.RawMessage `json:"msg_fees,omitempty"`
+	// ValidUntil is nil if the expiration is not known, because the
+	// domain renew period was not configured.
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+// AccountConfiguration is the configuration of the account module, as far
+// as it is needed to track expiration of domains.
+type AccountConfiguration struct {
+	Owner             string        `json:"owner,omitempty"`
+	DomainRenew       time.Duration `json:"domain_renew"`
+	DomainGracePeriod time.Duration `json:"domain_grace_period"`
+}
+
+// Change identifies the transaction that modified a domain or an account.
+type Change struct {
+	Height int64     `json:"height"`
+	Time   time.Time `json:"time"`
+	// TxHash and MsgPath are empty for the state that was known before
+	// history was recorded.
+	TxHash  string `json:"transaction_hash,omitempty"`
+	MsgPath string `json:"msg_path,omitempty"`
+}
+
+// AccountVersion is the state of an account, including its targets, after
+// a change.
+type AccountVersion struct {
+	Change
+	Account
+	Targets []AccountTarget `json:"targets"`
+	Deleted bool            `json:"deleted"`
+}
+
+// DomainVersion is the state of a domain after a change.
+type DomainVersion struct {
+	Change
+	Domain
+	Deleted bool `json:"deleted"`
+}
+
+// Starname is an account found by one of its targets.
+type Starname struct {
+	Domain string `json:"domain"`
+	Name   string `json:"name"`
+	Owner  string `json:"owner"`
+}
+
+// String returns the name*domain notation of the starname.
+func (s Starname) String() string {
+	return s.Name + "*" + s.Domain
+}
+
+// Renewal is an extension of the validity of a domain or an account.
+type Renewal struct {
+	Change
+	Domain string `json:"domain"`
+	// Name is the renewed account. It is nil if the domain was renewed.
+	Name *string `json:"name"`
+	// PreviousValidUntil and ValidUntil are nil if the expiration was not
+	// known.
+	PreviousValidUntil *time.Time `json:"previous_valid_until"`
+	ValidUntil         *time.Time `json:"valid_until"`
+}
@@ -1,9 +1,28 @@
 package models
 
 import (
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/cmd/bnsd/x/preregistration"
+	"github.com/iov-one/weave/cmd/bnsd/x/qualityscore"
+	"github.com/iov-one/weave/cmd/bnsd/x/termdeposit"
+	"github.com/iov-one/weave/cmd/bnsd/x/username"
 	coin "github.com/iov-one/weave/coin"
+	"github.com/iov-one/weave/x/aswap"
+	"github.com/iov-one/weave/x/cash"
+	"github.com/iov-one/weave/x/distribution"
+	"github.com/iov-one/weave/x/escrow"
+	"github.com/iov-one/weave/x/gov"
+	"github.com/iov-one/weave/x/msgfee"
+	"github.com/iov-one/weave/x/multisig"
+	"github.com/iov-one/weave/x/txfee"
 )
 
+// Adapters are JSON representations of messages with address fields. Each
+// adapter embeds the original message and replaces all of its addresses
+// with their bech32 representation. Optional addresses that are not set
+// are omitted.
+
 type CashSendMsgAdapter struct {
 	Source      string     `json:"source"`
 	Destination string     `json:"destination"`
@@ -11,3 +30,167 @@ type CashSendMsgAdapter struct {
 	// max length 128 character
 	Memo string `json:"memo"`
 }
+
+type EscrowCreateMsgAdapter struct {
+	*escrow.CreateMsg
+	Source      string `json:"source"`
+	Arbiter     string `json:"arbiter"`
+	Destination string `json:"destination"`
+}
+
+type EscrowUpdatePartiesMsgAdapter struct {
+	*escrow.UpdatePartiesMsg
+	Source      string `json:"source,omitempty"`
+	Arbiter     string `json:"arbiter,omitempty"`
+	Destination string `json:"destination,omitempty"`
+}
+
+type AswapCreateMsgAdapter struct {
+	*aswap.CreateMsg
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+type MultisigParticipantAdapter struct {
+	Signature string          `json:"signature"`
+	Weight    multisig.Weight `json:"weight"`
+}
+
+type MultisigCreateMsgAdapter struct {
+	*multisig.CreateMsg
+	Participants []MultisigParticipantAdapter `json:"participants"`
+}
+
+type MultisigUpdateMsgAdapter struct {
+	*multisig.UpdateMsg
+	Participants []MultisigParticipantAdapter `json:"participants"`
+}
+
+type DistributionDestinationAdapter struct {
+	Address string `json:"address"`
+	Weight  int32  `json:"weight"`
+}
+
+type DistributionCreateMsgAdapter struct {
+	*distribution.CreateMsg
+	Admin        string                           `json:"admin"`
+	Destinations []DistributionDestinationAdapter `json:"destinations"`
+}
+
+type DistributionResetMsgAdapter struct {
+	*distribution.ResetMsg
+	Destinations []DistributionDestinationAdapter `json:"destinations"`
+}
+
+type GovCreateProposalMsgAdapter struct {
+	*gov.CreateProposalMsg
+	Author string `json:"author,omitempty"`
+}
+
+type GovVoteMsgAdapter struct {
+	*gov.VoteMsg
+	Voter string `json:"voter,omitempty"`
+}
+
+type GovElectorAdapter struct {
+	Address string `json:"address"`
+	Weight  uint32 `json:"weight"`
+}
+
+type GovUpdateElectorateMsgAdapter struct {
+	*gov.UpdateElectorateMsg
+	DiffElectors []GovElectorAdapter `json:"diff_electors"`
+}
+
+type UsernameTransferTokenMsgAdapter struct {
+	*username.TransferTokenMsg
+	NewOwner string `json:"new_owner"`
+}
+
+type AccountRegisterDomainMsgAdapter struct {
+	*account.RegisterDomainMsg
+	Admin  string `json:"admin"`
+	Broker string `json:"broker,omitempty"`
+}
+
+type AccountTransferDomainMsgAdapter struct {
+	*account.TransferDomainMsg
+	NewAdmin string `json:"new_admin"`
+}
+
+type AccountRegisterAccountMsgAdapter struct {
+	*account.RegisterAccountMsg
+	Owner  string `json:"owner"`
+	Broker string `json:"broker,omitempty"`
+}
+
+type AccountTransferAccountMsgAdapter struct {
+	*account.TransferAccountMsg
+	NewOwner string `json:"new_owner"`
+}
+
+type PreregistrationRegisterMsgAdapter struct {
+	*preregistration.RegisterMsg
+	Owner string `json:"owner"`
+}
+
+type TermdepositDepositMsgAdapter struct {
+	*termdeposit.DepositMsg
+	Depositor string `json:"depositor"`
+}
+
+// UpdateConfigurationMsgAdapter represents the configuration update message
+// of any extension. Patch is one of the configuration adapters.
+type UpdateConfigurationMsgAdapter struct {
+	Metadata *weave.Metadata `json:"metadata,omitempty"`
+	Patch    interface{}     `json:"patch,omitempty"`
+}
+
+type CashConfigurationAdapter struct {
+	*cash.Configuration
+	Owner            string `json:"owner,omitempty"`
+	CollectorAddress string `json:"collector_address,omitempty"`
+}
+
+type TxfeeConfigurationAdapter struct {
+	*txfee.Configuration
+	Owner string `json:"owner,omitempty"`
+}
+
+type MsgfeeConfigurationAdapter struct {
+	*msgfee.Configuration
+	Owner    string `json:"owner,omitempty"`
+	FeeAdmin string `json:"fee_admin,omitempty"`
+}
+
+type AccountConfigurationAdapter struct {
+	*account.Configuration
+	Owner string `json:"owner,omitempty"`
+}
+
+type UsernameConfigurationAdapter struct {
+	*username.Configuration
+	Owner string `json:"owner,omitempty"`
+}
+
+type PreregistrationConfigurationAdapter struct {
+	*preregistration.Configuration
+	Owner string `json:"owner,omitempty"`
+}
+
+type QualityscoreConfigurationAdapter struct {
+	*qualityscore.Configuration
+	Owner string `json:"owner,omitempty"`
+}
+
+type TermdepositCustomRateAdapter struct {
+	Address string         `json:"address"`
+	Rate    weave.Fraction `json:"rate"`
+}
+
+type TermdepositConfigurationAdapter struct {
+	*termdeposit.Configuration
+	Owner     string                         `json:"owner,omitempty"`
+	Admin     string                         `json:"admin,omitempty"`
+	BaseRates []TermdepositCustomRateAdapter `json:"base_rates"`
+}
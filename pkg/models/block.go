@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -13,6 +14,14 @@ type Block struct {
 	ParticipantIDs []int64       `json:"-"`
 	MissingIDs     []int64       `json:"-"`
 	Messages       []string      `json:"messages,omitempty"`
-	FeeFrac        uint64        `json:"fee_frac"`
+	Fees           []Fee         `json:"fees,omitempty"`
 	Transactions   []Transaction `json:"transactions"`
+	// Header, Commit and Results are the raw JSON of the block header,
+	// commit and results, as returned by the Tendermint API.
+	// RawTransactions are the binary transactions of the block. They are
+	// stored so that a block can be reindexed without network access.
+	Header          json.RawMessage `json:"-"`
+	Commit          json.RawMessage `json:"-"`
+	Results         json.RawMessage `json:"-"`
+	RawTransactions [][]byte        `json:"-"`
 }
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Escrow states.
+const (
+	EscrowOpen     = "open"
+	EscrowReleased = "released"
+	EscrowReturned = "returned"
+)
+
+// Escrow holds funds of the source until they are released to the
+// destination by the arbiter or the source, or returned to the source after
+// the timeout. All addresses are bech32 encoded.
+type Escrow struct {
+	// ID is the key the escrow is stored with on the chain.
+	ID          []byte `json:"id"`
+	Address     string `json:"address"`
+	Source      string `json:"source"`
+	Arbiter     string `json:"arbiter"`
+	Destination string `json:"destination"`
+	// Amount is what is left on the escrow.
+	Amount  []Coin    `json:"amount"`
+	Timeout time.Time `json:"timeout"`
+	Memo    string    `json:"memo,omitempty"`
+	State   string    `json:"state"`
+}
+
+// EscrowEvent is a change of an escrow, caused by a transaction.
+type EscrowEvent struct {
+	ID int64 `json:"id"`
+	Change
+	// Kind is one of "create", "release", "return" or "update_parties".
+	Kind string `json:"kind"`
+	// Moved is the amount moved to or from the escrow.
+	Moved []Coin `json:"moved,omitempty"`
+	// Escrow is the state after the event.
+	Escrow Escrow `json:"escrow"`
+}
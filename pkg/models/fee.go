@@ -0,0 +1,18 @@
+package models
+
+// Fee is an amount of a single currency paid for processing transactions.
+type Fee struct {
+	// Payer is the bech32 address of the account that paid the fee. It
+	// is empty for fee totals.
+	Payer      string `json:"payer,omitempty"`
+	Ticker     string `json:"ticker"`
+	Whole      int64  `json:"whole"`
+	Fractional int64  `json:"fractional"`
+}
+
+// Coin is an amount of a single currency.
+type Coin struct {
+	Ticker     string `json:"ticker"`
+	Whole      int64  `json:"whole"`
+	Fractional int64  `json:"fractional"`
+}
@@ -0,0 +1,34 @@
+package models
+
+// LedgerEntry is a change of the balance of an address, caused by a
+// transaction. Amounts are signed, negative for debits. Whole and
+// Fractional have the same sign.
+type LedgerEntry struct {
+	ID int64 `json:"id"`
+	Change
+	// Address is the bech32 address which balance changed.
+	Address    string `json:"address"`
+	Ticker     string `json:"ticker"`
+	Whole      int64  `json:"whole"`
+	Fractional int64  `json:"fractional"`
+	// Kind describes the movement, for example "send" or "fee".
+	Kind string `json:"kind"`
+	// Counterparty is the bech32 address of the other side of the
+	// movement, if known.
+	Counterparty string `json:"counterparty,omitempty"`
+}
+
+// Balance is the amount of a single currency held by an address.
+type Balance struct {
+	Address    string `json:"address"`
+	Ticker     string `json:"ticker"`
+	Whole      int64  `json:"whole"`
+	Fractional int64  `json:"fractional"`
+}
+
+// CashConfiguration is the configuration of the cash module, as far as it
+// is needed to track fees.
+type CashConfiguration struct {
+	// MinimalFee is charged for transactions that failed to deliver.
+	MinimalFee Coin `json:"minimal_fee"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// MultisigContract is a weighted multi signature contract. A transaction is
+// authorized by the contract if the weights of its signers reach the
+// activation threshold. Changing the contract requires the admin threshold.
+type MultisigContract struct {
+	// ID is the key the contract is stored with on the chain.
+	ID []byte `json:"id"`
+	// Address is the bech32 address of the contract.
+	Address             string                `json:"address"`
+	Participants        []MultisigParticipant `json:"participants"`
+	ActivationThreshold int32                 `json:"activation_threshold"`
+	AdminThreshold      int32                 `json:"admin_threshold"`
+}
+
+// MultisigParticipant is a signer of a multisig contract.
+type MultisigParticipant struct {
+	// Address is the bech32 address of the signer.
+	Address string `json:"address"`
+	Weight  int32  `json:"weight"`
+}
@@ -5,7 +5,17 @@ import (
 )
 
 type Transaction struct {
-	Hash    string          `json:"hash"`
-	BlockID int64           `json:"block_height"`
-	Message json.RawMessage `json:"message,omitempty"`
+	Hash     string          `json:"hash"`
+	BlockID  int64           `json:"block_height"`
+	Message  json.RawMessage `json:"message,omitempty"`
+	Fee      *Fee            `json:"fee,omitempty"`
+	Signers  []string        `json:"signers,omitempty"`
+	Messages []Message       `json:"-"`
+	// Multisigs are IDs of multisig contracts used to authorize the
+	// transaction.
+	Multisigs [][]byte `json:"-"`
+	// DecodeError is set if the transaction could not be decoded. Such
+	// transaction is stored with its Raw bytes only.
+	DecodeError string `json:"decode_error,omitempty"`
+	Raw         []byte `json:"-"`
 }
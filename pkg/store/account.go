@@ -0,0 +1,463 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave"
+	"github.com/iov-one/weave/cmd/bnsd/x/account"
+	"github.com/iov-one/weave/errors"
+	"github.com/lib/pq"
+)
+
+// Domains and accounts that are deleted are not removed. They are marked
+// with the deletion time instead and ignored by all queries. Updates of
+// domains and accounts that do not exist are ignored.
+//
+// Each update appends the new state of all modified domains and accounts to
+// their history, attributed to given change.
+
+// The configuration of the account module is recorded with the height it is
+// known from. A configuration updated by a transaction is recorded with its
+// hash, so that it is recorded again when the block is reindexed.
+
+// AccountConfigurationAt returns the configuration of the account module as
+// of given height, including changes done at that height. ErrNotFound is
+// returned if it is not known at that height.
+func (t *Tx) AccountConfigurationAt(ctx context.Context, height int64) (*models.AccountConfiguration, error) {
+	var (
+		c                        models.AccountConfiguration
+		owner                    sql.NullString
+		domainRenew, gracePeriod int64
+	)
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT owner, domain_renew, domain_grace_period
+		FROM account_configuration
+		WHERE height <= $1
+		ORDER BY height DESC, id DESC
+		LIMIT 1
+	`, height).Scan(&owner, &domainRenew, &gracePeriod)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select account configuration")
+	}
+	c.Owner = owner.String
+	c.DomainRenew = time.Duration(domainRenew) * time.Second
+	c.DomainGracePeriod = time.Duration(gracePeriod) * time.Second
+	return &c, nil
+}
+
+// SetAccountConfiguration records the configuration of the account module
+// set by given change.
+func (t *Tx) SetAccountConfiguration(ctx context.Context, ch models.Change, c models.AccountConfiguration) error {
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO account_configuration (height, transaction_hash, owner, domain_renew, domain_grace_period)
+		VALUES ($1, $2, $3, $4, $5)
+	`, ch.Height, nullString(ch.TxHash), nullString(c.Owner), seconds(c.DomainRenew), seconds(c.DomainGracePeriod))
+	return wrapPgErr(err, "set account configuration")
+}
+
+// InitAccountConfiguration records the configuration of the account module
+// as of given height, unless a configuration is already recorded at that
+// height. It is used to provide the configuration set in the genesis, at
+// height zero, or the configuration read from the chain, at the height it
+// was read at.
+func (s *Store) InitAccountConfiguration(ctx context.Context, height int64, c models.AccountConfiguration) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO account_configuration (height, owner, domain_renew, domain_grace_period)
+		SELECT $1::BIGINT, $2::TEXT, $3::BIGINT, $4::BIGINT
+		WHERE NOT EXISTS (SELECT 1 FROM account_configuration WHERE height = $1)
+	`, height, nullString(c.Owner), seconds(c.DomainRenew), seconds(c.DomainGracePeriod))
+	return wrapPgErr(err, "init account configuration")
+}
+
+// InsertDomain adds a registered domain, unless a domain with the same name
+// already exists. The chain rejects the registration of an existing domain,
+// so the existing one is kept.
+func (t *Tx) InsertDomain(ctx context.Context, ch models.Change, d models.Domain) error {
+	ids, err := t.queryIDs(ctx, `
+		INSERT INTO domains (domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (domain) WHERE deleted_at IS NULL DO NOTHING
+		RETURNING id
+	`, d.Domain, d.Admin, nullString(d.Broker), d.HasSuperuser, seconds(d.AccountRenew),
+		jsonValue(d.MsgFees), d.ValidUntil)
+	if err != nil {
+		return errors.Wrap(err, "insert domain")
+	}
+	return t.recordDomains(ctx, ch, ids)
+}
+
+// LoadDomain returns the domain with given name. ErrNotFound is returned if
+// it does not exist.
+func (t *Tx) LoadDomain(ctx context.Context, domain string) (*models.Domain, error) {
+	return loadDomain(ctx, t.tx, domain)
+}
+
+// LoadDomain returns the domain with given name. ErrNotFound is returned if
+// it does not exist.
+func (s *Store) LoadDomain(ctx context.Context, domain string) (*models.Domain, error) {
+	return loadDomain(ctx, s.db, domain)
+}
+
+func loadDomain(ctx context.Context, q querier, domain string) (*models.Domain, error) {
+	d, err := scanDomain(q.QueryRowContext(ctx, `
+		SELECT `+domainColumns+`
+		FROM domains
+		WHERE domain = $1 AND deleted_at IS NULL
+	`, domain))
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot load domain")
+	}
+	return &d, nil
+}
+
+const domainColumns = `id, domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until`
+
+func scanDomain(row interface{ Scan(...interface{}) error }) (models.Domain, error) {
+	var (
+		d            models.Domain
+		broker       sql.NullString
+		accountRenew int64
+		msgFees      []byte
+	)
+	err := row.Scan(&d.ID, &d.Domain, &d.Admin, &broker, &d.HasSuperuser, &accountRenew, &msgFees, &d.ValidUntil)
+	if err != nil {
+		return d, err
+	}
+	d.Broker = broker.String
+	d.AccountRenew = time.Duration(accountRenew) * time.Second
+	d.MsgFees = msgFees
+	d.ValidUntil = utcTime(d.ValidUntil)
+	return d, nil
+}
+
+const accountColumns = `id, domain, name, owner, broker, valid_until, certificates`
+
+func scanAccount(row interface{ Scan(...interface{}) error }) (models.Account, error) {
+	var (
+		acc    models.Account
+		broker sql.NullString
+		certs  pq.ByteaArray
+	)
+	err := row.Scan(&acc.ID, &acc.Domain, &acc.Name, &acc.Owner, &broker, &acc.ValidUntil, &certs)
+	if err != nil {
+		return acc, err
+	}
+	acc.Broker = broker.String
+	acc.ValidUntil = utcTime(acc.ValidUntil)
+	if len(certs) != 0 {
+		acc.Certificates = certs
+	}
+	return acc, nil
+}
+
+// querier is implemented by both sql.DB and sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// TransferDomain changes the admin of a domain. Same as the account module
+// does, all accounts of the domain are transferred to the new admin and
+// their targets and certificates are removed.
+func (t *Tx) TransferDomain(ctx context.Context, ch models.Change, domain string, newAdmin weave.Address) error {
+	ids, err := t.queryIDs(ctx, `
+		UPDATE domains SET admin = $2
+		WHERE domain = $1 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, newAdmin.String())
+	if err != nil {
+		return errors.Wrap(err, "update domain")
+	}
+	if err := t.recordDomains(ctx, ch, ids); err != nil {
+		return err
+	}
+	_, err = t.tx.ExecContext(ctx, `
+		DELETE FROM account_targets
+		WHERE account_id IN (
+			SELECT id FROM accounts WHERE domain = $1 AND deleted_at IS NULL
+		)
+	`, domain)
+	if err != nil {
+		return wrapPgErr(err, "delete account targets")
+	}
+	ids, err = t.queryIDs(ctx, `
+		UPDATE accounts SET owner = $2, certificates = NULL
+		WHERE domain = $1 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, newAdmin.String())
+	if err != nil {
+		return errors.Wrap(err, "update accounts")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// RenewDomain sets a new expiration time of a domain. The renewal is
+// recorded together with the previous expiration time. A nil expiration time
+// means that it is not known.
+func (t *Tx) RenewDomain(ctx context.Context, ch models.Change, domain string, validUntil *time.Time) error {
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO renewals (`+renewalColumns+`)
+		SELECT $2, $3, $4, $5, domain, NULL, valid_until, $6
+		FROM domains
+		WHERE domain = $1 AND deleted_at IS NULL
+	`, domain, ch.Height, nullTime(ch.Time), nullString(ch.TxHash), nullString(ch.MsgPath), validUntil)
+	if err != nil {
+		return wrapPgErr(err, "insert renewal")
+	}
+	ids, err := t.queryIDs(ctx, `
+		UPDATE domains SET valid_until = $2
+		WHERE domain = $1 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, validUntil)
+	if err != nil {
+		return errors.Wrap(err, "update domain")
+	}
+	return t.recordDomains(ctx, ch, ids)
+}
+
+// ReplaceDomainMsgFees sets new fees of account messages within a domain.
+func (t *Tx) ReplaceDomainMsgFees(ctx context.Context, ch models.Change, domain string, msgFees json.RawMessage) error {
+	ids, err := t.queryIDs(ctx, `
+		UPDATE domains SET msg_fees = $2
+		WHERE domain = $1 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, jsonValue(msgFees))
+	if err != nil {
+		return errors.Wrap(err, "update domain")
+	}
+	return t.recordDomains(ctx, ch, ids)
+}
+
+// DeleteDomain marks a domain and all its accounts as deleted at the time of
+// the change.
+func (t *Tx) DeleteDomain(ctx context.Context, ch models.Change, domain string) error {
+	ids, err := t.queryIDs(ctx, `
+		UPDATE domains SET deleted_at = $2
+		WHERE domain = $1 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, ch.Time.UTC())
+	if err != nil {
+		return errors.Wrap(err, "delete domain")
+	}
+	if err := t.recordDomains(ctx, ch, ids); err != nil {
+		return err
+	}
+	ids, err = t.queryIDs(ctx, `
+		UPDATE accounts SET deleted_at = $2
+		WHERE domain = $1 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, ch.Time.UTC())
+	if err != nil {
+		return errors.Wrap(err, "delete accounts")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// FlushDomain marks all accounts of a domain as deleted at the time of the
+// change, except the account with an empty name, that always exists.
+func (t *Tx) FlushDomain(ctx context.Context, ch models.Change, domain string) error {
+	ids, err := t.queryIDs(ctx, `
+		UPDATE accounts SET deleted_at = $2
+		WHERE domain = $1 AND name <> '' AND deleted_at IS NULL
+		RETURNING id
+	`, domain, ch.Time.UTC())
+	if err != nil {
+		return errors.Wrap(err, "delete accounts")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// InsertAccount adds a registered account together with its targets, unless
+// an account with the same domain and name already exists. The chain rejects
+// the registration of an existing account, so the existing one is kept.
+// Expiration is unknown if validUntil is nil.
+func (t *Tx) InsertAccount(ctx context.Context, ch models.Change, a *account.RegisterAccountMsg, validUntil *time.Time) error {
+	var accountID int64
+	err := t.tx.QueryRowContext(ctx, `
+		INSERT INTO accounts(domain, name, owner, broker, valid_until)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (domain, name) WHERE deleted_at IS NULL DO NOTHING
+		RETURNING id
+	`, a.Domain, a.Name, a.Owner.String(), addressValue(a.Broker), validUntil).Scan(&accountID)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return wrapPgErr(err, "insert account")
+	}
+
+	for _, target := range a.Targets {
+		_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO account_targets (account_id, blockchain_id, address)
+		VALUES ($1, $2, $3)
+		`, accountID, target.BlockchainID, target.Address)
+		if err != nil {
+			return wrapPgErr(err, "insert account targets")
+		}
+	}
+	return t.recordAccounts(ctx, ch, []int64{accountID})
+}
+
+// ReplaceAccountTargets sets new targets of an existing account. Unknown
+// accounts are ignored.
+func (t *Tx) ReplaceAccountTargets(ctx context.Context, ch models.Change, a *account.ReplaceAccountTargetsMsg) error {
+	var accountID int64
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT id FROM accounts WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+	`, a.Domain, a.Name).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return wrapPgErr(err, "cannot get account ID")
+	}
+
+	if _, err := t.tx.ExecContext(ctx, `DELETE FROM account_targets WHERE account_id = $1`, accountID); err != nil {
+		return wrapPgErr(err, "delete account targets")
+	}
+
+	for _, target := range a.NewTargets {
+		_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO account_targets (account_id, blockchain_id, address)
+		VALUES ($1, $2, $3)
+		`, accountID, target.BlockchainID, target.Address)
+		if err != nil {
+			return wrapPgErr(err, "insert account targets")
+		}
+	}
+	return t.recordAccounts(ctx, ch, []int64{accountID})
+}
+
+// TransferAccount changes the owner of an account. Same as the account
+// module does, targets and certificates of the account are removed.
+func (t *Tx) TransferAccount(ctx context.Context, ch models.Change, domain, name string, newOwner weave.Address) error {
+	_, err := t.tx.ExecContext(ctx, `
+		DELETE FROM account_targets
+		WHERE account_id IN (
+			SELECT id FROM accounts WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+		)
+	`, domain, name)
+	if err != nil {
+		return wrapPgErr(err, "delete account targets")
+	}
+	ids, err := t.queryIDs(ctx, `
+		UPDATE accounts SET owner = $3, certificates = NULL
+		WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, name, newOwner.String())
+	if err != nil {
+		return errors.Wrap(err, "update account")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// RenewAccount sets a new expiration time of an account. The renewal is
+// recorded together with the previous expiration time.
+func (t *Tx) RenewAccount(ctx context.Context, ch models.Change, domain, name string, validUntil *time.Time) error {
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO renewals (`+renewalColumns+`)
+		SELECT $3, $4, $5, $6, domain, name, valid_until, $7
+		FROM accounts
+		WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+	`, domain, name, ch.Height, nullTime(ch.Time), nullString(ch.TxHash), nullString(ch.MsgPath), validUntil)
+	if err != nil {
+		return wrapPgErr(err, "insert renewal")
+	}
+	ids, err := t.queryIDs(ctx, `
+		UPDATE accounts SET valid_until = $3
+		WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, name, validUntil)
+	if err != nil {
+		return errors.Wrap(err, "update account")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// DeleteAccount marks an account as deleted at the time of the change.
+func (t *Tx) DeleteAccount(ctx context.Context, ch models.Change, domain, name string) error {
+	ids, err := t.queryIDs(ctx, `
+		UPDATE accounts SET deleted_at = $3
+		WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, name, ch.Time.UTC())
+	if err != nil {
+		return errors.Wrap(err, "delete account")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// AddAccountCertificate appends a certificate to an account.
+func (t *Tx) AddAccountCertificate(ctx context.Context, ch models.Change, domain, name string, cert []byte) error {
+	ids, err := t.queryIDs(ctx, `
+		UPDATE accounts SET certificates = array_append(certificates, $3)
+		WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+		RETURNING id
+	`, domain, name, cert)
+	if err != nil {
+		return errors.Wrap(err, "update account")
+	}
+	return t.recordAccounts(ctx, ch, ids)
+}
+
+// DeleteAccountCertificate removes the certificate with given sha256 hash
+// from an account.
+func (t *Tx) DeleteAccountCertificate(ctx context.Context, ch models.Change, domain, name string, certHash []byte) error {
+	var (
+		accountID int64
+		certs     pq.ByteaArray
+	)
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT id, certificates FROM accounts
+		WHERE domain = $1 AND name = $2 AND deleted_at IS NULL
+		FOR UPDATE
+	`, domain, name).Scan(&accountID, &certs)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return wrapPgErr(err, "cannot select account")
+	}
+
+	var remaining pq.ByteaArray
+	for _, c := range certs {
+		if sum := sha256.Sum256(c); !bytes.Equal(sum[:], certHash) {
+			remaining = append(remaining, c)
+		}
+	}
+	_, err = t.tx.ExecContext(ctx, `
+		UPDATE accounts SET certificates = $2 WHERE id = $1
+	`, accountID, remaining)
+	if err != nil {
+		return wrapPgErr(err, "update account")
+	}
+	return t.recordAccounts(ctx, ch, []int64{accountID})
+}
+
+// addressValue returns the column value of an optional address.
+func addressValue(a weave.Address) interface{} {
+	if len(a) == 0 {
+		return nil
+	}
+	return a.String()
+}
+
+// nullString returns the column value of an optional string.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// seconds returns the column value of a duration, stored in seconds.
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+	"github.com/lib/pq"
+)
+
+// SaveEscrow records an escrow event of given kind, with the state of the
+// escrow after the event. The current state is updated unless a later event
+// of the escrow is already recorded, which happens when a block is
+// reindexed.
+func (t *Tx) SaveEscrow(ctx context.Context, ch models.Change, kind string, moved []models.Coin, e models.Escrow) error {
+	amount, err := coinsValue(e.Amount)
+	if err != nil {
+		return errors.Wrap(err, "amount")
+	}
+	movedAmount, err := coinsValue(moved)
+	if err != nil {
+		return errors.Wrap(err, "moved amount")
+	}
+
+	_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO escrows (id, address, source, arbiter, destination, amount, timeout, memo, state, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET
+			address = EXCLUDED.address,
+			source = EXCLUDED.source,
+			arbiter = EXCLUDED.arbiter,
+			destination = EXCLUDED.destination,
+			amount = EXCLUDED.amount,
+			timeout = EXCLUDED.timeout,
+			memo = EXCLUDED.memo,
+			state = EXCLUDED.state,
+			height = EXCLUDED.height
+		WHERE escrows.height <= EXCLUDED.height
+	`, e.ID, e.Address, e.Source, e.Arbiter, e.Destination, amount, e.Timeout.UTC(),
+		nullString(e.Memo), e.State, ch.Height)
+	if err != nil {
+		return wrapPgErr(err, "upsert escrow")
+	}
+
+	_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO escrow_events (escrow_id, height, block_time, transaction_hash, msg_path,
+			kind, moved, source, arbiter, destination, amount, state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`, e.ID, ch.Height, nullTime(ch.Time), nullString(ch.TxHash), nullString(ch.MsgPath),
+		kind, movedAmount, e.Source, e.Arbiter, e.Destination, amount, e.State)
+	return wrapPgErr(err, "insert escrow event")
+}
+
+// coinsValue returns the JSONB value of a list of coins.
+func coinsValue(coins []models.Coin) (interface{}, error) {
+	if coins == nil {
+		coins = []models.Coin{}
+	}
+	raw, err := json.Marshal(coins)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal coins")
+	}
+	return jsonValue(raw), nil
+}
+
+// EscrowAt returns the state of an escrow after all events up to given
+// height, including that height. ErrNotFound is returned if the escrow did
+// not exist at that height.
+func (t *Tx) EscrowAt(ctx context.Context, id []byte, height int64) (*models.Escrow, error) {
+	return escrowAt(ctx, t.tx, id, height)
+}
+
+// EscrowAt returns the state of an escrow after all events up to given
+// height, including that height. ErrNotFound is returned if the escrow did
+// not exist at that height.
+func (s *Store) EscrowAt(ctx context.Context, id []byte, height int64) (*models.Escrow, error) {
+	return escrowAt(ctx, s.db, id, height)
+}
+
+func escrowAt(ctx context.Context, q querier, id []byte, height int64) (*models.Escrow, error) {
+	e, err := scanEscrow(q.QueryRowContext(ctx, `
+		SELECT escrows.id, escrows.address, ev.source, ev.arbiter, ev.destination,
+			ev.amount, escrows.timeout, escrows.memo, ev.state
+		FROM escrow_events ev
+			JOIN escrows ON escrows.id = ev.escrow_id
+		WHERE ev.escrow_id = $1 AND ev.height <= $2
+		ORDER BY ev.height DESC, ev.id DESC
+		LIMIT 1
+	`, id, height))
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot load escrow")
+	}
+	return &e, nil
+}
+
+// LoadEscrow returns the current state of an escrow. ErrNotFound is returned
+// if it does not exist.
+func (s *Store) LoadEscrow(ctx context.Context, id []byte) (*models.Escrow, error) {
+	e, err := scanEscrow(s.db.QueryRowContext(ctx, `
+		SELECT `+escrowColumns+`
+		FROM escrows
+		WHERE id = $1
+	`, id))
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot load escrow")
+	}
+	return &e, nil
+}
+
+const escrowColumns = `id, address, source, arbiter, destination, amount, timeout, memo, state`
+
+func scanEscrow(row interface{ Scan(...interface{}) error }) (models.Escrow, error) {
+	var (
+		e      models.Escrow
+		amount []byte
+		memo   sql.NullString
+	)
+	err := row.Scan(&e.ID, &e.Address, &e.Source, &e.Arbiter, &e.Destination,
+		&amount, &e.Timeout, &memo, &e.State)
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(amount, &e.Amount); err != nil {
+		return e, errors.Wrap(err, "cannot unmarshal amount")
+	}
+	e.Timeout = e.Timeout.UTC()
+	e.Memo = memo.String
+	return e, nil
+}
+
+// OpenEscrows returns escrows that were neither released nor returned, and
+// given address is the source, the arbiter or the destination of, ordered by
+// ID. Pass the last escrow of a page as after to select the next page.
+// ErrLimit is returned if the limit exceeds 100. ErrNotFound is returned if
+// no escrow was found.
+func (s *Store) OpenEscrows(ctx context.Context, party string, after *models.Escrow, limit int) ([]models.Escrow, error) {
+	query := sq.Select(escrowColumns).
+		From("escrows").
+		Where("state = 'open'").
+		Where("(source = ? OR arbiter = ? OR destination = ?)", party, party, party).
+		OrderBy("id")
+	if after != nil {
+		query = query.Where("id > ?", after.ID)
+	}
+	return s.loadEscrows(ctx, query, limit)
+}
+
+// ExpiredEscrows returns escrows that timed out at given time but were
+// neither released nor returned, ordered by timeout and ID. Funds of such
+// escrows can only be returned to the source. Pagination and errors are the
+// same as for OpenEscrows.
+func (s *Store) ExpiredEscrows(ctx context.Context, at time.Time, after *models.Escrow, limit int) ([]models.Escrow, error) {
+	query := sq.Select(escrowColumns).
+		From("escrows").
+		Where("state = 'open'").
+		Where("timeout <= ?", at.UTC()).
+		OrderBy("timeout", "id")
+	if after != nil {
+		query = query.Where("(timeout, id) > (?, ?)", after.Timeout.UTC(), after.ID)
+	}
+	return s.loadEscrows(ctx, query, limit)
+}
+
+func (s *Store) loadEscrows(ctx context.Context, query sq.SelectBuilder, limit int) ([]models.Escrow, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+	rows, err := query.
+		PlaceholderFormat(sq.Dollar).
+		Limit(uint64(limit)).
+		RunWith(s.db).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select escrows")
+	}
+	defer rows.Close()
+
+	var escrows []models.Escrow
+	for rows.Next() {
+		e, err := scanEscrow(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan escrow")
+		}
+		escrows = append(escrows, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning escrows")
+	}
+
+	if len(escrows) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no escrows")
+	}
+	return escrows, nil
+}
+
+// EscrowEvents returns all events of an escrow, oldest first. ErrNotFound is
+// returned if the escrow has no events.
+func (s *Store) EscrowEvents(ctx context.Context, id []byte) ([]models.EscrowEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ev.id, ev.height, ev.block_time, ev.transaction_hash, ev.msg_path, ev.kind, ev.moved,
+			escrows.id, escrows.address, ev.source, ev.arbiter, ev.destination,
+			ev.amount, escrows.timeout, escrows.memo, ev.state
+		FROM escrow_events ev
+			JOIN escrows ON escrows.id = ev.escrow_id
+		WHERE ev.escrow_id = $1
+		ORDER BY ev.height, ev.id
+	`, id)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select escrow events")
+	}
+	defer rows.Close()
+
+	var events []models.EscrowEvent
+	for rows.Next() {
+		ev, err := scanEscrowEvent(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan escrow event")
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning escrow events")
+	}
+
+	if len(events) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no escrow events")
+	}
+	return events, nil
+}
+
+func scanEscrowEvent(row interface{ Scan(...interface{}) error }) (models.EscrowEvent, error) {
+	var (
+		ev                 models.EscrowEvent
+		blockTime          pq.NullTime
+		txHash, path, memo sql.NullString
+		moved, amount      []byte
+	)
+	err := row.Scan(&ev.ID, &ev.Height, &blockTime, &txHash, &path, &ev.Kind, &moved,
+		&ev.Escrow.ID, &ev.Escrow.Address, &ev.Escrow.Source, &ev.Escrow.Arbiter, &ev.Escrow.Destination,
+		&amount, &ev.Escrow.Timeout, &memo, &ev.Escrow.State)
+	if err != nil {
+		return ev, err
+	}
+	if err := json.Unmarshal(moved, &ev.Moved); err != nil {
+		return ev, errors.Wrap(err, "cannot unmarshal moved amount")
+	}
+	if err := json.Unmarshal(amount, &ev.Escrow.Amount); err != nil {
+		return ev, errors.Wrap(err, "cannot unmarshal amount")
+	}
+	if blockTime.Valid {
+		ev.Time = blockTime.Time.UTC()
+	}
+	ev.TxHash = txHash.String
+	ev.MsgPath = path.String
+	ev.Escrow.Timeout = ev.Escrow.Timeout.UTC()
+	ev.Escrow.Memo = memo.String
+	return ev, nil
+}
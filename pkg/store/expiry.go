@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+	"github.com/lib/pq"
+)
+
+// Domains and accounts which expiration is not known are never returned as
+// expiring or expired.
+
+// ExpiringDomains returns existing domains that expire within given time
+// range, including from and excluding to, ordered by expiration time and
+// name. Pass the last domain of a page as after to select the next page.
+// ErrLimit is returned if the limit exceeds 100. ErrNotFound is returned if
+// no domain was found.
+func (s *Store) ExpiringDomains(ctx context.Context, from, to time.Time, after *models.Domain, limit int) ([]models.Domain, error) {
+	query := sq.Select(domainColumns).
+		From("domains").
+		Where("deleted_at IS NULL").
+		Where("valid_until >= ? AND valid_until < ?", from.UTC(), to.UTC()).
+		OrderBy("valid_until", "domain")
+	if after != nil && after.ValidUntil != nil {
+		query = query.Where("(valid_until, domain) > (?, ?)", after.ValidUntil.UTC(), after.Domain)
+	}
+	return s.loadDomains(ctx, query, limit)
+}
+
+// ExpiredDomains returns domains that expired before given time but were not
+// deleted, ordered by expiration time and name. Pagination and errors are
+// the same as for ExpiringDomains.
+func (s *Store) ExpiredDomains(ctx context.Context, at time.Time, after *models.Domain, limit int) ([]models.Domain, error) {
+	query := sq.Select(domainColumns).
+		From("domains").
+		Where("deleted_at IS NULL").
+		Where("valid_until < ?", at.UTC()).
+		OrderBy("valid_until", "domain")
+	if after != nil && after.ValidUntil != nil {
+		query = query.Where("(valid_until, domain) > (?, ?)", after.ValidUntil.UTC(), after.Domain)
+	}
+	return s.loadDomains(ctx, query, limit)
+}
+
+func (s *Store) loadDomains(ctx context.Context, query sq.SelectBuilder, limit int) ([]models.Domain, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+	rows, err := query.
+		PlaceholderFormat(sq.Dollar).
+		Limit(uint64(limit)).
+		RunWith(s.db).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select domains")
+	}
+	defer rows.Close()
+
+	var domains []models.Domain
+	for rows.Next() {
+		d, err := scanDomain(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan domain")
+		}
+		domains = append(domains, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning domains")
+	}
+
+	if len(domains) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no domains")
+	}
+	return domains, nil
+}
+
+// ExpiringAccounts returns existing accounts that expire within given time
+// range, including from and excluding to, ordered by expiration time, domain
+// and name. Pass the last account of a page as after to select the next
+// page. ErrLimit is returned if the limit exceeds 100. ErrNotFound is
+// returned if no account was found.
+func (s *Store) ExpiringAccounts(ctx context.Context, from, to time.Time, after *models.Account, limit int) ([]models.Account, error) {
+	query := sq.Select(accountColumns).
+		From("accounts").
+		Where("deleted_at IS NULL").
+		Where("valid_until >= ? AND valid_until < ?", from.UTC(), to.UTC()).
+		OrderBy("valid_until", "domain", "name")
+	if after != nil && after.ValidUntil != nil {
+		query = query.Where("(valid_until, domain, name) > (?, ?, ?)", after.ValidUntil.UTC(), after.Domain, after.Name)
+	}
+	return s.loadAccounts(ctx, query, limit)
+}
+
+// ExpiredAccounts returns accounts that expired before given time but were
+// not deleted, ordered by expiration time, domain and name. Pagination and
+// errors are the same as for ExpiringAccounts.
+func (s *Store) ExpiredAccounts(ctx context.Context, at time.Time, after *models.Account, limit int) ([]models.Account, error) {
+	query := sq.Select(accountColumns).
+		From("accounts").
+		Where("deleted_at IS NULL").
+		Where("valid_until < ?", at.UTC()).
+		OrderBy("valid_until", "domain", "name")
+	if after != nil && after.ValidUntil != nil {
+		query = query.Where("(valid_until, domain, name) > (?, ?, ?)", after.ValidUntil.UTC(), after.Domain, after.Name)
+	}
+	return s.loadAccounts(ctx, query, limit)
+}
+
+func (s *Store) loadAccounts(ctx context.Context, query sq.SelectBuilder, limit int) ([]models.Account, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+	rows, err := query.
+		PlaceholderFormat(sq.Dollar).
+		Limit(uint64(limit)).
+		RunWith(s.db).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select accounts")
+	}
+	defer rows.Close()
+
+	var accounts []models.Account
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan account")
+		}
+		accounts = append(accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning accounts")
+	}
+
+	if len(accounts) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no accounts")
+	}
+	return accounts, nil
+}
+
+const renewalColumns = `height, block_time, transaction_hash, msg_path,
+	domain, name, previous_valid_until, valid_until`
+
+// DomainRenewals returns all renewals of a domain and of its accounts,
+// oldest first. ErrNotFound is returned if there are none.
+func (s *Store) DomainRenewals(ctx context.Context, domain string) ([]models.Renewal, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+renewalColumns+`
+		FROM renewals
+		WHERE domain = $1
+		ORDER BY height, id
+	`, domain)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select renewals")
+	}
+	defer rows.Close()
+
+	var renewals []models.Renewal
+	for rows.Next() {
+		var (
+			r                  models.Renewal
+			blockTime          pq.NullTime
+			txHash, path, name sql.NullString
+		)
+		err := rows.Scan(&r.Height, &blockTime, &txHash, &path,
+			&r.Domain, &name, &r.PreviousValidUntil, &r.ValidUntil)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan renewal")
+		}
+		if blockTime.Valid {
+			r.Time = blockTime.Time.UTC()
+		}
+		r.TxHash = txHash.String
+		r.MsgPath = path.String
+		if name.Valid {
+			r.Name = &name.String
+		}
+		r.PreviousValidUntil = utcTime(r.PreviousValidUntil)
+		r.ValidUntil = utcTime(r.ValidUntil)
+		renewals = append(renewals, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning renewals")
+	}
+
+	if len(renewals) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no renewals")
+	}
+	return renewals, nil
+}
@@ -0,0 +1,368 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+	"github.com/lib/pq"
+)
+
+// History of domains and accounts is append-only. Every change appends a
+// full copy of the state after the change, so that the state as of any
+// height is a single row. State known before history was recorded is
+// stored at height zero.
+
+const (
+	accountHistoryColumns = `height, block_time, transaction_hash, msg_path,
+		domain, name, owner, broker, valid_until, certificates, targets, deleted`
+	domainHistoryColumns = `height, block_time, transaction_hash, msg_path,
+		domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until, deleted`
+)
+
+// queryIDs executes a statement returning IDs of modified rows.
+func (t *Tx) queryIDs(ctx context.Context, query string, args ...interface{}) ([]int64, error) {
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapPgErr(err, "query")
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, wrapPgErr(err, "scan id")
+		}
+		ids = append(ids, id)
+	}
+	return ids, wrapPgErr(rows.Err(), "scanning ids")
+}
+
+// recordDomains appends the current state of given domains to their
+// history.
+func (t *Tx) recordDomains(ctx context.Context, ch models.Change, domainIDs []int64) error {
+	if len(domainIDs) == 0 {
+		return nil
+	}
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO domain_history (`+domainHistoryColumns+`)
+		SELECT $2, $3, $4, $5,
+			domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until,
+			deleted_at IS NOT NULL
+		FROM domains
+		WHERE id = ANY($1)
+		ORDER BY id
+	`, pq.Int64Array(domainIDs), ch.Height, nullTime(ch.Time), nullString(ch.TxHash), nullString(ch.MsgPath))
+	return wrapPgErr(err, "insert domain history")
+}
+
+// recordAccounts appends the current state of given accounts, including
+// their targets, to their history.
+func (t *Tx) recordAccounts(ctx context.Context, ch models.Change, accountIDs []int64) error {
+	if len(accountIDs) == 0 {
+		return nil
+	}
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO account_history (`+accountHistoryColumns+`)
+		SELECT $2, $3, $4, $5,
+			domain, name, owner, broker, valid_until, certificates,
+			COALESCE((
+				SELECT jsonb_agg(jsonb_build_object(
+					'blockchain_id', account_targets.blockchain_id,
+					'address', account_targets.address
+				) ORDER BY account_targets.id)
+				FROM account_targets
+				WHERE account_targets.account_id = accounts.id
+			), '[]'),
+			deleted_at IS NOT NULL
+		FROM accounts
+		WHERE id = ANY($1)
+		ORDER BY id
+	`, pq.Int64Array(accountIDs), ch.Height, nullTime(ch.Time), nullString(ch.TxHash), nullString(ch.MsgPath))
+	return wrapPgErr(err, "insert account history")
+}
+
+// RewindAccounts restores domains and accounts changed after given height
+// to their state as of that height, using their history. History and
+// renewals recorded after that height are removed. Domains and accounts
+// deleted at or before that height are left unchanged.
+func (t *Tx) RewindAccounts(ctx context.Context, height int64) error {
+	// A row was changed after the height unless it was deleted by then.
+	const changed = `(deleted_at IS NULL OR deleted_at > COALESCE(
+		(SELECT block_time FROM blocks WHERE block_height = $1), '-infinity'))`
+
+	_, err := t.tx.ExecContext(ctx, `
+		DELETE FROM account_targets
+		WHERE account_id IN (
+			SELECT id FROM accounts
+			WHERE (domain, name) IN (SELECT domain, name FROM account_history WHERE height > $1)
+				AND `+changed+`
+		)
+	`, height)
+	if err != nil {
+		return wrapPgErr(err, "delete account targets")
+	}
+	_, err = t.tx.ExecContext(ctx, `
+		DELETE FROM accounts
+		WHERE (domain, name) IN (SELECT domain, name FROM account_history WHERE height > $1)
+			AND `+changed+`
+	`, height)
+	if err != nil {
+		return wrapPgErr(err, "delete accounts")
+	}
+	_, err = t.tx.ExecContext(ctx, `
+		DELETE FROM domains
+		WHERE domain IN (SELECT domain FROM domain_history WHERE height > $1)
+			AND `+changed+`
+	`, height)
+	if err != nil {
+		return wrapPgErr(err, "delete domains")
+	}
+
+	_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO domains (domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until)
+		SELECT domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until
+		FROM (
+			SELECT DISTINCT ON (domain) *
+			FROM domain_history
+			WHERE height <= $1 AND domain IN (SELECT domain FROM domain_history WHERE height > $1)
+			ORDER BY domain, height DESC, id DESC
+		) h
+		WHERE NOT deleted
+		ORDER BY id
+	`, height)
+	if err != nil {
+		return wrapPgErr(err, "restore domains")
+	}
+	const versions = `
+		SELECT DISTINCT ON (domain, name) *
+		FROM account_history
+		WHERE height <= $1 AND (domain, name) IN (
+			SELECT domain, name FROM account_history WHERE height > $1
+		)
+		ORDER BY domain, name, height DESC, id DESC`
+	_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO accounts (domain, name, owner, broker, valid_until, certificates)
+		SELECT domain, name, owner, broker, valid_until, certificates
+		FROM (`+versions+`) h
+		WHERE NOT deleted
+		ORDER BY id
+	`, height)
+	if err != nil {
+		return wrapPgErr(err, "restore accounts")
+	}
+	// Accounts of the restored versions are the only ones left that were
+	// changed after the height.
+	_, err = t.tx.ExecContext(ctx, `
+		INSERT INTO account_targets (account_id, blockchain_id, address)
+		SELECT accounts.id, t.target->>'blockchain_id', t.target->>'address'
+		FROM (`+versions+`) h
+			JOIN accounts ON accounts.domain = h.domain AND accounts.name = h.name
+				AND accounts.deleted_at IS NULL
+			CROSS JOIN jsonb_array_elements(h.targets) WITH ORDINALITY AS t(target, n)
+		WHERE NOT h.deleted
+		ORDER BY accounts.id, t.n
+	`, height)
+	if err != nil {
+		return wrapPgErr(err, "restore account targets")
+	}
+
+	for _, table := range []string{"account_history", "domain_history", "renewals"} {
+		if _, err := t.tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE height > $1`, height); err != nil {
+			return wrapPgErr(err, "delete "+table)
+		}
+	}
+	return nil
+}
+
+// AccountAt returns the state of an account as of given height, including
+// changes done at that height. ErrNotFound is returned if the account did
+// not exist at that height.
+func (s *Store) AccountAt(ctx context.Context, domain, name string, height int64) (*models.AccountVersion, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT `+accountHistoryColumns+`
+		FROM account_history
+		WHERE domain = $1 AND name = $2 AND height <= $3
+		ORDER BY height DESC, id DESC
+		LIMIT 1
+	`, domain, name, height)
+	v, err := scanAccountVersion(row)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot load account")
+	}
+	if v.Deleted {
+		return nil, errors.Wrapf(errors.ErrNotFound, "account deleted at height %d", v.Height)
+	}
+	return &v, nil
+}
+
+// AccountHistory returns all changes of an account, oldest first.
+// ErrNotFound is returned if the account was never registered.
+func (s *Store) AccountHistory(ctx context.Context, domain, name string) ([]models.AccountVersion, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+accountHistoryColumns+`
+		FROM account_history
+		WHERE domain = $1 AND name = $2
+		ORDER BY height, id
+	`, domain, name)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select account history")
+	}
+	defer rows.Close()
+
+	var versions []models.AccountVersion
+	for rows.Next() {
+		v, err := scanAccountVersion(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "scan account history")
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning account history")
+	}
+	if len(versions) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no account history")
+	}
+	return versions, nil
+}
+
+func scanAccountVersion(row interface{ Scan(...interface{}) error }) (models.AccountVersion, error) {
+	var (
+		v                    models.AccountVersion
+		blockTime            pq.NullTime
+		txHash, path, broker sql.NullString
+		certs                pq.ByteaArray
+		targets              []byte
+	)
+	err := row.Scan(&v.Height, &blockTime, &txHash, &path,
+		&v.Domain, &v.Name, &v.Owner, &broker, &v.ValidUntil, &certs, &targets, &v.Deleted)
+	if err != nil {
+		return v, err
+	}
+	if blockTime.Valid {
+		v.Change.Time = blockTime.Time.UTC()
+	}
+	v.TxHash = txHash.String
+	v.MsgPath = path.String
+	v.Broker = broker.String
+	v.ValidUntil = utcTime(v.ValidUntil)
+	if len(certs) != 0 {
+		v.Certificates = certs
+	}
+	if err := json.Unmarshal(targets, &v.Targets); err != nil {
+		return v, errors.Wrap(err, "targets")
+	}
+	return v, nil
+}
+
+// DomainAt returns the state of a domain as of given height, including
+// changes done at that height. ErrNotFound is returned if the domain did not
+// exist at that height.
+func (s *Store) DomainAt(ctx context.Context, domain string, height int64) (*models.DomainVersion, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT `+domainHistoryColumns+`
+		FROM domain_history
+		WHERE domain = $1 AND height <= $2
+		ORDER BY height DESC, id DESC
+		LIMIT 1
+	`, domain, height)
+	v, err := scanDomainVersion(row)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot load domain")
+	}
+	if v.Deleted {
+		return nil, errors.Wrapf(errors.ErrNotFound, "domain deleted at height %d", v.Height)
+	}
+	return &v, nil
+}
+
+// DomainHistory returns all changes of a domain, oldest first. ErrNotFound
+// is returned if the domain was never registered.
+func (s *Store) DomainHistory(ctx context.Context, domain string) ([]models.DomainVersion, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+domainHistoryColumns+`
+		FROM domain_history
+		WHERE domain = $1
+		ORDER BY height, id
+	`, domain)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select domain history")
+	}
+	defer rows.Close()
+
+	var versions []models.DomainVersion
+	for rows.Next() {
+		v, err := scanDomainVersion(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "scan domain history")
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning domain history")
+	}
+	if len(versions) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no domain history")
+	}
+	return versions, nil
+}
+
+func scanDomainVersion(row interface{ Scan(...interface{}) error }) (models.DomainVersion, error) {
+	var (
+		v                    models.DomainVersion
+		blockTime            pq.NullTime
+		txHash, path, broker sql.NullString
+		accountRenew         int64
+		msgFees              []byte
+	)
+	err := row.Scan(&v.Height, &blockTime, &txHash, &path,
+		&v.Domain.Domain, &v.Admin, &broker, &v.HasSuperuser, &accountRenew, &msgFees, &v.ValidUntil, &v.Deleted)
+	if err != nil {
+		return v, err
+	}
+	if blockTime.Valid {
+		v.Change.Time = blockTime.Time.UTC()
+	}
+	v.TxHash = txHash.String
+	v.MsgPath = path.String
+	v.Broker = broker.String
+	v.AccountRenew = time.Duration(accountRenew) * time.Second
+	v.MsgFees = msgFees
+	v.ValidUntil = utcTime(v.ValidUntil)
+	return v, nil
+}
+
+// HeightAt returns the height of the last block created at or before given
+// time. ErrNotFound is returned if there is no such block.
+func (s *Store) HeightAt(ctx context.Context, t time.Time) (int64, error) {
+	var height int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT block_height FROM blocks
+		WHERE block_time <= $1
+		ORDER BY block_time DESC, block_height DESC
+		LIMIT 1
+	`, t.UTC()).Scan(&height)
+	return height, wrapPgErr(err, "cannot select block")
+}
+
+// nullTime returns the column value of an optional time.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// utcTime returns an optional time in UTC.
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
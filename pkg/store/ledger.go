@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+	"github.com/lib/pq"
+)
+
+// InsertLedgerEntries appends given balance changes to the ledger.
+func (t *Tx) InsertLedgerEntries(ctx context.Context, entries []models.LedgerEntry) error {
+	rows := make([][]interface{}, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, []interface{}{
+			e.Height, nullTime(e.Time), nullString(e.TxHash), nullString(e.MsgPath),
+			e.Address, e.Ticker, e.Whole, e.Fractional, e.Kind, nullString(e.Counterparty),
+		})
+	}
+	columns := []string{"height", "block_time", "transaction_hash", "msg_path",
+		"address", "ticker", "whole", "fractional", "kind", "counterparty"}
+	return errors.Wrap(t.copyIn(ctx, "ledger_entries", columns, rows), "insert ledger entries")
+}
+
+// The configuration of the cash module is recorded with the height it is
+// known from, the same way the account module configuration is.
+
+// CashConfigurationAt returns the configuration of the cash module as of
+// given height, including changes done at that height. ErrNotFound is
+// returned if it is not known at that height.
+func (t *Tx) CashConfigurationAt(ctx context.Context, height int64) (*models.CashConfiguration, error) {
+	var (
+		c      models.CashConfiguration
+		ticker sql.NullString
+	)
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT minimal_fee_ticker, minimal_fee_whole, minimal_fee_fractional
+		FROM cash_configuration
+		WHERE height <= $1
+		ORDER BY height DESC, id DESC
+		LIMIT 1
+	`, height).Scan(&ticker, &c.MinimalFee.Whole, &c.MinimalFee.Fractional)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select cash configuration")
+	}
+	c.MinimalFee.Ticker = ticker.String
+	return &c, nil
+}
+
+// SetCashConfiguration records the configuration of the cash module set by
+// given change.
+func (t *Tx) SetCashConfiguration(ctx context.Context, ch models.Change, c models.CashConfiguration) error {
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO cash_configuration (height, transaction_hash, minimal_fee_ticker, minimal_fee_whole, minimal_fee_fractional)
+		VALUES ($1, $2, $3, $4, $5)
+	`, ch.Height, nullString(ch.TxHash), nullString(c.MinimalFee.Ticker), c.MinimalFee.Whole, c.MinimalFee.Fractional)
+	return wrapPgErr(err, "set cash configuration")
+}
+
+// InitCashConfiguration records the configuration of the cash module as of
+// given height, unless a configuration is already recorded at that height.
+// It is used to provide the configuration read from the chain, at the height
+// it was read at.
+func (s *Store) InitCashConfiguration(ctx context.Context, height int64, c models.CashConfiguration) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO cash_configuration (height, minimal_fee_ticker, minimal_fee_whole, minimal_fee_fractional)
+		SELECT $1::BIGINT, $2::TEXT, $3::BIGINT, $4::BIGINT
+		WHERE NOT EXISTS (SELECT 1 FROM cash_configuration WHERE height = $1)
+	`, height, nullString(c.MinimalFee.Ticker), c.MinimalFee.Whole, c.MinimalFee.Fractional)
+	return wrapPgErr(err, "init cash configuration")
+}
+
+// BalanceAt returns the balance of an address as of given height, same as
+// the Store method does. Changes inserted within the transaction are
+// included.
+func (t *Tx) BalanceAt(ctx context.Context, address string, height int64) ([]models.Balance, error) {
+	return balanceAt(ctx, t.tx, address, height)
+}
+
+// BalanceAt returns the balance of an address as of given height, including
+// changes done at that height, one per ticker. Balances are sums of all
+// ledger entries, so that funds received before the synchronization started
+// are not included. ErrNotFound is returned if the address has no entries.
+//
+// Only cash sends, escrows, term deposits and fees paid are recorded.
+// Movements that are not tracked include atomic swaps, distribution revenue
+// payouts, messages executed by governance proposals or scheduled tasks
+// instead of transactions, and fees credited to the fee collector.
+func (s *Store) BalanceAt(ctx context.Context, address string, height int64) ([]models.Balance, error) {
+	return balanceAt(ctx, s.db, address, height)
+}
+
+func balanceAt(ctx context.Context, q querier, address string, height int64) ([]models.Balance, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT ticker,
+			trunc(total / 1000000000)::BIGINT,
+			(total % 1000000000)::BIGINT
+		FROM (
+			SELECT ticker, SUM(whole::NUMERIC * 1000000000 + fractional) AS total
+			FROM ledger_entries
+			WHERE address = $1 AND height <= $2
+			GROUP BY ticker
+		) totals
+		ORDER BY ticker
+	`, address, height)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select balances")
+	}
+	defer rows.Close()
+
+	var balances []models.Balance
+	for rows.Next() {
+		b := models.Balance{Address: address}
+		if err := rows.Scan(&b.Ticker, &b.Whole, &b.Fractional); err != nil {
+			return nil, wrapPgErr(err, "cannot scan balance")
+		}
+		balances = append(balances, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning balances")
+	}
+
+	if len(balances) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no ledger entries")
+	}
+	return balances, nil
+}
+
+// LedgerCounterparty returns the counterparty of the first ledger entry of
+// given kind that changed the balance of an address. ErrNotFound is returned
+// if there is no such entry.
+func (t *Tx) LedgerCounterparty(ctx context.Context, address, kind string) (string, error) {
+	var counterparty sql.NullString
+	err := t.tx.QueryRowContext(ctx, `
+		SELECT counterparty
+		FROM ledger_entries
+		WHERE address = $1 AND kind = $2
+		ORDER BY height, id
+		LIMIT 1
+	`, address, kind).Scan(&counterparty)
+	if err != nil {
+		return "", wrapPgErr(err, "cannot select ledger entry")
+	}
+	return counterparty.String, nil
+}
+
+// Statement returns ledger entries of an address, oldest first. Pass the
+// last entry of a page as after to select the next page. ErrLimit is
+// returned if the limit exceeds 100. ErrNotFound is returned if no entry was
+// found.
+func (s *Store) Statement(ctx context.Context, address string, after *models.LedgerEntry, limit int) ([]models.LedgerEntry, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+	var afterHeight, afterID int64
+	if after != nil {
+		afterHeight, afterID = after.Height, after.ID
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, height, block_time, transaction_hash, msg_path,
+			address, ticker, whole, fractional, kind, counterparty
+		FROM ledger_entries
+		WHERE address = $1 AND (height, id) > ($2, $3)
+		ORDER BY height, id
+		LIMIT $4
+	`, address, afterHeight, afterID, limit)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select ledger entries")
+	}
+	defer rows.Close()
+
+	var entries []models.LedgerEntry
+	for rows.Next() {
+		var (
+			e                          models.LedgerEntry
+			blockTime                  pq.NullTime
+			txHash, path, counterparty sql.NullString
+		)
+		err := rows.Scan(&e.ID, &e.Height, &blockTime, &txHash, &path,
+			&e.Address, &e.Ticker, &e.Whole, &e.Fractional, &e.Kind, &counterparty)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan ledger entry")
+		}
+		if blockTime.Valid {
+			e.Time = blockTime.Time.UTC()
+		}
+		e.TxHash = txHash.String
+		e.MsgPath = path.String
+		e.Counterparty = counterparty.String
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning ledger entries")
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no ledger entries")
+	}
+	return entries, nil
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/iov-one/weave/errors"
+)
+
+// migration is a single, versioned schema change.
+type migration struct {
+	Version int
+	Name    string
+	Query   string
+}
+
+// migrationLockID is the advisory lock key that serializes migrations of
+// concurrently starting collectors.
+const migrationLockID = 0x626c6f636b6d6574
+
+// MigrationStatus describes a known migration.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// AppliedAt is zero if the migration was not applied yet.
+	AppliedAt time.Time
+}
+
+// Applied returns true if the migration was applied.
+func (m *MigrationStatus) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+// Migrate applies all pending migrations in version order, within a single
+// database transaction. It returns the status of each migration applied. An
+// advisory lock is held for the duration of the transaction, so that only one
+// process is migrating the database at a time.
+func Migrate(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return nil, wrapPgErr(err, "acquire migration lock")
+	}
+	if err := ensureMigrationsTable(ctx, tx); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []MigrationStatus
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.Query); err != nil {
+			return nil, errors.Wrapf(&QueryError{Query: m.Query, Err: err}, "migration %d", m.Version)
+		}
+		var appliedAt time.Time
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO schema_migrations (version, name)
+			VALUES ($1, $2)
+			RETURNING applied_at
+		`, m.Version, m.Name).Scan(&appliedAt)
+		if err != nil {
+			return nil, wrapPgErr(err, "register migration")
+		}
+		done = append(done, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: appliedAt.UTC(),
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, wrapPgErr(err, "commit migrations")
+	}
+	return done, nil
+}
+
+// Migrations returns the status of all known migrations, in version order.
+// The database is not modified. All migrations are pending if the database
+// was never migrated.
+func Migrations(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var migrated bool
+	err = tx.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&migrated)
+	if err != nil {
+		return nil, wrapPgErr(err, "find migrations table")
+	}
+	var applied map[int]time.Time
+	if migrated {
+		if applied, err = appliedMigrations(ctx, tx); err != nil {
+			return nil, err
+		}
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: applied[m.Version],
+		}
+	}
+	return status, nil
+}
+
+func ensureMigrationsTable(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`)
+	return wrapPgErr(err, "create migrations table")
+}
+
+// appliedMigrations returns the application time of all applied migrations
+// by their version.
+func appliedMigrations(ctx context.Context, tx *sql.Tx) (map[int]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, wrapPgErr(err, "select migrations")
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, wrapPgErr(err, "scan migration")
+		}
+		applied[version] = appliedAt.UTC()
+	}
+	return applied, wrapPgErr(rows.Err(), "scanning migrations")
+}
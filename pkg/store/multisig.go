@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+)
+
+// SaveMultisigContract creates or replaces a multisig contract together with
+// its participants. A contract changed at a later height is left unchanged,
+// which happens when a block is reindexed.
+func (t *Tx) SaveMultisigContract(ctx context.Context, ch models.Change, c models.MultisigContract) error {
+	res, err := t.tx.ExecContext(ctx, `
+		INSERT INTO multisig_contracts (id, address, activation_threshold, admin_threshold, height)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET
+			address = EXCLUDED.address,
+			activation_threshold = EXCLUDED.activation_threshold,
+			admin_threshold = EXCLUDED.admin_threshold,
+			height = EXCLUDED.height
+		WHERE multisig_contracts.height <= EXCLUDED.height
+	`, c.ID, c.Address, c.ActivationThreshold, c.AdminThreshold, ch.Height)
+	if err != nil {
+		return wrapPgErr(err, "upsert multisig contract")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return wrapPgErr(err, "upsert multisig contract")
+	} else if n == 0 {
+		return nil
+	}
+
+	if _, err := t.tx.ExecContext(ctx, `DELETE FROM multisig_participants WHERE contract_id = $1`, c.ID); err != nil {
+		return wrapPgErr(err, "delete multisig participants")
+	}
+	rows := make([][]interface{}, 0, len(c.Participants))
+	for i, p := range c.Participants {
+		rows = append(rows, []interface{}{c.ID, i, p.Address, p.Weight})
+	}
+	err = t.copyIn(ctx, "multisig_participants", []string{"contract_id", "participant_index", "address", "weight"}, rows)
+	return errors.Wrap(err, "insert multisig participants")
+}
+
+const multisigColumns = `id, address, activation_threshold, admin_threshold,
+	COALESCE((
+		SELECT jsonb_agg(jsonb_build_object(
+			'address', p.address,
+			'weight', p.weight
+		) ORDER BY p.participant_index)
+		FROM multisig_participants p
+		WHERE p.contract_id = multisig_contracts.id
+	), '[]')`
+
+func scanMultisigContract(row interface{ Scan(...interface{}) error }) (models.MultisigContract, error) {
+	var (
+		c            models.MultisigContract
+		participants []byte
+	)
+	err := row.Scan(&c.ID, &c.Address, &c.ActivationThreshold, &c.AdminThreshold, &participants)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(participants, &c.Participants); err != nil {
+		return c, errors.Wrap(err, "cannot unmarshal participants")
+	}
+	return c, nil
+}
+
+// LoadMultisigContract returns the multisig contract with given ID.
+// ErrNotFound is returned if it does not exist.
+func (s *Store) LoadMultisigContract(ctx context.Context, id []byte) (*models.MultisigContract, error) {
+	c, err := scanMultisigContract(s.db.QueryRowContext(ctx, `
+		SELECT `+multisigColumns+`
+		FROM multisig_contracts
+		WHERE id = $1
+	`, id))
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot load multisig contract")
+	}
+	return &c, nil
+}
+
+// MultisigContractsByParticipant returns multisig contracts that given
+// bech32 address is a participant of, ordered by ID. Pass the last contract
+// of a page as after to select the next page. ErrLimit is returned if the
+// limit exceeds 100. ErrNotFound is returned if no contract was found.
+func (s *Store) MultisigContractsByParticipant(ctx context.Context, address string, after *models.MultisigContract, limit int) ([]models.MultisigContract, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+	query := sq.Select(multisigColumns).
+		From("multisig_contracts").
+		Where("id IN (SELECT contract_id FROM multisig_participants WHERE address = ?)", address).
+		OrderBy("id")
+	if after != nil {
+		query = query.Where("id > ?", after.ID)
+	}
+	rows, err := query.
+		PlaceholderFormat(sq.Dollar).
+		Limit(uint64(limit)).
+		RunWith(s.db).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select multisig contracts")
+	}
+	defer rows.Close()
+
+	var contracts []models.MultisigContract
+	for rows.Next() {
+		c, err := scanMultisigContract(rows)
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan multisig contract")
+		}
+		contracts = append(contracts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning multisig contracts")
+	}
+
+	if len(contracts) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no multisig contracts")
+	}
+	return contracts, nil
+}
+
+// LoadTxsByMultisig returns the latest transactions authorized using given
+// multisig contract, newest first.
+func (s *Store) LoadTxsByMultisig(ctx context.Context, contractID []byte, limit int) ([]models.Transaction, error) {
+	return s.loadTxs(ctx, `
+		SELECT `+txColumns+`
+		FROM `+txTables+`
+		WHERE transaction_hash IN (
+			SELECT transaction_hash FROM transaction_multisigs WHERE contract_id = $1
+		)
+		ORDER BY block_id DESC
+		LIMIT $2
+	`, limit, contractID)
+}
@@ -1,34 +1,453 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"strings"
 )
 
+// EnsureSchema applies all pending migrations.
 func EnsureSchema(pg *sql.DB) error {
-	tx, err := pg.Begin()
-	if err != nil {
-		return fmt.Errorf("transaction begin: %s", err)
-	}
+	_, err := Migrate(context.Background(), pg)
+	return err
+}
+
+// migrations is the ordered list of all schema changes. Once released, a
+// migration must never be changed. Add a new one instead.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Query:   schema,
+	},
+	{
+		Version: 2,
+		Name:    "drop duplicated transaction hash indexes",
+		// Previous versions created a new index on every start.
+		// Transaction hash is unique, so all of them are redundant.
+		Query: `
+DO $$
+DECLARE
+	idx RECORD;
+BEGIN
+	FOR idx IN
+		SELECT i.relname AS name
+		FROM pg_index x
+		INNER JOIN pg_class i ON i.oid = x.indexrelid
+		INNER JOIN pg_class t ON t.oid = x.indrelid
+		INNER JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = x.indkey[0]
+		WHERE t.relname = 'transactions'
+			AND pg_table_is_visible(t.oid)
+			AND NOT x.indisunique
+			AND x.indnatts = 1
+			AND a.attname = 'transaction_hash'
+	LOOP
+		EXECUTE format('DROP INDEX %I', idx.name);
+	END LOOP;
+END $$;
+`,
+	},
+	{
+		Version: 3,
+		Name:    "fees per ticker",
+		// Transaction fees were not stored before, so only the block
+		// totals can be migrated. All of them were paid in IOV.
+		Query: `
+CREATE TABLE block_fees (
+	block_id BIGINT NOT NULL REFERENCES blocks(block_height),
+	ticker TEXT NOT NULL,
+	whole BIGINT NOT NULL,
+	fractional BIGINT NOT NULL,
+	PRIMARY KEY (block_id, ticker)
+);
+
+CREATE TABLE transaction_fees (
+	transaction_hash TEXT NOT NULL PRIMARY KEY REFERENCES transactions(transaction_hash),
+	payer TEXT NOT NULL,
+	ticker TEXT NOT NULL,
+	whole BIGINT NOT NULL,
+	fractional BIGINT NOT NULL
+);
+
+CREATE INDEX ON transaction_fees (payer);
+
+INSERT INTO block_fees (block_id, ticker, whole, fractional)
+SELECT block_height, 'IOV', fee_frac / 1000000000, fee_frac % 1000000000
+FROM blocks
+WHERE fee_frac > 0;
+
+ALTER TABLE blocks DROP COLUMN fee_frac;
+`,
+	},
+	{
+		Version: 4,
+		Name:    "transaction signers",
+		Query: `
+CREATE TABLE transaction_signers (
+	transaction_hash TEXT NOT NULL REFERENCES transactions(transaction_hash),
+	signer_index INT NOT NULL,
+	signer TEXT NOT NULL,
+	PRIMARY KEY (transaction_hash, signer_index)
+);
+
+CREATE INDEX ON transaction_signers (signer);
+`,
+	},
+	{
+		Version: 5,
+		Name:    "messages",
+		// Batched messages of existing transactions are represented
+		// as stored, without bech32 addresses.
+		Query: `
+CREATE TABLE messages (
+	transaction_hash TEXT NOT NULL REFERENCES transactions(transaction_hash),
+	message_index INT NOT NULL,
+	path TEXT NOT NULL,
+	details JSONB,
+	PRIMARY KEY (transaction_hash, message_index)
+);
+
+CREATE INDEX ON messages (path);
+CREATE INDEX ON messages ((details->>'source'));
+CREATE INDEX ON messages ((details->>'destination'));
+CREATE INDEX ON messages ((details->>'memo'));
+
+INSERT INTO messages (transaction_hash, message_index, path, details)
+SELECT transaction_hash, 0, message->>'path', message->'details'
+FROM transactions
+WHERE jsonb_typeof(message) = 'object';
+
+INSERT INTO messages (transaction_hash, message_index, path, details)
+SELECT t.transaction_hash, m.ordinality - 1, m.value->>'path', m.value->'details'
+FROM transactions t, jsonb_array_elements(t.message) WITH ORDINALITY m
+WHERE jsonb_typeof(t.message) = 'array';
+`,
+	},
+	{
+		Version: 6,
+		Name:    "raw block data",
+		// Blocks synchronized before are left without raw data and
+		// cannot be reindexed.
+		Query: `
+ALTER TABLE blocks
+	ADD COLUMN raw_header JSONB,
+	ADD COLUMN raw_commit JSONB,
+	ADD COLUMN raw_transactions BYTEA[];
+`,
+	},
+	{
+		Version: 7,
+		Name:    "transaction decode errors",
+		Query: `
+ALTER TABLE transactions
+	ADD COLUMN decode_error TEXT,
+	ADD COLUMN raw BYTEA;
+
+CREATE INDEX ON transactions (block_id) WHERE decode_error IS NOT NULL;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "account lifecycle",
+		Query: `
+CREATE TABLE account_configuration (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	owner TEXT,
+	domain_renew BIGINT NOT NULL,
+	domain_grace_period BIGINT NOT NULL
+);
+
+CREATE TABLE domains (
+	id BIGSERIAL PRIMARY KEY,
+	domain TEXT NOT NULL,
+	admin TEXT NOT NULL,
+	broker TEXT,
+	has_superuser BOOLEAN NOT NULL,
+	account_renew BIGINT NOT NULL,
+	msg_fees JSONB,
+	valid_until TIMESTAMPTZ,
+	deleted_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX ON domains (domain) WHERE deleted_at IS NULL;
+
+UPDATE accounts SET broker = NULL WHERE broker = '(nil)';
+ALTER TABLE accounts
+	ADD COLUMN valid_until TIMESTAMPTZ,
+	ADD COLUMN certificates BYTEA[],
+	ADD COLUMN deleted_at TIMESTAMPTZ;
+UPDATE accounts SET deleted_at = now()
+	WHERE id NOT IN (SELECT max(id) FROM accounts GROUP BY domain, name);
+CREATE UNIQUE INDEX ON accounts (domain, name) WHERE deleted_at IS NULL;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "account history",
+		Query: `
+CREATE TABLE domain_history (
+	id BIGSERIAL PRIMARY KEY,
+	height BIGINT NOT NULL,
+	block_time TIMESTAMPTZ,
+	transaction_hash TEXT,
+	msg_path TEXT,
+	domain TEXT NOT NULL,
+	admin TEXT NOT NULL,
+	broker TEXT,
+	has_superuser BOOLEAN NOT NULL,
+	account_renew BIGINT NOT NULL,
+	msg_fees JSONB,
+	valid_until TIMESTAMPTZ,
+	deleted BOOLEAN NOT NULL
+);
+CREATE INDEX ON domain_history (domain, height);
+CREATE INDEX ON domain_history (height);
+
+CREATE TABLE account_history (
+	id BIGSERIAL PRIMARY KEY,
+	height BIGINT NOT NULL,
+	block_time TIMESTAMPTZ,
+	transaction_hash TEXT,
+	msg_path TEXT,
+	domain TEXT NOT NULL,
+	name TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	broker TEXT,
+	valid_until TIMESTAMPTZ,
+	certificates BYTEA[],
+	targets JSONB NOT NULL,
+	deleted BOOLEAN NOT NULL
+);
+CREATE INDEX ON account_history (domain, name, height);
+CREATE INDEX ON account_history (height);
+
+CREATE INDEX ON blocks (block_time);
+
+INSERT INTO domain_history (height, domain, admin, broker, has_superuser, account_renew,
+	msg_fees, valid_until, deleted)
+SELECT 0, domain, admin, broker, has_superuser, account_renew, msg_fees, valid_until, FALSE
+FROM domains
+WHERE deleted_at IS NULL
+ORDER BY id;
+
+INSERT INTO account_history (height, domain, name, owner, broker, valid_until,
+	certificates, targets, deleted)
+SELECT 0, domain, name, owner, broker, valid_until, certificates,
+	COALESCE((
+		SELECT jsonb_agg(jsonb_build_object(
+			'blockchain_id', account_targets.blockchain_id,
+			'address', account_targets.address
+		) ORDER BY account_targets.id)
+		FROM account_targets
+		WHERE account_targets.account_id = accounts.id
+	), '[]'),
+	FALSE
+FROM accounts
+WHERE deleted_at IS NULL
+ORDER BY id;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "reverse starname lookup",
+		Query: `
+CREATE INDEX ON account_targets (blockchain_id, address);
+CREATE INDEX ON account_targets (account_id);
+CREATE INDEX ON account_history USING GIN (targets jsonb_path_ops);
+`,
+	},
+	{
+		Version: 11,
+		Name:    "expiry tracking",
+		Query: `
+CREATE TABLE renewals (
+	id BIGSERIAL PRIMARY KEY,
+	height BIGINT NOT NULL,
+	block_time TIMESTAMPTZ,
+	transaction_hash TEXT,
+	msg_path TEXT,
+	domain TEXT NOT NULL,
+	name TEXT,
+	previous_valid_until TIMESTAMPTZ,
+	valid_until TIMESTAMPTZ
+);
+CREATE INDEX ON renewals (domain, height);
+CREATE INDEX ON renewals (height);
 
-	for _, query := range strings.Split(schema, "\n---\n") {
-		query = strings.TrimSpace(query)
+INSERT INTO renewals (height, block_time, transaction_hash, msg_path, domain, name,
+	previous_valid_until, valid_until)
+SELECT height, block_time, transaction_hash, msg_path, domain, NULL, previous, valid_until
+FROM (
+	SELECT *, lag(valid_until) OVER (PARTITION BY domain ORDER BY height, id) AS previous
+	FROM domain_history
+) h
+WHERE msg_path = 'account/renew_domain'
+ORDER BY id;
 
-		if _, err := tx.Exec(query); err != nil {
-			return &QueryError{Query: query, Err: err}
-		}
-	}
+INSERT INTO renewals (height, block_time, transaction_hash, msg_path, domain, name,
+	previous_valid_until, valid_until)
+SELECT height, block_time, transaction_hash, msg_path, domain, name, previous, valid_until
+FROM (
+	SELECT *, lag(valid_until) OVER (PARTITION BY domain, name ORDER BY height, id) AS previous
+	FROM account_history
+) h
+WHERE msg_path = 'account/renew_account'
+ORDER BY id;
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("transaction commit: %s", err)
-	}
+CREATE INDEX ON domains (valid_until) WHERE deleted_at IS NULL;
+CREATE INDEX ON accounts (valid_until) WHERE deleted_at IS NULL;
+`,
+	},
+	{
+		Version: 12,
+		Name:    "ledger",
+		Query: `
+CREATE TABLE ledger_entries (
+	id BIGSERIAL PRIMARY KEY,
+	height BIGINT NOT NULL,
+	block_time TIMESTAMPTZ,
+	transaction_hash TEXT,
+	msg_path TEXT,
+	address TEXT NOT NULL,
+	ticker TEXT NOT NULL,
+	whole BIGINT NOT NULL,
+	fractional BIGINT NOT NULL,
+	kind TEXT NOT NULL,
+	counterparty TEXT
+);
+CREATE INDEX ON ledger_entries (address, height, id);
+CREATE INDEX ON ledger_entries (height);
+`,
+	},
+	{
+		Version: 13,
+		Name:    "escrows",
+		// Escrow events hold the state of the escrow after each
+		// event, so that a block can be reindexed.
+		Query: `
+ALTER TABLE blocks ADD COLUMN raw_results JSONB;
 
-	_ = tx.Rollback()
+CREATE TABLE escrows (
+	id BYTEA PRIMARY KEY,
+	address TEXT NOT NULL,
+	source TEXT NOT NULL,
+	arbiter TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	amount JSONB NOT NULL,
+	timeout TIMESTAMPTZ NOT NULL,
+	memo TEXT,
+	state TEXT NOT NULL,
+	height BIGINT NOT NULL
+);
+CREATE INDEX ON escrows (source) WHERE state = 'open';
+CREATE INDEX ON escrows (arbiter) WHERE state = 'open';
+CREATE INDEX ON escrows (destination) WHERE state = 'open';
+CREATE INDEX ON escrows (timeout) WHERE state = 'open';
 
-	return nil
+CREATE TABLE escrow_events (
+	id BIGSERIAL PRIMARY KEY,
+	escrow_id BYTEA NOT NULL REFERENCES escrows(id),
+	height BIGINT NOT NULL,
+	block_time TIMESTAMPTZ,
+	transaction_hash TEXT,
+	msg_path TEXT,
+	kind TEXT NOT NULL,
+	moved JSONB NOT NULL,
+	source TEXT NOT NULL,
+	arbiter TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	amount JSONB NOT NULL,
+	state TEXT NOT NULL
+);
+CREATE INDEX ON escrow_events (escrow_id, height, id);
+CREATE INDEX ON escrow_events (height);
+`,
+	},
+	{
+		Version: 14,
+		Name:    "multisig contracts",
+		// Contracts created before cannot be recorded, because their
+		// IDs are known only from the transaction results. Links of
+		// transactions to contracts are restored from messages.
+		Query: `
+CREATE TABLE multisig_contracts (
+	id BYTEA PRIMARY KEY,
+	address TEXT NOT NULL,
+	activation_threshold INT NOT NULL,
+	admin_threshold INT NOT NULL,
+	height BIGINT NOT NULL
+);
+
+CREATE TABLE multisig_participants (
+	contract_id BYTEA NOT NULL REFERENCES multisig_contracts(id),
+	participant_index INT NOT NULL,
+	address TEXT NOT NULL,
+	weight INT NOT NULL,
+	PRIMARY KEY (contract_id, participant_index)
+);
+CREATE INDEX ON multisig_participants (address);
+
+CREATE TABLE transaction_multisigs (
+	transaction_hash TEXT NOT NULL REFERENCES transactions(transaction_hash),
+	contract_id BYTEA NOT NULL,
+	PRIMARY KEY (transaction_hash, contract_id)
+);
+CREATE INDEX ON transaction_multisigs (contract_id);
+
+INSERT INTO transaction_multisigs (transaction_hash, contract_id)
+SELECT DISTINCT t.transaction_hash, decode(ids.id, 'hex')
+FROM transactions t,
+	jsonb_array_elements(CASE jsonb_typeof(t.message)
+		WHEN 'array' THEN t.message
+		ELSE jsonb_build_array(t.message)
+	END) m,
+	jsonb_array_elements_text(m->'multisig_contract_ids') ids(id)
+WHERE t.message IS NOT NULL;
+`,
+	},
+	{
+		Version: 15,
+		Name:    "cash configuration",
+		Query: `
+CREATE TABLE cash_configuration (
+	id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+	minimal_fee_ticker TEXT,
+	minimal_fee_whole BIGINT NOT NULL,
+	minimal_fee_fractional BIGINT NOT NULL
+);
+`,
+	},
+	{
+		Version: 16,
+		Name:    "account configuration history",
+		Query: `
+ALTER TABLE account_configuration DROP COLUMN id;
+ALTER TABLE account_configuration
+	ADD COLUMN id BIGSERIAL PRIMARY KEY,
+	ADD COLUMN height BIGINT,
+	ADD COLUMN transaction_hash TEXT;
+UPDATE account_configuration SET height = COALESCE((SELECT MAX(block_height) FROM blocks), 0);
+ALTER TABLE account_configuration ALTER COLUMN height SET NOT NULL;
+CREATE INDEX ON account_configuration (height);
+`,
+	},
+	{
+		Version: 17,
+		Name:    "cash configuration history",
+		Query: `
+ALTER TABLE cash_configuration DROP COLUMN id;
+ALTER TABLE cash_configuration
+	ADD COLUMN id BIGSERIAL PRIMARY KEY,
+	ADD COLUMN height BIGINT,
+	ADD COLUMN transaction_hash TEXT;
+UPDATE cash_configuration SET height = COALESCE((SELECT MAX(block_height) FROM blocks), 0);
+ALTER TABLE cash_configuration ALTER COLUMN height SET NOT NULL;
+CREATE INDEX ON cash_configuration (height);
+`,
+	},
 }
 
+// schema is the initial schema. It must be safe to apply on databases
+// created before migrations were introduced.
 const schema = `
 
 CREATE TABLE IF NOT EXISTS validators (
@@ -39,8 +458,6 @@ CREATE TABLE IF NOT EXISTS validators (
 	memo TEXT
 );
 
----
-
 CREATE TABLE IF NOT EXISTS blocks (
 	block_height BIGINT NOT NULL PRIMARY KEY,
 	block_hash TEXT NOT NULL UNIQUE,
@@ -50,8 +467,6 @@ CREATE TABLE IF NOT EXISTS blocks (
 	fee_frac BIGINT NOT NULL
 );
 
----
-
 CREATE TABLE IF NOT EXISTS block_participations (
 	id BIGSERIAL PRIMARY KEY,
 	validated BOOLEAN NOT NULL,
@@ -60,8 +475,6 @@ CREATE TABLE IF NOT EXISTS block_participations (
 	UNIQUE (block_id, validator_id)
 );
 
----
-
 CREATE TABLE IF NOT EXISTS transactions (
 	id BIGSERIAL PRIMARY KEY,
 	transaction_hash TEXT NOT NULL UNIQUE,
@@ -69,17 +482,13 @@ CREATE TABLE IF NOT EXISTS transactions (
 	message JSONB
 );
 
-CREATE INDEX ON transactions (transaction_hash);
----
-
 CREATE TABLE IF NOT EXISTS accounts(
 	id BIGSERIAL PRIMARY KEY,
 	domain TEXT NOT NULL,
 	name TEXT NOT NULL,
 	owner TEXT NOT NULL,
-	broker TEXT	
+	broker TEXT
 );
----
 
 CREATE TABLE IF NOT EXISTS account_targets(
 	id BIGSERIAL PRIMARY KEY,
@@ -87,7 +496,6 @@ CREATE TABLE IF NOT EXISTS account_targets(
 	blockchain_id TEXT NOT NULL,
 	address TEXT NOT NULL
 );
----
 `
 
 type QueryError struct {
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+)
+
+// StarnameQuery selects starnames with a target pointing to a blockchain
+// address.
+type StarnameQuery struct {
+	BlockchainID string
+	Address      string
+	// Domain limits results to a single domain, if not empty.
+	Domain string
+	// Height selects the state as of given height, including changes done
+	// at that height. The current state is used if zero.
+	Height int64
+	// After is the last starname of the previous page. Starnames are
+	// ordered by domain and name.
+	After *models.Starname
+	Limit int
+}
+
+// StarnamesByTarget returns starnames selected by given query, ordered by
+// domain and name. ErrLimit is returned if the limit exceeds 100.
+// ErrNotFound is returned if no starname was found.
+func (s *Store) StarnamesByTarget(ctx context.Context, q StarnameQuery) ([]models.Starname, error) {
+	if q.Limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+
+	var query sq.SelectBuilder
+	if q.Height == 0 {
+		query = currentStarnames(q)
+	} else {
+		target, err := json.Marshal([]models.AccountTarget{{BlockchainID: q.BlockchainID, Address: q.Address}})
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal target")
+		}
+		query = historicStarnames(q, string(target))
+	}
+
+	rows, err := query.
+		PlaceholderFormat(sq.Dollar).
+		Limit(uint64(q.Limit)).
+		RunWith(s.db).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select starnames")
+	}
+	defer rows.Close()
+
+	var names []models.Starname
+	for rows.Next() {
+		var n models.Starname
+		if err := rows.Scan(&n.Domain, &n.Name, &n.Owner); err != nil {
+			return nil, wrapPgErr(err, "cannot scan starname")
+		}
+		names = append(names, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning starnames")
+	}
+
+	if len(names) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no starnames")
+	}
+	return names, nil
+}
+
+// currentStarnames selects starnames from existing accounts.
+func currentStarnames(q StarnameQuery) sq.SelectBuilder {
+	query := sq.Select("accounts.domain", "accounts.name", "accounts.owner").
+		Distinct().
+		From("accounts").
+		Join("account_targets ON account_targets.account_id = accounts.id").
+		Where(sq.Eq{
+			"account_targets.blockchain_id": q.BlockchainID,
+			"account_targets.address":       q.Address,
+		}).
+		Where("accounts.deleted_at IS NULL").
+		OrderBy("accounts.domain", "accounts.name")
+	if q.Domain != "" {
+		query = query.Where(sq.Eq{"accounts.domain": q.Domain})
+	}
+	if q.After != nil {
+		query = query.Where("(accounts.domain, accounts.name) > (?, ?)", q.After.Domain, q.After.Name)
+	}
+	return query
+}
+
+// historicStarnames selects starnames from the latest version of each
+// account as of the query height. Only accounts that had the target at any
+// time are considered, so that the history targets index is used.
+func historicStarnames(q StarnameQuery, target string) sq.SelectBuilder {
+	latest := sq.Select("DISTINCT ON (domain, name) domain, name, owner, targets, deleted").
+		From("account_history").
+		Where("height <= ?", q.Height).
+		Where(`(domain, name) IN (
+			SELECT domain, name FROM account_history
+			WHERE targets @> ?::jsonb AND height <= ?
+		)`, target, q.Height).
+		OrderBy("domain", "name", "height DESC", "id DESC")
+	if q.Domain != "" {
+		latest = latest.Where(sq.Eq{"domain": q.Domain})
+	}
+	if q.After != nil {
+		latest = latest.Where("(domain, name) > (?, ?)", q.After.Domain, q.After.Name)
+	}
+
+	return sq.Select("domain", "name", "owner").
+		FromSelect(latest, "latest").
+		Where("NOT deleted").
+		Where("targets @> ?::jsonb", target).
+		OrderBy("domain", "name")
+}
@@ -15,6 +15,47 @@ import (
 	"github.com/iov-one/weave/errors"
 )
 
+const (
+	// txColumns are the columns scanned by scanTx.
+	txColumns = `transaction_hash, block_id, message, decode_error, payer, ticker, whole, fractional,
+		ARRAY(
+			SELECT signer FROM transaction_signers s
+			WHERE s.transaction_hash = transactions.transaction_hash
+			ORDER BY signer_index
+		)`
+	// txTables joins transactions with their fees.
+	txTables = `transactions LEFT JOIN transaction_fees USING (transaction_hash)`
+)
+
+// scanTx reads a transaction selected using txColumns.
+func scanTx(row interface{ Scan(...interface{}) error }) (models.Transaction, error) {
+	var (
+		tx                       models.Transaction
+		message                  []byte
+		decodeErr, payer, ticker sql.NullString
+		whole, fractional        sql.NullInt64
+	)
+	err := row.Scan(&tx.Hash, &tx.BlockID, &message, &decodeErr, &payer, &ticker, &whole, &fractional, pq.Array(&tx.Signers))
+	if err != nil {
+		return tx, err
+	}
+	// Undecodable transactions are stored without a message.
+	tx.Message = message
+	tx.DecodeError = decodeErr.String
+	if len(tx.Signers) == 0 {
+		tx.Signers = nil
+	}
+	if ticker.Valid {
+		tx.Fee = &models.Fee{
+			Payer:      payer.String,
+			Ticker:     ticker.String,
+			Whole:      whole.Int64,
+			Fractional: fractional.Int64,
+		}
+	}
+	return tx, nil
+}
+
 // NewStore returns a store that provides an access to our database.
 func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
@@ -64,96 +105,35 @@ func (s *Store) ValidatorAddressID(ctx context.Context, address []byte) (int64,
 	return id, castPgErr(err)
 }
 
+// InsertBlock adds a block together with its participations and
+// transactions. ErrConflict is returned if the block or any of its
+// transactions is already present.
 func (s *Store) InsertBlock(ctx context.Context, b models.Block) error {
-	if len(b.ParticipantIDs) == 0 {
-		return errors.Wrap(ErrConflict, "no participants on block")
-	}
-
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return errors.Wrap(err, "cannot create transaction")
-	}
-
-	_, err = tx.ExecContext(ctx, `
-		INSERT INTO blocks (block_height, block_hash, block_time, proposer_id, messages, fee_frac)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, b.Height, b.Hash, b.Time.UTC(), b.ProposerID, pq.Array(b.Messages), b.FeeFrac)
-	if err != nil {
-		return wrapPgErr(err, "insert block")
-	}
-
-	for _, part := range b.ParticipantIDs {
-		_, err = tx.ExecContext(ctx, `
-		INSERT INTO block_participations (validated, block_id, validator_id)
-		VALUES (true, $1, $2)
-		`, b.Height, part)
-		if err != nil {
-			return wrapPgErr(err, "insert block participant")
-		}
-	}
-
-	for _, missed := range b.MissingIDs {
-		_, err = tx.ExecContext(ctx, `
-		INSERT INTO block_participations (validated, block_id, validator_id)
-		VALUES (false, $1, $2)
-		`, b.Height, missed)
-		if err != nil {
-			return wrapPgErr(err, "insert block participant")
-		}
-	}
+	return s.InTx(ctx, func(tx *Tx) error {
+		return tx.InsertBlock(ctx, b)
+	})
+}
 
-	for _, transaction := range b.Transactions {
-		_, err := tx.ExecContext(ctx, `
-		INSERT INTO transactions(transaction_hash, block_id, message)
-		VALUES($1, $2, $3)`, transaction.Hash, b.Height, transaction.Message)
-		if err != nil {
-			return wrapPgErr(err, "insert transaction")
+// InsertBlocks adds all given blocks within a single database transaction.
+// Either all blocks are inserted or none. ErrConflict is returned if any of
+// the blocks or their transactions is already present.
+func (s *Store) InsertBlocks(ctx context.Context, blocks []models.Block) error {
+	return s.InTx(ctx, func(tx *Tx) error {
+		for _, b := range blocks {
+			if err := tx.InsertBlock(ctx, b); err != nil {
+				return errors.Wrapf(err, "block %d", b.Height)
+			}
 		}
-	}
-
-	err = tx.Commit()
-
-	_ = tx.Rollback()
-
-	return wrapPgErr(err, "commit block tx")
+		return nil
+	})
 }
 
+// InsertAccount adds a registered account together with its targets. The
+// change is recorded at height zero.
 func (s *Store) InsertAccount(ctx context.Context, a *account.RegisterAccountMsg) error {
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return errors.Wrap(err, "cannot create transaction")
-	}
-
-	query :=
-		`INSERT INTO accounts(domain, name, owner, broker)
-		  VALUES ($1, $2, $3, $4)
-  		  RETURNING id`
-	stmt, err := s.db.Prepare(query)
-	if err != nil {
-		return wrapPgErr(err, "insert account query")
-	}
-	defer stmt.Close()
-
-	var accountID int
-	if err := stmt.QueryRow(a.Domain, a.Name, a.Owner.String(), a.Broker.String()).Scan(&accountID); err != nil {
-		return wrapPgErr(err, "insert account")
-	}
-
-	for _, target := range a.Targets {
-		_, err = tx.ExecContext(ctx, `
-		INSERT INTO account_targets (account_id, blockchain_id, address)
-		VALUES ($1, $2, $3)
-		`, accountID, target.BlockchainID, target.Address)
-		if err != nil {
-			return wrapPgErr(err, "insert account targets")
-		}
-	}
-
-	err = tx.Commit()
-
-	_ = tx.Rollback()
-
-	return wrapPgErr(err, "commit account")
+	return s.InTx(ctx, func(tx *Tx) error {
+		return tx.InsertAccount(ctx, models.Change{}, a, nil)
+	})
 }
 
 // LoadLastNBlock returns the last blocks with given count.
@@ -170,14 +150,14 @@ func (s *Store) LastNBlock(ctx context.Context, limit, after int) ([]*models.Blo
 	var err error
 	if after == 0 {
 		rows, err = s.db.QueryContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages
 		FROM blocks
 		ORDER BY block_height DESC
 		LIMIT $1
 	`, limit)
 	} else {
 		rows, err = s.db.QueryContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages
 		FROM blocks
 		WHERE block_height < $1
 		ORDER BY block_height DESC
@@ -198,7 +178,7 @@ func (s *Store) LastNBlock(ctx context.Context, limit, after int) ([]*models.Blo
 
 	for rows.Next() {
 		var b models.Block
-		err := rows.Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac)
+		err := rows.Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages))
 		if err != nil {
 			err = castPgErr(err)
 			if errors.ErrNotFound.Is(err) {
@@ -219,6 +199,9 @@ func (s *Store) LastNBlock(ctx context.Context, limit, after int) ([]*models.Blo
 		if err != nil {
 			return nil, err
 		}
+		if b.Fees, err = s.loadBlockFees(ctx, b.Height); err != nil {
+			return nil, err
+		}
 
 		// insert validator name to the response
 		name, err := s.validatorNameFromProposerID(ctx, b.ProposerID)
@@ -235,6 +218,31 @@ func (s *Store) LastNBlock(ctx context.Context, limit, after int) ([]*models.Blo
 	return blocks, nil
 }
 
+// loadBlockFees returns fee totals of the block with given height, one per
+// ticker.
+func (s *Store) loadBlockFees(ctx context.Context, blockHeight int64) ([]models.Fee, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ticker, whole, fractional
+		FROM block_fees
+		WHERE block_id = $1
+		ORDER BY ticker
+	`, blockHeight)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select block fees")
+	}
+	defer rows.Close()
+
+	var fees []models.Fee
+	for rows.Next() {
+		var f models.Fee
+		if err := rows.Scan(&f.Ticker, &f.Whole, &f.Fractional); err != nil {
+			return nil, wrapPgErr(err, "cannot scan block fee")
+		}
+		fees = append(fees, f)
+	}
+	return fees, wrapPgErr(rows.Err(), "scanning block fees")
+}
+
 func (s *Store) validatorNameFromProposerID(ctx context.Context, proposerID int64) (string, error) {
 	var vadr []byte
 	err := s.db.QueryRowContext(ctx, `
@@ -270,10 +278,10 @@ func (s *Store) LoadBlock(ctx context.Context, blockHeight int64) (*models.Block
 	var b models.Block
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages
 		FROM blocks
 		WHERE block_height = $1
-	`, blockHeight).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac)
+	`, blockHeight).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages))
 
 	if err != nil {
 		err = castPgErr(err)
@@ -297,6 +305,10 @@ func (s *Store) LoadBlock(ctx context.Context, blockHeight int64) (*models.Block
 	// normalize it here, as not always stored like this in the db
 	b.Time = b.Time.UTC()
 	b.ParticipantIDs, b.MissingIDs, err = s.loadParticipants(ctx, b.Height)
+	if err != nil {
+		return nil, err
+	}
+	b.Fees, err = s.loadBlockFees(ctx, b.Height)
 	return &b, err
 }
 
@@ -304,10 +316,10 @@ func (s *Store) LoadBlockByHash(ctx context.Context, blockHash string) (*models.
 	var b models.Block
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages
 		FROM blocks
 		WHERE block_hash=$1
-	`, blockHash).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac)
+	`, blockHash).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages))
 
 	if err != nil {
 		err = castPgErr(err)
@@ -331,6 +343,10 @@ func (s *Store) LoadBlockByHash(ctx context.Context, blockHash string) (*models.
 	// normalize it here, as not always stored like this in the db
 	b.Time = b.Time.UTC()
 	b.ParticipantIDs, b.MissingIDs, err = s.loadParticipants(ctx, b.Height)
+	if err != nil {
+		return nil, err
+	}
+	b.Fees, err = s.loadBlockFees(ctx, b.Height)
 	return &b, err
 }
 
@@ -338,10 +354,10 @@ func (s *Store) LoadBlockByHeight(ctx context.Context, blockHeight string) (*mod
 	var b models.Block
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT block_height, block_hash, block_time, proposer_id, messages, fee_frac
+		SELECT block_height, block_hash, block_time, proposer_id, messages
 		FROM blocks
 		WHERE block_height=$1
-	`, blockHeight).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages), &b.FeeFrac)
+	`, blockHeight).Scan(&b.Height, &b.Hash, &b.Time, &b.ProposerID, pq.Array(&b.Messages))
 
 	if err != nil {
 		err = castPgErr(err)
@@ -365,18 +381,53 @@ func (s *Store) LoadBlockByHeight(ctx context.Context, blockHeight string) (*mod
 	// normalize it here, as not always stored like this in the db
 	b.Time = b.Time.UTC()
 	b.ParticipantIDs, b.MissingIDs, err = s.loadParticipants(ctx, b.Height)
+	if err != nil {
+		return nil, err
+	}
+	b.Fees, err = s.loadBlockFees(ctx, b.Height)
 	return &b, err
 }
 
+// LoadRawBlocks returns all blocks within given height range, including
+// both ends, in height order. Only the height, hash, time and raw data of
+// each block is loaded. Header, Commit, Results and RawTransactions are nil
+// for blocks that were stored without raw data.
+func (s *Store) LoadRawBlocks(ctx context.Context, fromHeight, toHeight int64) ([]*models.Block, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT block_height, block_hash, block_time, raw_header, raw_commit, raw_results, raw_transactions
+		FROM blocks
+		WHERE block_height BETWEEN $1 AND $2
+		ORDER BY block_height
+	`, fromHeight, toHeight)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select blocks")
+	}
+	defer rows.Close()
+
+	var blocks []*models.Block
+	for rows.Next() {
+		var (
+			b                       models.Block
+			header, commit, results []byte
+		)
+		err := rows.Scan(&b.Height, &b.Hash, &b.Time, &header, &commit, &results, (*pq.ByteaArray)(&b.RawTransactions))
+		if err != nil {
+			return nil, wrapPgErr(err, "cannot scan block")
+		}
+		b.Time = b.Time.UTC()
+		b.Header, b.Commit, b.Results = header, commit, results
+		blocks = append(blocks, &b)
+	}
+	return blocks, wrapPgErr(rows.Err(), "scanning blocks")
+}
+
 // LoadTx
 func (s *Store) LoadTx(ctx context.Context, txHash string) (*models.Transaction, error) {
-	var tx models.Transaction
-
-	err := s.db.QueryRowContext(ctx, `
-		SELECT transaction_hash, block_id, message
-		FROM transactions
+	tx, err := scanTx(s.db.QueryRowContext(ctx, `
+		SELECT `+txColumns+`
+		FROM `+txTables+`
 		WHERE transaction_hash=$1
-	`, txHash).Scan(&tx.Hash, &tx.BlockID, &tx.Message)
+	`, txHash))
 	if err == nil {
 		return &tx, nil
 	}
@@ -391,8 +442,8 @@ func (s *Store) LoadTx(ctx context.Context, txHash string) (*models.Transaction,
 // LoadLatestNTx
 func (s *Store) LoadLatestNTx(ctx context.Context, n int) ([]*models.Transaction, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT transaction_hash, block_id, message
-		FROM transactions
+		SELECT `+txColumns+`
+		FROM `+txTables+`
 		ORDER BY block_id DESC
 		LIMIT $1
 	`, n)
@@ -409,8 +460,7 @@ func (s *Store) LoadLatestNTx(ctx context.Context, n int) ([]*models.Transaction
 	var txs []*models.Transaction
 
 	for rows.Next() {
-		var tx models.Transaction
-		err := rows.Scan(&tx.Hash, &tx.BlockID, &tx.Message)
+		tx, err := scanTx(rows)
 		if err != nil {
 			err = castPgErr(err)
 			if errors.ErrNotFound.Is(err) {
@@ -429,8 +479,8 @@ func (s *Store) LoadLatestNTx(ctx context.Context, n int) ([]*models.Transaction
 // LoadTxsInBlock
 func (s *Store) LoadTxsInBlock(ctx context.Context, blockHeight int64) ([]models.Transaction, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT transaction_hash, block_id, message
-		FROM transactions
+		SELECT `+txColumns+`
+		FROM `+txTables+`
 		WHERE block_id=$1
 	`, blockHeight)
 	defer rows.Close()
@@ -446,8 +496,7 @@ func (s *Store) LoadTxsInBlock(ctx context.Context, blockHeight int64) ([]models
 	var txs []models.Transaction
 
 	for rows.Next() {
-		var tx models.Transaction
-		err := rows.Scan(&tx.Hash, &tx.BlockID, &tx.Message)
+		tx, err := scanTx(rows)
 		if err != nil {
 			err = castPgErr(err)
 			if errors.ErrNotFound.Is(err) {
@@ -465,20 +514,32 @@ func (s *Store) LoadTxsInBlock(ctx context.Context, blockHeight int64) ([]models
 	return txs, nil
 }
 
+// LoadTxsByParams returns transactions with a message matching all given
+// parameters. Empty parameters are ignored. Messages contained in a batch are
+// matched the same way as unbatched ones.
 func (s *Store) LoadTxsByParams(ctx context.Context, source, dest, memo string) ([]models.Transaction, error) {
-	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
-	query := psql.Select("transaction_hash, block_id, message").From("transactions").Limit(100)
-
+	// Placeholders are numbered when the outer query is built.
+	msgs := sq.Select("transaction_hash").From("messages")
 	if source != "" {
-		query = query.Where("message->'details'->>'source' = ?", source)
+		msgs = msgs.Where("details->>'source' = ?", source)
 	}
 	if dest != "" {
-		query = query.Where("message->'details'->>'destination' = ?", dest)
+		msgs = msgs.Where("details->>'destination' = ?", dest)
 	}
 	if memo != "" {
-		query = query.Where("message->'details'->>'memo' = ?", memo)
+		msgs = msgs.Where("details->>'memo' = ?", memo)
+	}
+	msgsSQL, msgsArgs, err := msgs.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "build messages query")
 	}
 
+	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
+	query := psql.Select(txColumns).From(txTables).
+		Where("transaction_hash IN ("+msgsSQL+")", msgsArgs...).
+		OrderBy("block_id DESC").
+		Limit(100)
+
 	rows, err := query.RunWith(s.db).QueryContext(ctx)
 	if err != nil {
 		err = castPgErr(err)
@@ -487,12 +548,12 @@ func (s *Store) LoadTxsByParams(ctx context.Context, source, dest, memo string)
 		}
 		return nil, errors.Wrap(castPgErr(err), "cannot select txs")
 	}
+	defer rows.Close()
 
 	var txs []models.Transaction
 
 	for rows.Next() {
-		var tx models.Transaction
-		err := rows.Scan(&tx.Hash, &tx.BlockID, &tx.Message)
+		tx, err := scanTx(rows)
 		if err != nil {
 			err = castPgErr(err)
 			if errors.ErrNotFound.Is(err) {
@@ -510,45 +571,147 @@ func (s *Store) LoadTxsByParams(ctx context.Context, source, dest, memo string)
 	return txs, nil
 }
 
-// LoadTxsByMemo
+// LoadTxsByMemo returns transactions with a message that has given memo.
+// Messages contained in a batch are matched as well.
 func (s *Store) LoadTxsByMemo(ctx context.Context, memo string) ([]models.Transaction, error) {
-	rows, err := s.db.QueryContext(ctx, `
-			SELECT transaction_hash, block_id, message
-			FROM transactions
-			AND message -> 'details' ->> 'memo' = $1
-		`, memo)
-	defer rows.Close()
+	return s.loadTxs(ctx, `
+		SELECT `+txColumns+`
+		FROM `+txTables+`
+		WHERE transaction_hash IN (
+			SELECT transaction_hash FROM messages WHERE details->>'memo' = $1
+		)
+		ORDER BY block_id DESC
+		LIMIT $2
+	`, 100, memo)
+}
+
+// LoadTxsBySigner returns the latest transactions signed by given bech32
+// address, newest first.
+func (s *Store) LoadTxsBySigner(ctx context.Context, signer string, limit int) ([]models.Transaction, error) {
+	return s.loadTxs(ctx, `
+		SELECT `+txColumns+`
+		FROM `+txTables+`
+		WHERE transaction_hash IN (
+			SELECT transaction_hash FROM transaction_signers WHERE signer = $1
+		)
+		ORDER BY block_id DESC
+		LIMIT $2
+	`, limit, signer)
+}
+
+// LoadTxsByFeePayer returns the latest transactions which fee was paid by
+// given bech32 address, newest first.
+func (s *Store) LoadTxsByFeePayer(ctx context.Context, payer string, limit int) ([]models.Transaction, error) {
+	return s.loadTxs(ctx, `
+		SELECT `+txColumns+`
+		FROM `+txTables+`
+		WHERE payer = $1
+		ORDER BY block_id DESC
+		LIMIT $2
+	`, limit, payer)
+}
+
+// loadTxs returns transactions selected with given query, that must select
+// txColumns. The limit is passed to the query after all other arguments.
+// ErrLimit is returned if the limit exceeds 100. ErrNotFound is returned if
+// no transaction was found.
+func (s *Store) loadTxs(ctx context.Context, query string, limit int, args ...interface{}) ([]models.Transaction, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
 
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit)...)
 	if err != nil {
-		err = castPgErr(err)
-		if errors.ErrNotFound.Is(err) {
-			return nil, errors.Wrap(err, "no txs")
-		}
-		return nil, errors.Wrap(castPgErr(err), "cannot select txs")
+		return nil, wrapPgErr(err, "cannot select txs")
 	}
+	defer rows.Close()
 
 	var txs []models.Transaction
-
 	for rows.Next() {
-		var tx models.Transaction
-		err := rows.Scan(&tx.Hash, &tx.BlockID, &tx.Message)
+		tx, err := scanTx(rows)
 		if err != nil {
-			err = castPgErr(err)
-			if errors.ErrNotFound.Is(err) {
-				return nil, errors.Wrap(err, "no tx")
-			}
-			return nil, errors.Wrap(castPgErr(err), "cannot select tx")
+			return nil, wrapPgErr(err, "cannot select tx")
 		}
 		txs = append(txs, tx)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning txs")
+	}
 
 	if len(txs) == 0 {
 		return nil, errors.Wrap(errors.ErrNotFound, "no txs")
 	}
+	return txs, nil
+}
+
+// LoadUndecodedTxs returns transactions that could not be decoded, starting
+// at given height, in height order. Only the hash, block height, raw bytes
+// and the decode error are loaded. Blocks of returned transactions must be
+// reindexed once the decoder supports them. ErrNotFound is returned if there
+// are none.
+func (s *Store) LoadUndecodedTxs(ctx context.Context, fromHeight int64, limit int) ([]models.Transaction, error) {
+	if limit > 100 {
+		return nil, errors.Wrap(ErrLimit, "limit exceeded")
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT transaction_hash, block_id, decode_error, raw
+		FROM transactions
+		WHERE decode_error IS NOT NULL AND block_id >= $1
+		ORDER BY block_id, transaction_hash
+		LIMIT $2
+	`, fromHeight, limit)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select txs")
+	}
+	defer rows.Close()
+
+	var txs []models.Transaction
+	for rows.Next() {
+		var tx models.Transaction
+		if err := rows.Scan(&tx.Hash, &tx.BlockID, &tx.DecodeError, &tx.Raw); err != nil {
+			return nil, wrapPgErr(err, "cannot scan tx")
+		}
+		txs = append(txs, tx)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapPgErr(err, "scanning txs")
+	}
 
+	if len(txs) == 0 {
+		return nil, errors.Wrap(errors.ErrNotFound, "no txs")
+	}
 	return txs, nil
 }
 
+// FeesPaidBy returns totals of all fees paid by given bech32 address, one per
+// ticker.
+func (s *Store) FeesPaidBy(ctx context.Context, payer string) ([]models.Fee, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT ticker,
+			(SUM(whole) + DIV(SUM(fractional), 1000000000))::BIGINT,
+			MOD(SUM(fractional), 1000000000)::BIGINT
+		FROM transaction_fees
+		WHERE payer = $1
+		GROUP BY ticker
+		ORDER BY ticker
+	`, payer)
+	if err != nil {
+		return nil, wrapPgErr(err, "cannot select fees")
+	}
+	defer rows.Close()
+
+	var fees []models.Fee
+	for rows.Next() {
+		f := models.Fee{Payer: payer}
+		if err := rows.Scan(&f.Ticker, &f.Whole, &f.Fractional); err != nil {
+			return nil, wrapPgErr(err, "cannot scan fee")
+		}
+		fees = append(fees, f)
+	}
+	return fees, wrapPgErr(rows.Err(), "scanning fees")
+}
+
 // loadParticipants will load the participants for the given block and update the structure.
 // Automatically called as part of Load/LatestBlock to give you the full info
 func (s *Store) loadParticipants(ctx context.Context, blockHeight int64) (participants []int64, missing []int64, err error) {
@@ -581,47 +744,20 @@ func (s *Store) loadParticipants(ctx context.Context, blockHeight int64) (partic
 	return
 }
 
+// ReplaceAccountTargets sets new targets of an existing account. The change
+// is recorded at height zero.
 func (s *Store) ReplaceAccountTargets(ctx context.Context, a *account.ReplaceAccountTargetsMsg) error {
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return errors.Wrap(err, "cannot create transaction")
-	}
-
-	var accountID int
-	if err := s.db.QueryRow(`SELECT id FROM accounts WHERE domain = $1 AND name = $2`, a.Domain, a.Name).Scan(&accountID); err != nil {
-		return wrapPgErr(err, "cannot get account ID")
-	}
-
-	if _, err := tx.ExecContext(ctx, `DELETE FROM account_targets WHERE account_id = $1`, accountID); err != nil {
-		return wrapPgErr(err, "update account delete query")
-
-	}
-
-	for _, target := range a.NewTargets {
-		_, err = tx.ExecContext(ctx, `
-		INSERT INTO account_targets (account_id, blockchain_id, address)
-		VALUES ($1, $2, $3)
-		`, accountID, target.BlockchainID, target.Address)
-		if err != nil {
-			return wrapPgErr(err, "insert account targets")
-		}
-	}
-
-	err = tx.Commit()
-
-	_ = tx.Rollback()
-
-	return wrapPgErr(err, "commit account")
+	return s.InTx(ctx, func(tx *Tx) error {
+		return tx.ReplaceAccountTargets(ctx, models.Change{}, a)
+	})
 }
 
 func (s *Store) LoadAccount(ctx context.Context, name, domain string) (*models.Account, error) {
-	var acc models.Account
-
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, domain, name, owner, broker
+	acc, err := scanAccount(s.db.QueryRowContext(ctx, `
+		SELECT `+accountColumns+`
 		FROM accounts
-		WHERE name=$1 AND domain=$2
-	`, name, domain).Scan(&acc.ID, &acc.Domain, &acc.Name, &acc.Owner, &acc.Broker)
+		WHERE name=$1 AND domain=$2 AND deleted_at IS NULL
+	`, name, domain))
 	if err != nil {
 		return nil, wrapPgErr(err, "cannot load account")
 	}
@@ -633,7 +769,7 @@ func (s *Store) LoadAccountTargets(ctx context.Context, name, domain string) ([]
 		SELECT account_targets.id, account_targets.account_id, account_targets.blockchain_id, account_targets.address
 		FROM account_targets
 		INNER JOIN accounts ON account_targets.account_id = accounts.id
-		AND accounts.name = $1 AND accounts.domain = $2
+		AND accounts.name = $1 AND accounts.domain = $2 AND accounts.deleted_at IS NULL
 	`, name, domain)
 	defer rows.Close()
 
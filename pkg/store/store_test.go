@@ -2,9 +2,12 @@ package store
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -289,6 +292,10 @@ func TestStoreInsertBlock(t *testing.T) {
 				ProposerID:     2,
 				ParticipantIDs: []int64{2, 3},
 				Messages:       []string{"test/one"},
+				Fees: []models.Fee{
+					{Ticker: "ETH", Fractional: 5},
+					{Ticker: "IOV", Whole: 1, Fractional: 2},
+				},
 			},
 		},
 		"success with one missing": {
@@ -390,6 +397,221 @@ func TestStoreInsertBlock(t *testing.T) {
 	}
 }
 
+func TestStoreInsertBlocks(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+	if err != nil {
+		t.Fatalf("cannot create a validator: %s", err)
+	}
+
+	newBlock := func(height int64, txHashes ...string) models.Block {
+		b := models.Block{
+			Height:         height,
+			Hash:           hex.EncodeToString([]byte{0, 1, byte(height)}),
+			Time:           time.Now().UTC().Round(time.Microsecond),
+			ProposerID:     vID,
+			ParticipantIDs: []int64{vID},
+			Messages:       []string{},
+		}
+		for _, h := range txHashes {
+			b.Transactions = append(b.Transactions, models.Transaction{
+				Hash:    h,
+				Message: json.RawMessage(`{"path":"test/msg"}`),
+			})
+		}
+		return b
+	}
+
+	blocks := []models.Block{newBlock(1, "a1", "a2"), newBlock(2), newBlock(3, "a3")}
+	fee := &models.Fee{Payer: "tiov1payer", Ticker: "IOV", Whole: 3, Fractional: 4}
+	blocks[0].Transactions[0].Fee = fee
+	if err := s.InsertBlocks(ctx, blocks); err != nil {
+		t.Fatalf("cannot insert blocks: %s", err)
+	}
+	for _, b := range blocks {
+		txs, err := s.LoadTxsInBlock(ctx, b.Height)
+		if err != nil && !errors.ErrNotFound.Is(err) {
+			t.Fatalf("cannot load transactions of block %d: %s", b.Height, err)
+		}
+		if len(txs) != len(b.Transactions) {
+			t.Fatalf("want %d transactions in block %d, got %d", len(b.Transactions), b.Height, len(txs))
+		}
+	}
+
+	tx, err := s.LoadTx(ctx, "a1")
+	if err != nil {
+		t.Fatalf("cannot load transaction: %s", err)
+	}
+	if !reflect.DeepEqual(tx.Fee, fee) {
+		t.Fatalf("want fee %+v, got %+v", fee, tx.Fee)
+	}
+	if tx, err := s.LoadTx(ctx, "a2"); err != nil || tx.Fee != nil {
+		t.Fatalf("want no fee, got %+v, %v", tx, err)
+	}
+
+	// Transaction hash conflict must roll back all blocks.
+	blocks = []models.Block{newBlock(4), newBlock(5, "a1")}
+	if err := s.InsertBlocks(ctx, blocks); !ErrConflict.Is(err) {
+		t.Fatalf("want conflict error, got %v", err)
+	}
+	if _, err := s.LoadBlock(ctx, 4); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("block 4 must not be inserted, got %v", err)
+	}
+}
+
+func TestStoreReindexBlock(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+	if err != nil {
+		t.Fatalf("cannot create a validator: %s", err)
+	}
+
+	block := models.Block{
+		Height:         1,
+		Hash:           "0a",
+		Time:           time.Now().UTC().Round(time.Microsecond),
+		ProposerID:     vID,
+		ParticipantIDs: []int64{vID},
+		Messages:       []string{"test/msg"},
+		Fees:           []models.Fee{{Ticker: "IOV", Whole: 1}},
+		Transactions: []models.Transaction{
+			{
+				Hash:    "a1",
+				Message: json.RawMessage(`{"path":"test/msg"}`),
+				Fee:     &models.Fee{Payer: "tiov1payer", Ticker: "IOV", Whole: 1},
+				Signers: []string{"tiov1payer"},
+				Messages: []models.Message{
+					{Path: "test/msg", Details: json.RawMessage(`{"memo":"old"}`)},
+				},
+			},
+		},
+		Header:          json.RawMessage(`{"height":"1"}`),
+		Commit:          json.RawMessage(`{"precommits":[]}`),
+		RawTransactions: [][]byte{{0x01, 0x02}},
+	}
+	if err := s.InsertBlock(ctx, block); err != nil {
+		t.Fatalf("cannot insert block: %s", err)
+	}
+
+	raw, err := s.LoadRawBlocks(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("cannot load raw blocks: %s", err)
+	}
+	if len(raw) != 1 {
+		t.Fatalf("want one block, got %d", len(raw))
+	}
+	if !reflect.DeepEqual(raw[0].RawTransactions, block.RawTransactions) {
+		t.Fatalf("want %v raw transactions, got %v", block.RawTransactions, raw[0].RawTransactions)
+	}
+	if len(raw[0].Header) == 0 || len(raw[0].Commit) == 0 {
+		t.Fatalf("want header and commit, got %s and %s", raw[0].Header, raw[0].Commit)
+	}
+
+	reindexed := block
+	reindexed.Fees = nil
+	reindexed.Transactions = []models.Transaction{
+		{
+			Hash:    "a2",
+			Message: json.RawMessage(`{"path":"test/msg"}`),
+			Messages: []models.Message{
+				{Path: "test/msg", Details: json.RawMessage(`{"memo":"new"}`)},
+			},
+		},
+	}
+	err = s.InTx(ctx, func(tx *Tx) error {
+		return tx.ReindexBlock(ctx, reindexed)
+	})
+	if err != nil {
+		t.Fatalf("cannot reindex block: %s", err)
+	}
+
+	if _, err := s.LoadTx(ctx, "a1"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want previous transaction removed, got %v", err)
+	}
+	if txs, err := s.LoadTxsByMemo(ctx, "new"); err != nil || len(txs) != 1 {
+		t.Fatalf("want reindexed transaction, got %v, %v", txs, err)
+	}
+	if fees, err := s.FeesPaidBy(ctx, "tiov1payer"); err != nil || len(fees) != 0 {
+		t.Fatalf("want no fees, got %v, %v", fees, err)
+	}
+
+	err = s.InTx(ctx, func(tx *Tx) error {
+		return tx.ReindexBlock(ctx, models.Block{Height: 2})
+	})
+	if !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+}
+
+func TestLoadUndecodedTxs(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+	if err != nil {
+		t.Fatalf("cannot create a validator: %s", err)
+	}
+
+	if _, err := s.LoadUndecodedTxs(ctx, 0, 10); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	for h := int64(1); h <= 3; h++ {
+		b := models.Block{
+			Height:         h,
+			Hash:           hex.EncodeToString([]byte{byte(h)}),
+			Time:           time.Now().UTC(),
+			ProposerID:     vID,
+			ParticipantIDs: []int64{vID},
+			Messages:       []string{},
+			Transactions: []models.Transaction{
+				{Hash: fmt.Sprintf("ok%d", h), Message: json.RawMessage(`{}`)},
+				{Hash: fmt.Sprintf("bad%d", h), DecodeError: "unknown message", Raw: []byte{byte(h)}},
+			},
+		}
+		if err := s.InsertBlock(ctx, b); err != nil {
+			t.Fatalf("cannot insert block: %s", err)
+		}
+	}
+
+	txs, err := s.LoadUndecodedTxs(ctx, 2, 10)
+	if err != nil {
+		t.Fatalf("cannot load undecoded txs: %s", err)
+	}
+	want := []models.Transaction{
+		{Hash: "bad2", BlockID: 2, DecodeError: "unknown message", Raw: []byte{2}},
+		{Hash: "bad3", BlockID: 3, DecodeError: "unknown message", Raw: []byte{3}},
+	}
+	if !reflect.DeepEqual(txs, want) {
+		t.Fatalf("want %+v, got %+v", want, txs)
+	}
+
+	tx, err := s.LoadTx(ctx, "bad1")
+	if err != nil {
+		t.Fatalf("cannot load undecoded tx: %s", err)
+	}
+	if tx.DecodeError != "unknown message" || tx.Message != nil {
+		t.Fatalf("unexpected tx: %+v", tx)
+	}
+
+	if _, err := s.LoadUndecodedTxs(ctx, 0, 101); !ErrLimit.Is(err) {
+		t.Fatalf("want limit error, got %v", err)
+	}
+}
+
 func TestStoreAccount(t *testing.T) {
 	db, cleanup := EnsureDB(t)
 	defer cleanup()
@@ -464,4 +686,1032 @@ func TestStoreAccount(t *testing.T) {
 	t.Logf("sent account targets: %+v", targets)
 	t.Logf("got account targets: %+v", accTargets)
 
+	// Registering the same account again does not replace it.
+	msg.Targets = targets[:1]
+	if err := s.InsertAccount(ctx, &msg); err != nil {
+		t.Fatalf("cannot insert account again: %s", err)
+	}
+	accTargets, err = s.LoadAccountTargets(ctx, "name", "domain")
+	if err != nil {
+		t.Fatalf("cannot load account: %s", err)
+	}
+	if len(accTargets) != len(newTargets) || accTargets[0].BlockchainID != "new" {
+		t.Fatalf("want replaced targets, got %+v", accTargets)
+	}
+}
+
+func TestStoreDomainLifecycle(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	admin := weavetest.NewCondition().Address()
+	owner := weavetest.NewCondition().Address()
+	validUntil := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	ch := models.Change{Height: 1, Time: validUntil, TxHash: "tx", MsgPath: "account/test"}
+
+	genesis := models.AccountConfiguration{DomainRenew: time.Minute}
+	if err := s.InitAccountConfiguration(ctx, 0, genesis); err != nil {
+		t.Fatalf("cannot init configuration: %s", err)
+	}
+	// Configuration known at a height is not replaced.
+	if err := s.InitAccountConfiguration(ctx, 0, models.AccountConfiguration{}); err != nil {
+		t.Fatalf("cannot init configuration: %s", err)
+	}
+
+	err := s.InTx(ctx, func(tx *Tx) error {
+		if _, err := tx.AccountConfigurationAt(ctx, -1); !errors.ErrNotFound.Is(err) {
+			t.Fatalf("want not found error, got %v", err)
+		}
+		conf := models.AccountConfiguration{DomainRenew: time.Hour}
+		if err := tx.SetAccountConfiguration(ctx, ch, conf); err != nil {
+			t.Fatalf("cannot set configuration: %s", err)
+		}
+		if got, err := tx.AccountConfigurationAt(ctx, 0); err != nil || *got != genesis {
+			t.Fatalf("want %+v, got %+v (%v)", genesis, got, err)
+		}
+		if got, err := tx.AccountConfigurationAt(ctx, 1); err != nil || *got != conf {
+			t.Fatalf("want %+v, got %+v (%v)", conf, got, err)
+		}
+
+		d := models.Domain{
+			Domain:       "domain",
+			Admin:        admin.String(),
+			AccountRenew: time.Minute,
+			MsgFees:      json.RawMessage(`[{"msg_path":"test/a"}]`),
+			ValidUntil:   &validUntil,
+		}
+		if err := tx.InsertDomain(ctx, ch, d); err != nil {
+			t.Fatalf("cannot insert domain: %s", err)
+		}
+		for _, name := range []string{"", "a", "b"} {
+			msg := &account.RegisterAccountMsg{
+				Domain:  "domain",
+				Name:    name,
+				Owner:   owner,
+				Targets: []account.BlockchainAddress{{BlockchainID: "chain", Address: name}},
+			}
+			if err := tx.InsertAccount(ctx, ch, msg, &validUntil); err != nil {
+				t.Fatalf("cannot insert account %q: %s", name, err)
+			}
+		}
+		if err := tx.AddAccountCertificate(ctx, ch, "domain", "a", []byte("cert")); err != nil {
+			t.Fatalf("cannot add certificate: %s", err)
+		}
+		if err := tx.DeleteAccount(ctx, ch, "domain", "b"); err != nil {
+			t.Fatalf("cannot delete account: %s", err)
+		}
+		// Updates of unknown accounts are ignored.
+		if err := tx.RenewAccount(ctx, ch, "domain", "unknown", &validUntil); err != nil {
+			t.Fatalf("cannot renew unknown account: %s", err)
+		}
+		replace := &account.ReplaceAccountTargetsMsg{
+			Domain:     "domain",
+			Name:       "unknown",
+			NewTargets: []account.BlockchainAddress{{BlockchainID: "chain", Address: "unknown"}},
+		}
+		if err := tx.ReplaceAccountTargets(ctx, ch, replace); err != nil {
+			t.Fatalf("cannot replace targets of unknown account: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+
+	d, err := s.LoadDomain(ctx, "domain")
+	if err != nil {
+		t.Fatalf("cannot load domain: %s", err)
+	}
+	if d.Admin != admin.String() || d.Broker != "" || d.AccountRenew != time.Minute || !d.ValidUntil.Equal(validUntil) {
+		t.Fatalf("unexpected domain: %+v", d)
+	}
+	acc, err := s.LoadAccount(ctx, "a", "domain")
+	if err != nil {
+		t.Fatalf("cannot load account: %s", err)
+	}
+	if acc.Broker != "" || !acc.ValidUntil.Equal(validUntil) || len(acc.Certificates) != 1 {
+		t.Fatalf("unexpected account: %+v", acc)
+	}
+	if _, err := s.LoadAccount(ctx, "b", "domain"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want deleted account not found, got %v", err)
+	}
+
+	err = s.InTx(ctx, func(tx *Tx) error {
+		cert := sha256.Sum256([]byte("cert"))
+		if err := tx.DeleteAccountCertificate(ctx, ch, "domain", "a", cert[:]); err != nil {
+			t.Fatalf("cannot delete certificate: %s", err)
+		}
+		if err := tx.TransferDomain(ctx, ch, "domain", admin); err != nil {
+			t.Fatalf("cannot transfer domain: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+	acc, err = s.LoadAccount(ctx, "a", "domain")
+	if err != nil {
+		t.Fatalf("cannot load account: %s", err)
+	}
+	if acc.Owner != admin.String() || len(acc.Certificates) != 0 {
+		t.Fatalf("unexpected transferred account: %+v", acc)
+	}
+	if _, err := s.LoadAccountTargets(ctx, "a", "domain"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want targets removed, got %v", err)
+	}
+
+	err = s.InTx(ctx, func(tx *Tx) error {
+		if err := tx.FlushDomain(ctx, ch, "domain"); err != nil {
+			t.Fatalf("cannot flush domain: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+	if _, err := s.LoadAccount(ctx, "a", "domain"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want flushed account not found, got %v", err)
+	}
+	if _, err := s.LoadAccount(ctx, "", "domain"); err != nil {
+		t.Fatalf("want empty account kept, got %v", err)
+	}
+
+	err = s.InTx(ctx, func(tx *Tx) error {
+		return tx.DeleteDomain(ctx, ch, "domain")
+	})
+	if err != nil {
+		t.Fatalf("cannot delete domain: %s", err)
+	}
+	if _, err := s.LoadDomain(ctx, "domain"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want deleted domain not found, got %v", err)
+	}
+	if _, err := s.LoadAccount(ctx, "", "domain"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want accounts of deleted domain not found, got %v", err)
+	}
+
+	// A deleted domain can be registered again.
+	err = s.InTx(ctx, func(tx *Tx) error {
+		return tx.InsertDomain(ctx, ch, models.Domain{Domain: "domain", Admin: owner.String()})
+	})
+	if err != nil {
+		t.Fatalf("cannot register domain again: %s", err)
+	}
+}
+
+func TestStoreAccountHistory(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	owner := weavetest.NewCondition().Address()
+	changes := []models.Change{
+		{Height: 10, TxHash: "register", MsgPath: "account/register_account"},
+		{Height: 20, TxHash: "replace", MsgPath: "account/replace_account_targets"},
+		{Height: 30, TxHash: "delete", MsgPath: "account/delete_account"},
+	}
+	err := s.InTx(ctx, func(tx *Tx) error {
+		register := &account.RegisterAccountMsg{
+			Domain:  "domain",
+			Name:    "alice",
+			Owner:   owner,
+			Targets: []account.BlockchainAddress{{BlockchainID: "chain", Address: "first"}},
+		}
+		if err := tx.InsertAccount(ctx, changes[0], register, nil); err != nil {
+			t.Fatalf("cannot insert account: %s", err)
+		}
+		replace := &account.ReplaceAccountTargetsMsg{
+			Domain:     "domain",
+			Name:       "alice",
+			NewTargets: []account.BlockchainAddress{{BlockchainID: "chain", Address: "second"}},
+		}
+		if err := tx.ReplaceAccountTargets(ctx, changes[1], replace); err != nil {
+			t.Fatalf("cannot replace targets: %s", err)
+		}
+		if err := tx.DeleteAccount(ctx, changes[2], "domain", "alice"); err != nil {
+			t.Fatalf("cannot delete account: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+
+	if _, err := s.AccountAt(ctx, "domain", "alice", 9); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found before registration, got %v", err)
+	}
+	for height, address := range map[int64]string{10: "first", 19: "first", 20: "second", 29: "second"} {
+		v, err := s.AccountAt(ctx, "domain", "alice", height)
+		if err != nil {
+			t.Fatalf("cannot load account at %d: %s", height, err)
+		}
+		if len(v.Targets) != 1 || v.Targets[0].Address != address || v.Owner != owner.String() {
+			t.Fatalf("want target %q at %d, got %+v", address, height, v)
+		}
+	}
+	if _, err := s.AccountAt(ctx, "domain", "alice", 30); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found after deletion, got %v", err)
+	}
+
+	history, err := s.AccountHistory(ctx, "domain", "alice")
+	if err != nil {
+		t.Fatalf("cannot load history: %s", err)
+	}
+	if len(history) != len(changes) {
+		t.Fatalf("want %d changes, got %+v", len(changes), history)
+	}
+	for i, v := range history {
+		if v.Change != changes[i] {
+			t.Errorf("want change %+v, got %+v", changes[i], v.Change)
+		}
+	}
+	if !history[2].Deleted {
+		t.Errorf("want last change to delete the account")
+	}
+
+	if _, err := s.AccountHistory(ctx, "domain", "bob"); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found history, got %v", err)
+	}
+	if _, err := s.DomainAt(ctx, "domain", 100); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found domain, got %v", err)
+	}
+	if _, err := s.HeightAt(ctx, time.Now()); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found height, got %v", err)
+	}
+}
+
+func TestStoreStarnamesByTarget(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	owner := weavetest.NewCondition().Address()
+	target := account.BlockchainAddress{BlockchainID: "chain", Address: "addr"}
+	other := account.BlockchainAddress{BlockchainID: "chain", Address: "other"}
+	err := s.InTx(ctx, func(tx *Tx) error {
+		for _, a := range []struct {
+			height  int64
+			domain  string
+			name    string
+			targets []account.BlockchainAddress
+		}{
+			{10, "iov", "alice", []account.BlockchainAddress{target, other}},
+			{10, "iov", "bob", []account.BlockchainAddress{other}},
+			{11, "iov", "carol", []account.BlockchainAddress{target}},
+			{12, "star", "alice", []account.BlockchainAddress{target}},
+		} {
+			msg := &account.RegisterAccountMsg{Domain: a.domain, Name: a.name, Owner: owner, Targets: a.targets}
+			if err := tx.InsertAccount(ctx, models.Change{Height: a.height}, msg, nil); err != nil {
+				t.Fatalf("cannot insert account: %s", err)
+			}
+		}
+		// Carol points elsewhere since height 20.
+		replace := &account.ReplaceAccountTargetsMsg{Domain: "iov", Name: "carol", NewTargets: []account.BlockchainAddress{other}}
+		return tx.ReplaceAccountTargets(ctx, models.Change{Height: 20}, replace)
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+
+	cases := map[string]struct {
+		query StarnameQuery
+		want  []string
+	}{
+		"current": {
+			query: StarnameQuery{BlockchainID: "chain", Address: "addr", Limit: 10},
+			want:  []string{"alice*iov", "alice*star"},
+		},
+		"current in domain": {
+			query: StarnameQuery{BlockchainID: "chain", Address: "addr", Domain: "star", Limit: 10},
+			want:  []string{"alice*star"},
+		},
+		"current next page": {
+			query: StarnameQuery{BlockchainID: "chain", Address: "other", After: &models.Starname{Domain: "iov", Name: "alice"}, Limit: 1},
+			want:  []string{"bob*iov"},
+		},
+		"at height": {
+			query: StarnameQuery{BlockchainID: "chain", Address: "addr", Height: 11, Limit: 10},
+			want:  []string{"alice*iov", "carol*iov"},
+		},
+		"at height in domain": {
+			query: StarnameQuery{BlockchainID: "chain", Address: "addr", Domain: "iov", Height: 19, After: &models.Starname{Domain: "iov", Name: "alice"}, Limit: 10},
+			want:  []string{"carol*iov"},
+		},
+		"at height after change": {
+			query: StarnameQuery{BlockchainID: "chain", Address: "addr", Height: 20, Limit: 10},
+			want:  []string{"alice*iov", "alice*star"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			names, err := s.StarnamesByTarget(ctx, tc.query)
+			if err != nil {
+				t.Fatalf("cannot load starnames: %s", err)
+			}
+			var got []string
+			for _, n := range names {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := s.StarnamesByTarget(ctx, StarnameQuery{BlockchainID: "chain", Address: "addr", Height: 9, Limit: 10}); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+	if _, err := s.StarnamesByTarget(ctx, StarnameQuery{Limit: 101}); !ErrLimit.Is(err) {
+		t.Fatalf("want limit error, got %v", err)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	owner := weavetest.NewCondition().Address()
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int) *time.Time {
+		t := now.AddDate(0, 0, days)
+		return &t
+	}
+	err := s.InTx(ctx, func(tx *Tx) error {
+		ch := models.Change{Height: 1, Time: now}
+		for domain, validUntil := range map[string]*time.Time{"expired": at(-1), "soon": at(5), "later": at(50), "unknown": nil} {
+			d := models.Domain{Domain: domain, Admin: owner.String(), ValidUntil: validUntil}
+			if err := tx.InsertDomain(ctx, ch, d); err != nil {
+				t.Fatalf("cannot insert domain: %s", err)
+			}
+		}
+		for name, validUntil := range map[string]*time.Time{"a": at(-2), "b": at(-1), "c": at(3), "d": at(3)} {
+			msg := &account.RegisterAccountMsg{Domain: "soon", Name: name, Owner: owner}
+			if err := tx.InsertAccount(ctx, ch, msg, validUntil); err != nil {
+				t.Fatalf("cannot insert account: %s", err)
+			}
+		}
+		if err := tx.DeleteAccount(ctx, ch, "soon", "b"); err != nil {
+			t.Fatalf("cannot delete account: %s", err)
+		}
+
+		renew := models.Change{Height: 2, Time: now, TxHash: "renew", MsgPath: "account/renew_domain"}
+		if err := tx.RenewDomain(ctx, renew, "soon", at(20)); err != nil {
+			t.Fatalf("cannot renew domain: %s", err)
+		}
+		renew.Height = 3
+		if err := tx.RenewAccount(ctx, renew, "soon", "c", at(30)); err != nil {
+			t.Fatalf("cannot renew account: %s", err)
+		}
+		// A renewal is recorded even if the new expiration is not known.
+		if err := tx.RenewDomain(ctx, renew, "unknown", nil); err != nil {
+			t.Fatalf("cannot renew domain: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+
+	domains, err := s.ExpiringDomains(ctx, now, *at(60), nil, 10)
+	if err != nil {
+		t.Fatalf("cannot load expiring domains: %s", err)
+	}
+	if len(domains) != 2 || domains[0].Domain != "soon" || domains[1].Domain != "later" {
+		t.Fatalf("unexpected expiring domains: %+v", domains)
+	}
+	domains, err = s.ExpiringDomains(ctx, now, *at(60), &domains[0], 10)
+	if err != nil || len(domains) != 1 || domains[0].Domain != "later" {
+		t.Fatalf("unexpected next page: %+v (%v)", domains, err)
+	}
+	domains, err = s.ExpiredDomains(ctx, now, nil, 10)
+	if err != nil || len(domains) != 1 || domains[0].Domain != "expired" {
+		t.Fatalf("unexpected expired domains: %+v (%v)", domains, err)
+	}
+
+	accounts, err := s.ExpiringAccounts(ctx, now, *at(10), nil, 10)
+	if err != nil || len(accounts) != 1 || accounts[0].Name != "d" {
+		t.Fatalf("unexpected expiring accounts: %+v (%v)", accounts, err)
+	}
+	accounts, err = s.ExpiredAccounts(ctx, now, nil, 10)
+	if err != nil || len(accounts) != 1 || accounts[0].Name != "a" {
+		t.Fatalf("unexpected expired accounts: %+v (%v)", accounts, err)
+	}
+	if _, err := s.ExpiredAccounts(ctx, now, &accounts[0], 10); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+	if _, err := s.ExpiredAccounts(ctx, now, nil, 101); !ErrLimit.Is(err) {
+		t.Fatalf("want limit error, got %v", err)
+	}
+
+	renewals, err := s.DomainRenewals(ctx, "soon")
+	if err != nil {
+		t.Fatalf("cannot load renewals: %s", err)
+	}
+	if len(renewals) != 2 {
+		t.Fatalf("want two renewals, got %+v", renewals)
+	}
+	if r := renewals[0]; r.Name != nil || !r.PreviousValidUntil.Equal(*at(5)) || !r.ValidUntil.Equal(*at(20)) {
+		t.Fatalf("unexpected domain renewal: %+v", r)
+	}
+	if r := renewals[1]; r.Name == nil || *r.Name != "c" || !r.PreviousValidUntil.Equal(*at(3)) || r.Height != 3 {
+		t.Fatalf("unexpected account renewal: %+v", r)
+	}
+	renewals, err = s.DomainRenewals(ctx, "unknown")
+	if err != nil {
+		t.Fatalf("cannot load renewals: %s", err)
+	}
+	if len(renewals) != 1 || renewals[0].PreviousValidUntil != nil || renewals[0].ValidUntil != nil {
+		t.Fatalf("unexpected renewals: %+v", renewals)
+	}
+}
+
+func TestStoreLedger(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	entries := []models.LedgerEntry{
+		{Change: models.Change{Height: 1, TxHash: "a"}, Address: "alice", Ticker: "IOV", Whole: 10, Kind: "send", Counterparty: "bob"},
+		{Change: models.Change{Height: 2, TxHash: "b"}, Address: "alice", Ticker: "IOV", Whole: -1, Fractional: -500000000, Kind: "send"},
+		{Change: models.Change{Height: 2, TxHash: "b"}, Address: "alice", Ticker: "IOV", Fractional: -600000000, Kind: "fee"},
+		{Change: models.Change{Height: 3, TxHash: "c"}, Address: "alice", Ticker: "CASH", Whole: 5, Kind: "send"},
+		{Change: models.Change{Height: 3, TxHash: "c"}, Address: "bob", Ticker: "IOV", Whole: 1, Kind: "send"},
+		{Change: models.Change{Height: 4, TxHash: "d"}, Address: "alice", Ticker: "IOV", Whole: -9, Kind: "send"},
+	}
+	err := s.InTx(ctx, func(tx *Tx) error {
+		return tx.InsertLedgerEntries(ctx, entries)
+	})
+	if err != nil {
+		t.Fatalf("cannot insert ledger entries: %s", err)
+	}
+
+	cases := map[int64][]models.Balance{
+		1: {{Address: "alice", Ticker: "IOV", Whole: 10}},
+		2: {{Address: "alice", Ticker: "IOV", Whole: 7, Fractional: 900000000}},
+		3: {
+			{Address: "alice", Ticker: "CASH", Whole: 5},
+			{Address: "alice", Ticker: "IOV", Whole: 7, Fractional: 900000000},
+		},
+		4: {
+			{Address: "alice", Ticker: "CASH", Whole: 5},
+			{Address: "alice", Ticker: "IOV", Whole: -1, Fractional: -100000000},
+		},
+	}
+	for height, want := range cases {
+		got, err := s.BalanceAt(ctx, "alice", height)
+		if err != nil {
+			t.Fatalf("cannot load balance at %d: %s", height, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("at %d want %+v, got %+v", height, want, got)
+		}
+	}
+	if _, err := s.BalanceAt(ctx, "bob", 2); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	page, err := s.Statement(ctx, "alice", nil, 3)
+	if err != nil {
+		t.Fatalf("cannot load statement: %s", err)
+	}
+	if len(page) != 3 || page[0].Counterparty != "bob" || page[2].Kind != "fee" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	page, err = s.Statement(ctx, "alice", &page[2], 3)
+	if err != nil {
+		t.Fatalf("cannot load statement: %s", err)
+	}
+	if len(page) != 2 || page[0].TxHash != "c" || page[1].TxHash != "d" {
+		t.Fatalf("unexpected second page: %+v", page)
+	}
+	if _, err := s.Statement(ctx, "alice", &page[1], 3); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+	if _, err := s.Statement(ctx, "alice", nil, 101); !ErrLimit.Is(err) {
+		t.Fatalf("want limit error, got %v", err)
+	}
+
+	err = s.InTx(ctx, func(tx *Tx) error {
+		if got, err := tx.BalanceAt(ctx, "bob", 3); err != nil || len(got) != 1 || got[0].Whole != 1 {
+			t.Fatalf("unexpected balance: %+v (%v)", got, err)
+		}
+		if got, err := tx.LedgerCounterparty(ctx, "alice", "send"); err != nil || got != "bob" {
+			t.Fatalf("want bob, got %q (%v)", got, err)
+		}
+		if _, err := tx.LedgerCounterparty(ctx, "bob", "fee"); !errors.ErrNotFound.Is(err) {
+			t.Fatalf("want not found error, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+}
+
+func TestStoreCashConfiguration(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	initial := models.CashConfiguration{MinimalFee: models.Coin{Ticker: "IOV", Fractional: 10000000}}
+	if err := s.InitCashConfiguration(ctx, 5, initial); err != nil {
+		t.Fatalf("cannot init configuration: %s", err)
+	}
+	ch := models.Change{Height: 7, TxHash: "tx", MsgPath: "cash/update_configuration"}
+	err := s.InTx(ctx, func(tx *Tx) error {
+		if _, err := tx.CashConfigurationAt(ctx, 4); !errors.ErrNotFound.Is(err) {
+			t.Fatalf("want not found error, got %v", err)
+		}
+		if got, err := tx.CashConfigurationAt(ctx, 5); err != nil || *got != initial {
+			t.Fatalf("want %+v, got %+v (%v)", initial, got, err)
+		}
+		return tx.SetCashConfiguration(ctx, ch, models.CashConfiguration{})
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+	// Configuration known at a height is not replaced.
+	if err := s.InitCashConfiguration(ctx, 5, models.CashConfiguration{}); err != nil {
+		t.Fatalf("cannot init configuration: %s", err)
+	}
+	err = s.InTx(ctx, func(tx *Tx) error {
+		if got, err := tx.CashConfigurationAt(ctx, 6); err != nil || *got != initial {
+			t.Fatalf("want %+v, got %+v (%v)", initial, got, err)
+		}
+		if got, err := tx.CashConfigurationAt(ctx, 7); err != nil || *got != (models.CashConfiguration{}) {
+			t.Fatalf("want empty configuration, got %+v (%v)", got, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("transaction failed: %s", err)
+	}
+}
+
+func TestStoreEscrows(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	timeout := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := models.Escrow{
+		ID:          []byte{0, 0, 0, 0, 0, 0, 0, 1},
+		Address:     "escrow1",
+		Source:      "alice",
+		Arbiter:     "carol",
+		Destination: "bob",
+		Amount:      []models.Coin{{Ticker: "IOV", Whole: 10}},
+		Timeout:     timeout,
+		Memo:        "first",
+		State:       models.EscrowOpen,
+	}
+	second := first
+	second.ID = []byte{0, 0, 0, 0, 0, 0, 0, 2}
+	second.Address = "escrow2"
+	second.Source = "bob"
+	second.Destination = "dave"
+	second.Timeout = timeout.Add(time.Hour)
+
+	err := s.InTx(ctx, func(tx *Tx) error {
+		for _, e := range []models.Escrow{first, second} {
+			if err := tx.SaveEscrow(ctx, models.Change{Height: 1, TxHash: "a"}, "create", e.Amount, e); err != nil {
+				return err
+			}
+		}
+		released := first
+		released.Amount = []models.Coin{{Ticker: "IOV", Whole: 4}}
+		return tx.SaveEscrow(ctx, models.Change{Height: 2, TxHash: "b"}, "release",
+			[]models.Coin{{Ticker: "IOV", Whole: 6}}, released)
+	})
+	if err != nil {
+		t.Fatalf("cannot save escrows: %s", err)
+	}
+
+	open, err := s.OpenEscrows(ctx, "bob", nil, 1)
+	if err != nil {
+		t.Fatalf("cannot load open escrows: %s", err)
+	}
+	if len(open) != 1 || open[0].Memo != "first" || open[0].Amount[0].Whole != 4 {
+		t.Fatalf("unexpected first page: %+v", open)
+	}
+	open, err = s.OpenEscrows(ctx, "bob", &open[0], 1)
+	if err != nil {
+		t.Fatalf("cannot load open escrows: %s", err)
+	}
+	if len(open) != 1 || open[0].Address != "escrow2" {
+		t.Fatalf("unexpected second page: %+v", open)
+	}
+	if _, err := s.OpenEscrows(ctx, "eve", nil, 10); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	at, err := s.EscrowAt(ctx, first.ID, 1)
+	if err != nil {
+		t.Fatalf("cannot load escrow: %s", err)
+	}
+	if !reflect.DeepEqual(*at, first) {
+		t.Fatalf("want %+v, got %+v", first, *at)
+	}
+	if _, err := s.EscrowAt(ctx, first.ID, 0); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	expired, err := s.ExpiredEscrows(ctx, timeout, nil, 10)
+	if err != nil {
+		t.Fatalf("cannot load expired escrows: %s", err)
+	}
+	if len(expired) != 1 || expired[0].Address != "escrow1" {
+		t.Fatalf("unexpected expired escrows: %+v", expired)
+	}
+
+	err = s.InTx(ctx, func(tx *Tx) error {
+		returned := *at
+		returned.Amount = nil
+		returned.State = models.EscrowReturned
+		return tx.SaveEscrow(ctx, models.Change{Height: 3, TxHash: "c"}, "return", at.Amount, returned)
+	})
+	if err != nil {
+		t.Fatalf("cannot return escrow: %s", err)
+	}
+	expired, err = s.ExpiredEscrows(ctx, timeout.Add(time.Hour), nil, 10)
+	if err != nil {
+		t.Fatalf("cannot load expired escrows: %s", err)
+	}
+	if len(expired) != 1 || expired[0].Address != "escrow2" {
+		t.Fatalf("returned escrow must not be expired: %+v", expired)
+	}
+
+	events, err := s.EscrowEvents(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("cannot load escrow events: %s", err)
+	}
+	var kinds []string
+	for _, ev := range events {
+		kinds = append(kinds, ev.Kind)
+	}
+	if want := []string{"create", "release", "return"}; !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("want %v events, got %v", want, kinds)
+	}
+	if events[1].Moved[0].Whole != 6 || events[2].Escrow.State != models.EscrowReturned {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	// Reindexing an earlier block must not overwrite the current state.
+	err = s.InTx(ctx, func(tx *Tx) error {
+		return tx.SaveEscrow(ctx, models.Change{Height: 1, TxHash: "a"}, "create", first.Amount, first)
+	})
+	if err != nil {
+		t.Fatalf("cannot save escrow: %s", err)
+	}
+	current, err := s.LoadEscrow(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("cannot load escrow: %s", err)
+	}
+	if current.State != models.EscrowReturned {
+		t.Fatalf("want returned escrow, got %+v", current)
+	}
+}
+
+func TestStoreTxsBySignerAndPayer(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+	if err != nil {
+		t.Fatalf("cannot create a validator: %s", err)
+	}
+
+	txs := []models.Transaction{
+		{
+			Hash:    "a1",
+			Message: json.RawMessage(`{"path":"test/msg"}`),
+			Fee:     &models.Fee{Payer: "alice", Ticker: "IOV", Fractional: 600000000},
+			Signers: []string{"alice", "bob"},
+		},
+		{
+			Hash:    "a2",
+			Message: json.RawMessage(`{"path":"test/msg"}`),
+			Fee:     &models.Fee{Payer: "alice", Ticker: "IOV", Whole: 1, Fractional: 500000000},
+			Signers: []string{"bob"},
+		},
+	}
+	block := models.Block{
+		Height:         1,
+		Hash:           hex.EncodeToString([]byte{0, 1}),
+		Time:           time.Now().UTC().Round(time.Microsecond),
+		ProposerID:     vID,
+		ParticipantIDs: []int64{vID},
+		Messages:       []string{},
+		Transactions:   txs,
+	}
+	if err := s.InsertBlock(ctx, block); err != nil {
+		t.Fatalf("cannot insert block: %s", err)
+	}
+
+	signed, err := s.LoadTxsBySigner(ctx, "bob", 10)
+	if err != nil {
+		t.Fatalf("cannot load signed transactions: %s", err)
+	}
+	if len(signed) != 2 {
+		t.Fatalf("want 2 transactions, got %d", len(signed))
+	}
+	signed, err = s.LoadTxsBySigner(ctx, "alice", 10)
+	if err != nil {
+		t.Fatalf("cannot load signed transactions: %s", err)
+	}
+	txs[0].BlockID = 1
+	if len(signed) != 1 || !reflect.DeepEqual(signed[0], txs[0]) {
+		t.Fatalf("want %+v, got %+v", txs[0], signed)
+	}
+	if _, err := s.LoadTxsBySigner(ctx, "carol", 10); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	paid, err := s.LoadTxsByFeePayer(ctx, "alice", 10)
+	if err != nil {
+		t.Fatalf("cannot load paid transactions: %s", err)
+	}
+	if len(paid) != 2 {
+		t.Fatalf("want 2 transactions, got %d", len(paid))
+	}
+
+	fees, err := s.FeesPaidBy(ctx, "alice")
+	if err != nil {
+		t.Fatalf("cannot load fees: %s", err)
+	}
+	want := []models.Fee{{Payer: "alice", Ticker: "IOV", Whole: 2, Fractional: 100000000}}
+	if !reflect.DeepEqual(fees, want) {
+		t.Fatalf("want %+v, got %+v", want, fees)
+	}
+}
+
+func TestStoreMultisigContracts(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	first := models.MultisigContract{
+		ID:      []byte{0, 0, 0, 0, 0, 0, 0, 1},
+		Address: "multisig1",
+		Participants: []models.MultisigParticipant{
+			{Address: "alice", Weight: 1},
+			{Address: "bob", Weight: 2},
+		},
+		ActivationThreshold: 2,
+		AdminThreshold:      3,
+	}
+	second := models.MultisigContract{
+		ID:                  []byte{0, 0, 0, 0, 0, 0, 0, 2},
+		Address:             "multisig2",
+		Participants:        []models.MultisigParticipant{{Address: "bob", Weight: 1}},
+		ActivationThreshold: 1,
+		AdminThreshold:      1,
+	}
+	updated := first
+	updated.Participants = []models.MultisigParticipant{{Address: "carol", Weight: 5}}
+
+	err := s.InTx(ctx, func(tx *Tx) error {
+		for _, c := range []models.MultisigContract{first, second} {
+			if err := tx.SaveMultisigContract(ctx, models.Change{Height: 1}, c); err != nil {
+				return err
+			}
+		}
+		if err := tx.SaveMultisigContract(ctx, models.Change{Height: 3}, updated); err != nil {
+			return err
+		}
+		// Reindexing an earlier block must not overwrite the update.
+		return tx.SaveMultisigContract(ctx, models.Change{Height: 1}, first)
+	})
+	if err != nil {
+		t.Fatalf("cannot save multisig contracts: %s", err)
+	}
+
+	c, err := s.LoadMultisigContract(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("cannot load multisig contract: %s", err)
+	}
+	if !reflect.DeepEqual(*c, updated) {
+		t.Fatalf("want %+v, got %+v", updated, *c)
+	}
+
+	contracts, err := s.MultisigContractsByParticipant(ctx, "bob", nil, 10)
+	if err != nil {
+		t.Fatalf("cannot load multisig contracts: %s", err)
+	}
+	if len(contracts) != 1 || !reflect.DeepEqual(contracts[0], second) {
+		t.Fatalf("want %+v, got %+v", second, contracts)
+	}
+	if _, err := s.MultisigContractsByParticipant(ctx, "alice", nil, 10); !errors.ErrNotFound.Is(err) {
+		t.Fatalf("want not found error, got %v", err)
+	}
+
+	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+	if err != nil {
+		t.Fatalf("cannot create a validator: %s", err)
+	}
+	block := models.Block{
+		Height:         1,
+		Hash:           hex.EncodeToString([]byte{0, 1}),
+		Time:           time.Now().UTC().Round(time.Microsecond),
+		ProposerID:     vID,
+		ParticipantIDs: []int64{vID},
+		Messages:       []string{},
+		Transactions: []models.Transaction{
+			{Hash: "a1", Message: json.RawMessage(`{"path":"test/msg"}`), Multisigs: [][]byte{first.ID, second.ID}},
+			{Hash: "a2", Message: json.RawMessage(`{"path":"test/msg"}`), Multisigs: [][]byte{second.ID, second.ID}},
+			{Hash: "a3", Message: json.RawMessage(`{"path":"test/msg"}`)},
+		},
+	}
+	if err := s.InsertBlock(ctx, block); err != nil {
+		t.Fatalf("cannot insert block: %s", err)
+	}
+
+	txs, err := s.LoadTxsByMultisig(ctx, second.ID, 10)
+	if err != nil {
+		t.Fatalf("cannot load transactions: %s", err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("want 2 transactions, got %d", len(txs))
+	}
+	txs, err = s.LoadTxsByMultisig(ctx, first.ID, 10)
+	if err != nil {
+		t.Fatalf("cannot load transactions: %s", err)
+	}
+	if len(txs) != 1 || txs[0].Hash != "a1" {
+		t.Fatalf("unexpected transactions: %+v", txs)
+	}
+}
+
+func TestLoadTxsByParams(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	s := NewStore(db)
+
+	vID, err := s.InsertValidator(ctx, []byte{0x01, 0, 0xbe, 'a'}, []byte{0x02})
+	if err != nil {
+		t.Fatalf("cannot create a validator: %s", err)
+	}
+
+	send := func(source, dest, memo string) models.Message {
+		return models.Message{
+			Path:    "cash/send",
+			Details: json.RawMessage(fmt.Sprintf(`{"source":%q,"destination":%q,"memo":%q}`, source, dest, memo)),
+		}
+	}
+	single := send("alice", "bob", "single")
+	batch := []models.Message{send("carol", "dave", "first"), send("alice", "dave", "second")}
+	singleJSON, _ := json.Marshal(single)
+	batchJSON, _ := json.Marshal(batch)
+
+	block := models.Block{
+		Height:         1,
+		Hash:           hex.EncodeToString([]byte{0, 1}),
+		Time:           time.Now().UTC().Round(time.Microsecond),
+		ProposerID:     vID,
+		ParticipantIDs: []int64{vID},
+		Messages:       []string{"cash/send", "batch"},
+		Transactions: []models.Transaction{
+			{Hash: "single", Message: singleJSON, Messages: []models.Message{single}},
+			{Hash: "batch", Message: batchJSON, Messages: batch},
+		},
+	}
+	if err := s.InsertBlock(ctx, block); err != nil {
+		t.Fatalf("cannot insert block: %s", err)
+	}
+
+	cases := map[string]struct {
+		source, dest, memo string
+		want               []string
+	}{
+		"source in both":                  {source: "alice", want: []string{"batch", "single"}},
+		"destination in batch":            {dest: "dave", want: []string{"batch"}},
+		"memo in batch":                   {memo: "second", want: []string{"batch"}},
+		"same message only":               {source: "carol", memo: "second"},
+		"source and destination":          {source: "alice", dest: "bob", want: []string{"single"}},
+		"source and destination in batch": {source: "alice", dest: "dave", want: []string{"batch"}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			txs, err := s.LoadTxsByParams(ctx, tc.source, tc.dest, tc.memo)
+			if len(tc.want) == 0 {
+				if !errors.ErrNotFound.Is(err) {
+					t.Fatalf("want not found error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot load transactions: %s", err)
+			}
+			var got []string
+			for _, tx := range txs {
+				got = append(got, tx.Hash)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+
+	txs, err := s.LoadTxsByMemo(ctx, "first")
+	if err != nil {
+		t.Fatalf("cannot load transactions by memo: %s", err)
+	}
+	if len(txs) != 1 || txs[0].Hash != "batch" {
+		t.Fatalf("unexpected transactions: %+v", txs)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, cleanup := EnsureDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// All migrations were applied when the database was created.
+	applied, err := Migrate(ctx, db)
+	if err != nil {
+		t.Fatalf("cannot migrate: %s", err)
+	}
+	if len(applied) != 0 {
+		t.Fatalf("want no migration applied, got %d", len(applied))
+	}
+
+	status, err := Migrations(ctx, db)
+	if err != nil {
+		t.Fatalf("cannot get migrations status: %s", err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("want %d migrations, got %d", len(migrations), len(status))
+	}
+	for _, m := range status {
+		if !m.Applied() {
+			t.Fatalf("migration %d not applied", m.Version)
+		}
+	}
+
+	var indexes int
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM pg_indexes
+		WHERE tablename = 'transactions' AND indexdef LIKE '%(transaction_hash)'
+	`).Scan(&indexes)
+	if err != nil {
+		t.Fatalf("cannot count indexes: %s", err)
+	}
+	if indexes != 1 {
+		t.Fatalf("want only the unique transaction hash index, got %d", indexes)
+	}
+
+	// Status of a database that was never migrated must not create the
+	// migrations table.
+	if _, err := db.ExecContext(ctx, `DROP TABLE schema_migrations`); err != nil {
+		t.Fatalf("cannot drop migrations table: %s", err)
+	}
+	status, err = Migrations(ctx, db)
+	if err != nil {
+		t.Fatalf("cannot get migrations status: %s", err)
+	}
+	for _, m := range status {
+		if m.Applied() {
+			t.Fatalf("migration %d must be pending", m.Version)
+		}
+	}
+	var migrated bool
+	err = db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&migrated)
+	if err != nil {
+		t.Fatalf("cannot find migrations table: %s", err)
+	}
+	if migrated {
+		t.Fatal("migrations table must not be created")
+	}
+}
+
+func TestMigrationsOrder(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %q must have version %d, got %d", m.Name, i+1, m.Version)
+		}
+	}
 }
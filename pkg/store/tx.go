@@ -0,0 +1,218 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/iov-one/block-metrics/pkg/models"
+	"github.com/iov-one/weave/errors"
+	"github.com/lib/pq"
+)
+
+// Tx provides write access to the database within a single database
+// transaction. Use Store.InTx to create one.
+type Tx struct {
+	tx *sql.Tx
+}
+
+// InTx calls given function within a database transaction. The transaction
+// is committed if the function succeeds and rolled back otherwise.
+func (s *Store) InTx(ctx context.Context, fn func(*Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot create transaction")
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := fn(&Tx{tx: tx}); err != nil {
+		return err
+	}
+	return wrapPgErr(tx.Commit(), "commit")
+}
+
+// InsertBlock adds a block together with its participations and
+// transactions. ErrConflict is returned if the block or any of its
+// transactions is already present.
+func (t *Tx) InsertBlock(ctx context.Context, b models.Block) error {
+	if len(b.ParticipantIDs) == 0 {
+		return errors.Wrap(ErrConflict, "no participants on block")
+	}
+
+	_, err := t.tx.ExecContext(ctx, `
+		INSERT INTO blocks (block_height, block_hash, block_time, proposer_id, messages,
+			raw_header, raw_commit, raw_results, raw_transactions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, b.Height, b.Hash, b.Time.UTC(), b.ProposerID, pq.Array(b.Messages),
+		jsonValue(b.Header), jsonValue(b.Commit), jsonValue(b.Results), pq.ByteaArray(b.RawTransactions))
+	if err != nil {
+		return wrapPgErr(err, "insert block")
+	}
+
+	rows := make([][]interface{}, 0, len(b.ParticipantIDs)+len(b.MissingIDs))
+	for _, part := range b.ParticipantIDs {
+		rows = append(rows, []interface{}{true, b.Height, part})
+	}
+	for _, missed := range b.MissingIDs {
+		rows = append(rows, []interface{}{false, b.Height, missed})
+	}
+	if err := t.copyIn(ctx, "block_participations", []string{"validated", "block_id", "validator_id"}, rows); err != nil {
+		return errors.Wrap(err, "insert block participants")
+	}
+	return t.insertTransactions(ctx, b)
+}
+
+// ReindexBlock replaces all data derived from transactions of an existing
+// block: transactions, their fees, signers, multisig contracts and
+// messages, and block fee totals. Data recorded by handlers at the block
+// height, like domain and account history, ledger entries or escrow events,
+// is removed as well. ErrNotFound is returned if the block does not exist.
+func (t *Tx) ReindexBlock(ctx context.Context, b models.Block) error {
+	res, err := t.tx.ExecContext(ctx, `
+		UPDATE blocks SET messages = $2 WHERE block_height = $1
+	`, b.Height, pq.Array(b.Messages))
+	if err != nil {
+		return wrapPgErr(err, "update block")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return wrapPgErr(err, "update block")
+	} else if n == 0 {
+		return errors.Wrapf(errors.ErrNotFound, "block %d", b.Height)
+	}
+
+	// Tables referencing transactions must be cleared first.
+	for _, table := range []string{"messages", "transaction_signers", "transaction_fees", "transaction_multisigs"} {
+		_, err := t.tx.ExecContext(ctx, `
+			DELETE FROM `+table+` WHERE transaction_hash IN (
+				SELECT transaction_hash FROM transactions WHERE block_id = $1
+			)
+		`, b.Height)
+		if err != nil {
+			return wrapPgErr(err, "delete "+table)
+		}
+	}
+	for _, table := range []string{"transactions", "block_fees"} {
+		if _, err := t.tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE block_id = $1`, b.Height); err != nil {
+			return wrapPgErr(err, "delete "+table)
+		}
+	}
+	// Data recorded by handlers is recorded again when they run.
+	for _, table := range []string{"account_history", "domain_history", "renewals", "ledger_entries", "escrow_events"} {
+		if _, err := t.tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE height = $1`, b.Height); err != nil {
+			return wrapPgErr(err, "delete "+table)
+		}
+	}
+	// Configuration read from the chain is not set by a transaction.
+	for _, table := range []string{"account_configuration", "cash_configuration"} {
+		_, err := t.tx.ExecContext(ctx, `
+			DELETE FROM `+table+` WHERE height = $1 AND transaction_hash IS NOT NULL
+		`, b.Height)
+		if err != nil {
+			return wrapPgErr(err, "delete "+table)
+		}
+	}
+	return t.insertTransactions(ctx, b)
+}
+
+// insertTransactions adds all transactions of a block, together with their
+// fees, signers, multisig contracts and messages, and the block fee totals.
+func (t *Tx) insertTransactions(ctx context.Context, b models.Block) error {
+	rows := make([][]interface{}, 0, len(b.Transactions))
+	for _, transaction := range b.Transactions {
+		var decodeErr interface{}
+		if transaction.DecodeError != "" {
+			decodeErr = transaction.DecodeError
+		}
+		rows = append(rows, []interface{}{transaction.Hash, b.Height, jsonValue(transaction.Message), decodeErr, transaction.Raw})
+	}
+	if err := t.copyIn(ctx, "transactions", []string{"transaction_hash", "block_id", "message", "decode_error", "raw"}, rows); err != nil {
+		return errors.Wrap(err, "insert transactions")
+	}
+
+	rows = rows[:0]
+	for _, transaction := range b.Transactions {
+		if f := transaction.Fee; f != nil {
+			rows = append(rows, []interface{}{transaction.Hash, f.Payer, f.Ticker, f.Whole, f.Fractional})
+		}
+	}
+	if err := t.copyIn(ctx, "transaction_fees", []string{"transaction_hash", "payer", "ticker", "whole", "fractional"}, rows); err != nil {
+		return errors.Wrap(err, "insert transaction fees")
+	}
+
+	rows = rows[:0]
+	for _, transaction := range b.Transactions {
+		for i, signer := range transaction.Signers {
+			rows = append(rows, []interface{}{transaction.Hash, i, signer})
+		}
+	}
+	if err := t.copyIn(ctx, "transaction_signers", []string{"transaction_hash", "signer_index", "signer"}, rows); err != nil {
+		return errors.Wrap(err, "insert transaction signers")
+	}
+
+	rows = rows[:0]
+	for _, transaction := range b.Transactions {
+		used := make(map[string]bool)
+		for _, id := range transaction.Multisigs {
+			if !used[string(id)] {
+				used[string(id)] = true
+				rows = append(rows, []interface{}{transaction.Hash, id})
+			}
+		}
+	}
+	if err := t.copyIn(ctx, "transaction_multisigs", []string{"transaction_hash", "contract_id"}, rows); err != nil {
+		return errors.Wrap(err, "insert transaction multisigs")
+	}
+
+	rows = rows[:0]
+	for _, transaction := range b.Transactions {
+		for i, m := range transaction.Messages {
+			rows = append(rows, []interface{}{transaction.Hash, i, m.Path, jsonValue(m.Details)})
+		}
+	}
+	if err := t.copyIn(ctx, "messages", []string{"transaction_hash", "message_index", "path", "details"}, rows); err != nil {
+		return errors.Wrap(err, "insert messages")
+	}
+
+	rows = rows[:0]
+	for _, f := range b.Fees {
+		rows = append(rows, []interface{}{b.Height, f.Ticker, f.Whole, f.Fractional})
+	}
+	if err := t.copyIn(ctx, "block_fees", []string{"block_id", "ticker", "whole", "fractional"}, rows); err != nil {
+		return errors.Wrap(err, "insert block fees")
+	}
+	return nil
+}
+
+// jsonValue returns the COPY value of a JSONB column. COPY encodes bytes as
+// bytea, which cannot be cast to JSONB, so a string must be used instead.
+func jsonValue(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
+
+// copyIn inserts all rows into given table using a single COPY statement.
+func (t *Tx) copyIn(ctx context.Context, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	stmt, err := t.tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return wrapPgErr(err, "prepare copy")
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			_ = stmt.Close()
+			return wrapPgErr(err, "copy row")
+		}
+	}
+	// Rows are buffered and constraint violations are reported only
+	// when the copy is flushed.
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		return wrapPgErr(err, "flush copy")
+	}
+	return wrapPgErr(stmt.Close(), "close copy")
+}